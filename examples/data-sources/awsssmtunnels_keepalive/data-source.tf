@@ -1,7 +1,12 @@
 // NOTE: We use the *_keepalive data resource to prevent the provider from being shut down prematurely
 // We need the tunnel to stay up until all the resources for the providers using the tunnel are done
-// reading or writing from it.
+// reading or writing from it. Reading it waits until the tunnels have had no client connections
+// for idle_period, and reports how much they were used in stats.
 data "awsssmtunnels_keepalive" "eks" {
+  tunnels     = [awsssmtunnels_remote_tunnel.eks.id]
+  idle_period = "10s"
+  max_wait    = "10m"
+
   depends_on = [
     kubernetes_secret.one,
     kubernetes_secret.two,
@@ -12,7 +17,13 @@ data "awsssmtunnels_keepalive" "eks" {
 }
 
 data "awsssmtunnels_keepalive" "rds" {
+  tunnels = [awsssmtunnels_remote_tunnel.rds.id]
+
   depends_on = [
     postgresql_tables.my_tables,
   ]
 }
+
+output "eks_tunnel_bytes_received" {
+  value = data.awsssmtunnels_keepalive.eks.stats[awsssmtunnels_remote_tunnel.eks.id].bytes_received
+}
@@ -0,0 +1,16 @@
+// The tunnel is opened when Terraform needs the provider configurations referencing it, kept
+// open while they are in use, and closed at the end of the run. Unlike the resource, it is never
+// stored in state, so it needs no awsssmtunnels_keepalive data source.
+// Ephemeral resources require Terraform 1.10 or later.
+ephemeral "awsssmtunnels_remote_tunnel" "rds" {
+  target      = "i-123456789"
+  remote_host = aws_rds_cluster.example.endpoint
+  remote_port = 5432
+}
+
+provider "postgresql" {
+  host     = ephemeral.awsssmtunnels_remote_tunnel.rds.local_host
+  port     = ephemeral.awsssmtunnels_remote_tunnel.rds.local_port
+  username = aws_rds_cluster.example.master_username
+  password = aws_rds_cluster.example.master_password
+}
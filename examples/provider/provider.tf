@@ -21,3 +21,51 @@ provider "awsssmtunnels" {
   shared_config_files = [var.tfc_aws_dynamic_credentials.default.shared_config_file]
   target              = "i-123456789"
 }
+
+// OR start a stopped bastion, and stop it again once Terraform is done
+
+provider "awsssmtunnels" {
+  region = "us-east-1"
+  target = "i-123456789"
+
+  auto_start_target = {
+    stop_on_shutdown = true
+    timeout          = "5m"
+  }
+}
+
+// OR route every tunnel through a Fargate task launched for the run, and stopped afterwards
+
+provider "awsssmtunnels" {
+  region = "us-east-1"
+
+  ephemeral_bastion = {
+    cluster         = "tools"
+    task_definition = "bastion"
+    subnets         = ["subnet-0123456789abcdef0"]
+    security_groups = ["sg-0123456789abcdef0"]
+  }
+}
+
+// OR start tunnels with the provider, so other providers can use their fixed ports from the first plan
+
+provider "awsssmtunnels" {
+  region = "us-east-1"
+  target = "i-123456789"
+
+  tunnel {
+    name        = "rds"
+    remote_host = "mydb.cluster-abcdefghijkl.us-east-1.rds.amazonaws.com"
+    remote_port = 5432
+    local_port  = 17638
+  }
+}
+
+provider "postgresql" {
+  host     = "127.0.0.1"
+  port     = 17638
+  database = "mydb"
+  username = var.pg_user
+  password = var.pg_password
+  sslmode  = "require"
+}
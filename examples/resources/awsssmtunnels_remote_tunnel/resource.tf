@@ -25,7 +25,6 @@ data "aws_eks_cluster_auth" "example" {
 }
 
 resource "awsssmtunnels_remote_tunnel" "eks" {
-  refresh_id  = "one" // Anything string can go here as this resource will always find a diff on this
   target      = "i-123456789"
   remote_host = replace(aws_eks_cluster.example.endpoint, "https://", "")
   remote_port = 443
@@ -33,24 +32,21 @@ resource "awsssmtunnels_remote_tunnel" "eks" {
   region      = "us-east-1"
 }
 
-// NOTE: The import is needed for the first plan, otherwise TF will hold off on the create until the Apply phase.
-// The import allows it to run in the very first plan.
-import {
-  id = "i-123456789|${replace(aws_eks_cluster.example.endpoint, "https://", "")}|443|16534|127.0.0.1|us-east-1"
-  to = awsssmtunnels_remote_tunnel.eks
-}
+// NOTE: The tunnel is opened while planning once its settings are known, and its local_host and local_port
+// are pinned in the plan, so the providers using it can reach the cluster during the very first plan.
 
 // NOTE: We use the *_keepalive data resource to prevent the provider from being shut down prematurely
 // We need the tunnel to stay up until all the resources for the providers using the tunnel are done
 // reading or writing from it.
 data "awsssmtunnels_keepalive" "eks" {
+  tunnels = [awsssmtunnels_remote_tunnel.eks.id]
+
   depends_on = [
     kubernetes_secret.one,
     kubernetes_secret.two,
     kubernetes_config_map.one,
     kubernetes_config_map.two,
     helm_release.example_operator,
-    awsssmtunnels_remote_tunnel.eks,
   ]
 }
 
@@ -60,21 +56,16 @@ data "awsssmtunnels_keepalive" "eks" {
 ##############################################
 
 resource "awsssmtunnels_remote_tunnel" "rds" {
-  refresh_id  = "one" // Anything string can go here as this resource will always find a diff on this
   remote_host = aws_rds_cluster.example.endpoint
   remote_port = 5432 // This is a PostgreSQL RDS cluster example
   local_port  = 17638
 }
 
-import {
-  id = "<remote host>|<remote port>|<local port>|127.0.0.1"
-  to = awsssmtunnels_remote_tunnel.rds
-}
-
 data "awsssmtunnels_keepalive" "rds" {
+  tunnels = [awsssmtunnels_remote_tunnel.rds.id]
+
   depends_on = [
     postgresql_tables.my_tables,
-    awsssmtunnels_remote_tunnel.rds,
   ]
 }
 
@@ -92,3 +83,97 @@ data "postgresql_tables" "my_tables" {
   database   = "mydb"
   depends_on = [awsssmtunnels_remote_tunnel.rds] // NOTE: The tunnel must be up before we can query the database
 }
+
+##############################################
+######## Port on the target example ##########
+##############################################
+
+// Without remote_host, the tunnel forwards to a port on the target itself using the
+// AWS-StartPortForwardingSession document, for services running on the instance.
+resource "awsssmtunnels_remote_tunnel" "admin" {
+  remote_port = 8080
+}
+
+##############################################
+######## Custom document example #############
+##############################################
+
+// Organization-managed documents can be used instead of the AWS-owned ones. Their parameters
+// are checked against the document when planning.
+resource "awsssmtunnels_remote_tunnel" "custom" {
+  remote_host   = aws_rds_cluster.example.endpoint
+  remote_port   = 5432
+  document_name = "MyOrg-StartPortForwardingSessionToRemoteHost"
+  document_parameters = {
+    // Declared by the document, along with portNumber and host
+    changeTicket = "OPS-1234"
+  }
+}
+
+##############################################
+######## Tag-selected bastion example ########
+##############################################
+
+// Instead of a hard-coded instance ID, the bastion is picked among the running instances with
+// matching tags whose SSM agent is online. resolved_target shows which one was picked, and it is
+// kept until it goes away, for example when its autoscaling group replaces it.
+resource "awsssmtunnels_remote_tunnel" "selected" {
+  remote_host = aws_rds_cluster.example.endpoint
+  remote_port = 5432
+  target_selector = {
+    tags = {
+      Role = "bastion"
+      Env  = "prod-*"
+    }
+    ssm_filters = {
+      PlatformTypes = ["Linux"]
+    }
+    strategy = "newest"
+  }
+}
+
+##############################################
+######## Failover example ####################
+##############################################
+
+// The targets are tried in order: when the first bastion is not connected, the tunnel starts on
+// the next one. A running tunnel whose session is lost also moves to the next bastion.
+// resolved_target shows the bastion in use.
+resource "awsssmtunnels_remote_tunnel" "failover" {
+  targets     = ["i-123456789", "i-987654321"]
+  remote_host = aws_rds_cluster.example.endpoint
+  remote_port = 5432
+}
+
+##############################################
+######## Bastion created in the same run #####
+##############################################
+
+// The SSM agent of a new instance takes a while to register. The tunnel waits for it to be online,
+// checking every 15 seconds for up to 10 minutes, so the VPC, its bastion and the resources
+// reached through the tunnel can be created in a single apply.
+resource "awsssmtunnels_remote_tunnel" "new_bastion" {
+  target                = aws_instance.bastion.id
+  remote_host           = aws_rds_cluster.example.endpoint
+  remote_port           = 5432
+  target_online_timeout = "10m"
+  target_poll_interval  = "15s"
+}
+
+##############################################
+######## ECS Exec example ####################
+##############################################
+
+// The tunnel goes through the "bastion" container of a task of the "bastion" Fargate service,
+// which must have ECS Exec enabled. The task is looked up when the tunnel starts, so deployments
+// of the service do not break the configuration.
+resource "awsssmtunnels_remote_tunnel" "ecs" {
+  remote_host = aws_rds_cluster.example.endpoint
+  remote_port = 5432
+
+  ecs_target = {
+    cluster   = "tools"
+    service   = "bastion"
+    container = "bastion"
+  }
+}
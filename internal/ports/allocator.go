@@ -0,0 +1,126 @@
+// Package ports hands out the local ports tunnels listen on.
+package ports
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// listenHost is the address tunnels listen on.
+const listenHost = "127.0.0.1"
+
+// Allocator binds local ports for tunnels. A port it bound stays reserved
+// until its listener is closed, so concurrent allocations never pick the same
+// port, and the listener is handed over to the tunnel instead of being bound
+// again. It is safe for concurrent use.
+type Allocator struct {
+	lower, upper int
+
+	mu       sync.Mutex
+	reserved map[int]bool
+}
+
+// NewAllocator returns an allocator picking ports between lower and upper,
+// inclusive. When both are 0, the OS picks the ports.
+func NewAllocator(lower, upper int) (*Allocator, error) {
+	if lower == 0 && upper == 0 {
+		return &Allocator{reserved: make(map[int]bool)}, nil
+	}
+	if lower < 1 || upper < 1 {
+		return nil, errors.New("port range must be positive")
+	}
+	if lower > upper {
+		return nil, errors.New("lower port must be less than upper port")
+	}
+	if upper > 65535 {
+		return nil, errors.New("port range must be less than 65536")
+	}
+	return &Allocator{
+		lower:    lower,
+		upper:    upper,
+		reserved: make(map[int]bool),
+	}, nil
+}
+
+// Listen binds port, or an open port of the range when port is 0, or a port
+// the OS picks when the allocator has no range. The port is released once
+// the listener is closed.
+func (a *Allocator) Listen(port int) (net.Listener, error) {
+	if port != 0 || a.lower == 0 {
+		return a.listen(port)
+	}
+
+	// The search starts at a random port, so allocators of concurrent
+	// processes are unlikely to race for the same ports
+	return a.ListenFrom(a.lower + rand.Intn(a.upper-a.lower+1))
+}
+
+// ListenFrom binds the first open port of the range from port on, wrapping
+// around, so the same port is picked as long as the ports before it are
+// taken alike. The OS picks the port when the allocator has no range. The
+// port is released once the listener is closed.
+func (a *Allocator) ListenFrom(port int) (net.Listener, error) {
+	if a.lower == 0 {
+		return a.listen(0)
+	}
+	if port < a.lower || port > a.upper {
+		return nil, fmt.Errorf("port %d is outside the range %d-%d", port, a.lower, a.upper)
+	}
+
+	size := a.upper - a.lower + 1
+	for i := range size {
+		listener, err := a.listen(a.lower + (port-a.lower+i)%size)
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no open port found in the range %d-%d", a.lower, a.upper)
+}
+
+// listen binds port unless it is reserved, and reserves the bound port. The
+// OS picks the port when port is 0.
+func (a *Allocator) listen(port int) (net.Listener, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if port != 0 && a.reserved[port] {
+		return nil, fmt.Errorf("port %d is already in use by another tunnel", port)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("unexpected listener address %s", listener.Addr())
+	}
+	port = addr.Port
+	a.reserved[port] = true
+	return &reservedListener{Listener: listener, allocator: a, port: port}, nil
+}
+
+func (a *Allocator) release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.reserved, port)
+}
+
+// reservedListener releases its port when closed.
+type reservedListener struct {
+	net.Listener
+	allocator *Allocator
+	port      int
+	closeOnce sync.Once
+}
+
+func (l *reservedListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		l.allocator.release(l.port)
+	})
+	return err
+}
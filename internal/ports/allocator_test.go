@@ -0,0 +1,215 @@
+package ports
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestNewAllocatorRejectsInvalidRanges(t *testing.T) {
+	for _, r := range [][2]int{{0, 100}, {100, 0}, {-1, 100}, {200, 100}, {100, 70000}} {
+		if _, err := NewAllocator(r[0], r[1]); err == nil {
+			t.Errorf("NewAllocator(%d, %d) did not fail", r[0], r[1])
+		}
+	}
+}
+
+func TestListenPicksPortsInRange(t *testing.T) {
+	lower, upper := freeRange(t, 5)
+	allocator, err := NewAllocator(lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int]bool)
+	for range 5 {
+		listener, err := allocator.Listen(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		port := listenerPort(t, listener)
+		if port < lower || port > upper {
+			t.Errorf("port %d is outside of %d-%d", port, lower, upper)
+		}
+		if seen[port] {
+			t.Errorf("port %d was handed out twice", port)
+		}
+		seen[port] = true
+	}
+
+	if _, err := allocator.Listen(0); err == nil {
+		t.Error("Listen succeeded with every port of the range in use")
+	}
+}
+
+func TestListenReservesPortUntilClosed(t *testing.T) {
+	lower, upper := freeRange(t, 1)
+	allocator, err := NewAllocator(lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := allocator.Listen(lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocator.Listen(lower); err == nil {
+		t.Fatal("reserved port was handed out again")
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing twice releases the port once
+	listener.Close()
+
+	listener, err = allocator.Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if port := listenerPort(t, listener); port != lower {
+		t.Errorf("got port %d, want the released port %d", port, lower)
+	}
+}
+
+func TestListenFrom(t *testing.T) {
+	lower, upper := freeRange(t, 3)
+	allocator, err := NewAllocator(lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	middle, err := allocator.ListenFrom(lower + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer middle.Close()
+	if port := listenerPort(t, middle); port != lower+1 {
+		t.Fatalf("got port %d, want %d", port, lower+1)
+	}
+	// Taken ports are skipped, wrapping around the range
+	last, err := allocator.ListenFrom(lower + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer last.Close()
+	if port := listenerPort(t, last); port != upper {
+		t.Errorf("got port %d, want the next open port %d", port, upper)
+	}
+	first, err := allocator.ListenFrom(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if port := listenerPort(t, first); port != lower {
+		t.Errorf("got port %d, want the range to wrap around to %d", port, lower)
+	}
+
+	if _, err := allocator.ListenFrom(upper + 1); err == nil {
+		t.Error("ListenFrom succeeded outside of the range")
+	}
+}
+
+func TestListenOSAssignedPorts(t *testing.T) {
+	allocator, err := NewAllocator(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := allocator.Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	port := listenerPort(t, first)
+	if port == 0 {
+		t.Fatal("got port 0, want the port the OS picked")
+	}
+	// The port the OS picked is reserved like any other
+	if _, err := allocator.Listen(port); err == nil {
+		t.Fatal("reserved port was handed out again")
+	}
+
+	second, err := allocator.Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if listenerPort(t, second) == port {
+		t.Errorf("port %d was handed out twice", port)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := allocator.Listen(port)
+	if err != nil {
+		t.Fatalf("released port %d was not handed out: %s", port, err)
+	}
+	listener.Close()
+}
+
+func TestListenConcurrently(t *testing.T) {
+	const count = 10
+	lower, upper := freeRange(t, count)
+	allocator, err := NewAllocator(lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	listeners := make([]net.Listener, count)
+	errs := make([]error, count)
+	for i := range count {
+		wg.Go(func() {
+			listeners[i], errs[i] = allocator.Listen(0)
+		})
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i := range count {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		defer listeners[i].Close()
+		port := listenerPort(t, listeners[i])
+		if seen[port] {
+			t.Errorf("port %d was handed out twice", port)
+		}
+		seen[port] = true
+	}
+}
+
+// freeRange returns a range of size ports which are currently open.
+func freeRange(t *testing.T, size int) (int, int) {
+	t.Helper()
+	for lower := 30000; lower < 60000; lower += size {
+		open := true
+		for port := lower; port < lower+size && open; port++ {
+			listener, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
+			if err != nil {
+				open = false
+				continue
+			}
+			listener.Close()
+		}
+		if open {
+			return lower, lower + size - 1
+		}
+	}
+	t.Fatal("no open port range found")
+	return 0, 0
+}
+
+func listenerPort(t *testing.T, listener net.Listener) int {
+	t.Helper()
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("unexpected listener address %s", listener.Addr())
+	}
+	return addr.Port
+}
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Descriptions of the ecs_target attribute, shared by the provider and the
+// resource schemas.
+const (
+	ecsTargetDescription          = "Forwards from a container of a running ECS task through ECS Exec instead of naming its `ecs:<cluster>_<task-id>_<runtime-id>` target, which changes with every deployment. The task is looked up with `ecs:ListTasks` and `ecs:DescribeTasks` when the tunnel starts, and the oldest running task with ECS Exec enabled is picked. A picked task is kept as long as it runs"
+	ecsTargetClusterDescription   = "The name or ARN of the cluster running the task"
+	ecsTargetServiceDescription   = "The name of the service running the task. Conflicts with `family`"
+	ecsTargetFamilyDescription    = "The task definition family of the task, for tasks that do not belong to a service. Conflicts with `service`"
+	ecsTargetContainerDescription = "The name of the container to forward from"
+)
+
+// ECSTargetModel describes the ecs_target attribute.
+type ECSTargetModel struct {
+	Cluster   types.String `tfsdk:"cluster"`
+	Service   types.String `tfsdk:"service"`
+	Family    types.String `tfsdk:"family"`
+	Container types.String `tfsdk:"container"`
+}
+
+// isKnown reports whether the ECS target can be resolved during plan.
+func (m *ECSTargetModel) isKnown() bool {
+	return m != nil && !m.Cluster.IsUnknown() && !m.Service.IsUnknown() && !m.Family.IsUnknown() && !m.Container.IsUnknown()
+}
+
+// ecsTarget converts the model, reporting errors on the attribute at p.
+func (m *ECSTargetModel) ecsTarget(p path.Path) (*ssmtunnels.ECSTarget, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	ecsTarget := &ssmtunnels.ECSTarget{
+		Cluster:   m.Cluster.ValueString(),
+		Service:   m.Service.ValueString(),
+		Family:    m.Family.ValueString(),
+		Container: m.Container.ValueString(),
+	}
+	if err := ecsTarget.Validate(); err != nil {
+		diags.AddAttributeError(
+			p,
+			"Invalid ECS target",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return nil, diags
+	}
+	return ecsTarget, diags
+}
@@ -2,12 +2,28 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
 	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
+// DefaultIdlePeriod is how long the tunnels must be idle when no period is
+// configured.
+const DefaultIdlePeriod = 5 * time.Second
+
+// DefaultMaxWait bounds the wait for the tunnels to be idle when no maximum
+// is configured.
+const DefaultMaxWait = 5 * time.Minute
+
 // Ensure provider defined types fully satisfy framework interfaces.
 var _ datasource.DataSource = &KeepaliveDataSource{}
 
@@ -17,11 +33,24 @@ func NewKeepaliveDataSource() datasource.DataSource {
 
 // KeepaliveDataSource defines the data source implementation.
 type KeepaliveDataSource struct {
+	tracker *TunnelTracker
 }
 
 // KeepaliveDataSourceModel describes the data source data model.
 type KeepaliveDataSourceModel struct {
-	Id types.String `tfsdk:"id"`
+	Tunnels    types.List                  `tfsdk:"tunnels"`
+	IdlePeriod types.String                `tfsdk:"idle_period"`
+	MaxWait    types.String                `tfsdk:"max_wait"`
+	Stats      map[string]TunnelStatsModel `tfsdk:"stats"`
+	Id         types.String                `tfsdk:"id"`
+}
+
+// TunnelStatsModel describes the connection counts of a tunnel.
+type TunnelStatsModel struct {
+	ActiveConnections types.Int64 `tfsdk:"active_connections"`
+	Connections       types.Int64 `tfsdk:"connections"`
+	BytesSent         types.Int64 `tfsdk:"bytes_sent"`
+	BytesReceived     types.Int64 `tfsdk:"bytes_received"`
 }
 
 func (d *KeepaliveDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
@@ -31,9 +60,46 @@ func (d *KeepaliveDataSource) Metadata(ctx context.Context, req datasource.Metad
 func (d *KeepaliveDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
 	resp.Schema = schema.Schema{
 		// This description is used by the documentation generator and the language server.
-		MarkdownDescription: "Data source used to keep the provider and tunnels alive",
+		MarkdownDescription: "Data source used to keep the provider and tunnels alive. Reading it waits until the tunnels have had no client connections for `idle_period`, so the providers using them are done before the provider shuts down",
 
 		Attributes: map[string]schema.Attribute{
+			"tunnels": schema.ListAttribute{
+				MarkdownDescription: "The `id` of the `awsssmtunnels_remote_tunnel` resources to wait for. Defaults to every tunnel the provider opened",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"idle_period": schema.StringAttribute{
+				MarkdownDescription: "How long the tunnels must have no client connections and no traffic, as a duration such as `10s`. Defaults to `5s`",
+				Optional:            true,
+			},
+			"max_wait": schema.StringAttribute{
+				MarkdownDescription: "How long to wait at most for the tunnels to be idle, as a duration such as `10m`. A warning is reported once it is exceeded. Defaults to `5m`",
+				Optional:            true,
+			},
+			"stats": schema.MapNestedAttribute{
+				MarkdownDescription: "The connection counts of the tunnels, by tunnel `id`",
+				Computed:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"active_connections": schema.Int64Attribute{
+							MarkdownDescription: "The number of client connections still open",
+							Computed:            true,
+						},
+						"connections": schema.Int64Attribute{
+							MarkdownDescription: "The number of client connections forwarded",
+							Computed:            true,
+						},
+						"bytes_sent": schema.Int64Attribute{
+							MarkdownDescription: "The number of bytes sent from clients to the remote host",
+							Computed:            true,
+						},
+						"bytes_received": schema.Int64Attribute{
+							MarkdownDescription: "The number of bytes received by clients from the remote host",
+							Computed:            true,
+						},
+					},
+				},
+			},
 			"id": schema.StringAttribute{
 				MarkdownDescription: "Example identifier", // TODO: Figure this out
 				Computed:            true,
@@ -42,6 +108,25 @@ func (d *KeepaliveDataSource) Schema(ctx context.Context, req datasource.SchemaR
 	}
 }
 
+func (d *KeepaliveDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+}
+
 func (d *KeepaliveDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
 	var data KeepaliveDataSourceModel
 
@@ -52,5 +137,91 @@ func (d *KeepaliveDataSource) Read(ctx context.Context, req datasource.ReadReque
 		return
 	}
 
+	idlePeriod := parseDuration(data.IdlePeriod, path.Root("idle_period"), &resp.Diagnostics)
+	if idlePeriod == 0 {
+		idlePeriod = DefaultIdlePeriod
+	}
+	maxWait := parseDuration(data.MaxWait, path.Root("max_wait"), &resp.Diagnostics)
+	if maxWait == 0 {
+		maxWait = DefaultMaxWait
+	}
+	var ids []string
+	if !data.Tunnels.IsNull() {
+		resp.Diagnostics.Append(data.Tunnels.ElementsAs(ctx, &ids, false)...)
+	}
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// No tunnels are open before the provider is configured
+	var tunnels map[string][]*ssmtunnels.Tunnel
+	if d.tracker != nil {
+		tunnels = d.tracker.Tunnels(ids)
+	}
+	for _, id := range ids {
+		if _, ok := tunnels[id]; !ok {
+			resp.Diagnostics.AddAttributeWarning(
+				path.Root("tunnels"),
+				"Tunnel not open",
+				fmt.Sprintf("The tunnel %s is not open in this run, so it is not waited for", id),
+			)
+		}
+	}
+
+	// The tunnels are waited for concurrently, and the wait ends at the
+	// first one failing
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		waitErr error
+	)
+	for id, idTunnels := range tunnels {
+		tflog.Info(ctx, "Waiting for the tunnel to be idle", map[string]interface{}{
+			"id":          id,
+			"idle_period": idlePeriod.String(),
+		})
+		for _, tunnel := range idTunnels {
+			wg.Go(func() {
+				if err := tunnel.WaitIdle(waitCtx, idlePeriod); err != nil {
+					errOnce.Do(func() {
+						waitErr = err
+						cancel()
+					})
+				}
+			})
+		}
+	}
+	wg.Wait()
+	if waitErr != nil {
+		if errors.Is(waitErr, context.DeadlineExceeded) {
+			waitErr = fmt.Errorf("tunnels were not idle after %s", maxWait)
+		}
+		resp.Diagnostics.AddWarning(
+			"Tunnels still in use",
+			fmt.Sprintf("Error: %s", waitErr),
+		)
+	}
+
+	data.Stats = make(map[string]TunnelStatsModel, len(tunnels))
+	for id, idTunnels := range tunnels {
+		var total ssmtunnels.TunnelStats
+		for _, tunnel := range idTunnels {
+			stats := tunnel.Stats()
+			total.ActiveConnections += stats.ActiveConnections
+			total.Connections += stats.Connections
+			total.BytesSent += stats.BytesSent
+			total.BytesReceived += stats.BytesReceived
+		}
+		data.Stats[id] = TunnelStatsModel{
+			ActiveConnections: basetypes.NewInt64Value(total.ActiveConnections),
+			Connections:       basetypes.NewInt64Value(total.Connections),
+			BytesSent:         basetypes.NewInt64Value(total.BytesSent),
+			BytesReceived:     basetypes.NewInt64Value(total.BytesReceived),
+		}
+	}
+
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
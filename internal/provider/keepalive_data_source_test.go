@@ -0,0 +1,181 @@
+package provider
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// readKeepalive reads the data source configured with config.
+func readKeepalive(t *testing.T, d *KeepaliveDataSource, config KeepaliveDataSourceModel) (KeepaliveDataSourceModel, diag.Diagnostics) {
+	t.Helper()
+	ctx := context.Background()
+	var schemaResp datasource.SchemaResponse
+	d.Schema(ctx, datasource.SchemaRequest{}, &schemaResp)
+	s := schemaResp.Schema
+	objectType := s.Type().TerraformType(ctx)
+
+	raw := tfsdk.State{Schema: s, Raw: tftypes.NewValue(objectType, nil)}
+	if diags := raw.Set(ctx, &config); diags.HasError() {
+		t.Fatal(diags)
+	}
+	req := datasource.ReadRequest{Config: tfsdk.Config{Schema: s, Raw: raw.Raw}}
+	resp := datasource.ReadResponse{State: tfsdk.State{Schema: s, Raw: tftypes.NewValue(objectType, nil)}}
+	d.Read(ctx, req, &resp)
+
+	var data KeepaliveDataSourceModel
+	if !resp.Diagnostics.HasError() {
+		resp.Diagnostics.Append(resp.State.Get(ctx, &data)...)
+	}
+	return data, resp.Diagnostics
+}
+
+func keepaliveConfig(idlePeriod, maxWait string, ids ...string) KeepaliveDataSourceModel {
+	config := KeepaliveDataSourceModel{
+		Tunnels:    types.ListNull(types.StringType),
+		IdlePeriod: types.StringValue(idlePeriod),
+		MaxWait:    types.StringValue(maxWait),
+		Id:         types.StringNull(),
+	}
+	if len(ids) > 0 {
+		elements := make([]attr.Value, 0, len(ids))
+		for _, id := range ids {
+			elements = append(elements, types.StringValue(id))
+		}
+		config.Tunnels = types.ListValueMust(types.StringType, elements)
+	}
+	return config
+}
+
+// holdConnection opens a connection through the local port, sends message
+// and closes the connection after hold.
+func holdConnection(t *testing.T, port int, message string, hold time.Duration) {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(message))); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(hold, func() {
+		conn.Close()
+	})
+}
+
+func TestKeepaliveWaitsForTunnelsToBeIdle(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	d := &KeepaliveDataSource{tracker: tracker}
+
+	// The connections are closed at least their hold after start
+	start := time.Now()
+	holds := map[string]time.Duration{"a": 300 * time.Millisecond, "b": 600 * time.Millisecond}
+	for id, hold := range holds {
+		echo := newEchoServer(t)
+		info, err := tracker.StartTunnel(t.Context(), id, echoSpec(echo), ReadinessConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		holdConnection(t, info.LocalPort, "hello "+id, hold)
+	}
+
+	data, diags := readKeepalive(t, d, keepaliveConfig("200ms", "30s"))
+	elapsed := time.Since(start)
+	if diags.HasError() || diags.WarningsCount() > 0 {
+		t.Fatal(diags)
+	}
+	// The tunnels are waited for at once, so the wait is the longest of them
+	if elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("waited %s for the tunnels to be idle", elapsed)
+	}
+
+	for id := range holds {
+		stats, ok := data.Stats[id]
+		if !ok {
+			t.Fatalf("no stats for %s", id)
+		}
+		if stats.Connections.ValueInt64() != 1 || stats.ActiveConnections.ValueInt64() != 0 {
+			t.Errorf("got %d connections and %d active ones for %s", stats.Connections.ValueInt64(), stats.ActiveConnections.ValueInt64(), id)
+		}
+		if want := int64(len("hello " + id)); stats.BytesSent.ValueInt64() != want || stats.BytesReceived.ValueInt64() != want {
+			t.Errorf("got %d bytes sent and %d received for %s, want %d", stats.BytesSent.ValueInt64(), stats.BytesReceived.ValueInt64(), id, want)
+		}
+	}
+}
+
+func TestKeepaliveMaxWait(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	d := &KeepaliveDataSource{tracker: tracker}
+
+	for _, id := range []string{"a", "b"} {
+		echo := newEchoServer(t)
+		info, err := tracker.StartTunnel(t.Context(), id, echoSpec(echo), ReadinessConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		holdConnection(t, info.LocalPort, "busy", time.Minute)
+	}
+
+	start := time.Now()
+	data, diags := readKeepalive(t, d, keepaliveConfig("100ms", "300ms"))
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("waited %s, past max_wait", elapsed)
+	}
+	if diags.HasError() || diags.WarningsCount() != 1 {
+		t.Fatalf("got %v, want a single warning", diags)
+	}
+	if data.Stats["a"].ActiveConnections.ValueInt64() != 1 {
+		t.Errorf("got %d active connections, want 1", data.Stats["a"].ActiveConnections.ValueInt64())
+	}
+}
+
+func TestKeepaliveOnlyWaitsForListedTunnels(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	d := &KeepaliveDataSource{tracker: tracker}
+
+	echo := newEchoServer(t)
+	info, err := tracker.StartTunnel(t.Context(), "busy", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holdConnection(t, info.LocalPort, "busy", time.Minute)
+	if _, err := tracker.StartTunnel(t.Context(), "idle", echoSpec(newEchoServer(t)), ReadinessConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, diags := readKeepalive(t, d, keepaliveConfig("100ms", "10s", "idle", "missing"))
+	if diags.HasError() || diags.WarningsCount() != 1 {
+		t.Fatalf("got %v, want a warning for the missing tunnel", diags)
+	}
+	if _, ok := data.Stats["busy"]; ok || len(data.Stats) != 1 {
+		t.Errorf("got stats for %v, want only idle", data.Stats)
+	}
+}
+
+func TestKeepaliveWithoutProvider(t *testing.T) {
+	d := &KeepaliveDataSource{}
+
+	data, diags := readKeepalive(t, d, keepaliveConfig("100ms", "1s", "a"))
+	if diags.HasError() || diags.WarningsCount() != 1 {
+		t.Fatalf("got %v, want a warning for the tunnel not open", diags)
+	}
+	if len(data.Stats) != 0 {
+		t.Errorf("got stats %v", data.Stats)
+	}
+}
@@ -6,89 +6,32 @@ package provider
 import (
 	"context"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/types"
-
-	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
-type TunnelInfo struct {
-	IsRunning   bool
-	LocalPort   int
-	ReadySignal chan bool // Used to signal when the tunnel is ready
-}
-
-type OtherTunnelInfo struct {
-	LocalPort   int
-	LocalHost   string
-	ReadySignal chan bool // Used to signal when the tunnel is ready
-}
-
-type TunnelTracker struct {
-	Tunnels map[string]*TunnelInfo
-	Svc     *ssm.Client
-}
-
-func NewTunnelTracker(svc *ssm.Client) *TunnelTracker {
-	return &TunnelTracker{
-		Tunnels: make(map[string]*TunnelInfo),
-		Svc:     svc,
-	}
-}
-
-// Ignore the tracker for now.
-func (t *TunnelTracker) StartTunnel(ctx context.Context, id string, target string, remoteHost string, remotePort int, localPort int, region string) (*OtherTunnelInfo, error) {
-	tunnel := &OtherTunnelInfo{
-		LocalPort: localPort,
-		LocalHost: "127.0.0.1",
-	}
-
-	errChan := make(chan error, 1)
-	// Start the tunnel in a separate goroutine
-	go func() {
-		// Attempt to start the tunnel
-		err := ssmtunnels.StartRemoteTunnel(context.Background(), ssmtunnels.RemoteTunnelConfig{
-			Client:     t.Svc,
-			Target:     target,
-			Region:     region,
-			RemoteHost: remoteHost,
-			RemotePort: remotePort,
-			LocalPort:  localPort,
-		})
-		errChan <- err
-	}()
-
-	// Wait for either an error to happen, or assume "up" after 10 seconds
-	select {
-	case err := <-errChan:
-		if err != nil {
-			// Failed to start the tunnel, handle the error
-			log.Printf("Error starting tunnel: %v", err)
-			close(errChan) // Ensure we signal that the attempt has concluded, even in failure
-			return nil, err
-		} else {
-			// Tunnel started without error, consider it "up"
-			return tunnel, nil
-		}
-	case <-time.After(10 * time.Second):
-		// No error within 10 seconds, consider the tunnel "up"
-		return tunnel, nil
-	}
-}
-
 // NOOP CHANGE
 // Ensure AwsSSMTunnelsProvider satisfies various provider interfaces.
 var _ provider.Provider = &AwsSSMTunnelsProvider{}
+var _ provider.ProviderWithEphemeralResources = &AwsSSMTunnelsProvider{}
 
 // AwsSSMTunnelsProvider defines the provider implementation.
 type AwsSSMTunnelsProvider struct {
@@ -96,23 +39,72 @@ type AwsSSMTunnelsProvider struct {
 	// provider is built and ran locally, and "test" when running acceptance
 	// testing.
 	version string
+
+	// ctx is the root context of the plugin process. Once it is canceled,
+	// every tunnel the provider opened is closed.
+	ctx context.Context
+	// shutdown is done once those tunnels are closed.
+	shutdown *sync.WaitGroup
 }
 
+// shutdownGracePeriod bounds how long stopping the targets the provider
+// started can delay the plugin from exiting. It matches the time tunnels take
+// at most to terminate their sessions, which shutdown always waits for.
+const shutdownGracePeriod = 10 * time.Second
+
 type ProvidedConfigData struct {
-	Tracker *TunnelTracker
-	Region  string
-	Target  string
+	Tracker        *TunnelTracker
+	Region         string
+	Target         string
+	Targets        []string
+	TargetSelector *ssmtunnels.TargetSelector
+	ECSTarget      *ssmtunnels.ECSTarget
+	// EphemeralBastion is set when tunnels go through the bastion task the
+	// Tracker launches.
+	EphemeralBastion bool
 }
 
 // AwsSSMTunnelsProviderModel describes the provider data model.
 type AwsSSMTunnelsProviderModel struct {
-	Region            types.String   `tfsdk:"region"`
-	AccessKey         types.String   `tfsdk:"access_key"`
-	SecretKey         types.String   `tfsdk:"secret_key"`
-	SessionToken      types.String   `tfsdk:"token"`
-	SharedConfigFiles []types.String `tfsdk:"shared_config_files"`
-	Profile           types.String   `tfsdk:"profile"`
-	Target            types.String   `tfsdk:"target"`
+	Region            types.String          `tfsdk:"region"`
+	AccessKey         types.String          `tfsdk:"access_key"`
+	SecretKey         types.String          `tfsdk:"secret_key"`
+	SessionToken      types.String          `tfsdk:"token"`
+	SharedConfigFiles []types.String        `tfsdk:"shared_config_files"`
+	Profile           types.String          `tfsdk:"profile"`
+	Target            types.String          `tfsdk:"target"`
+	Targets           []types.String        `tfsdk:"targets"`
+	TargetSelector    *TargetSelectorModel  `tfsdk:"target_selector"`
+	ECSTarget         *ECSTargetModel       `tfsdk:"ecs_target"`
+	AutoStartTarget   *AutoStartModel       `tfsdk:"auto_start_target"`
+	EphemeralBastion  *BastionModel         `tfsdk:"ephemeral_bastion"`
+	Endpoints         *EndpointsModel       `tfsdk:"endpoints"`
+	Tunnels           []ProviderTunnelModel `tfsdk:"tunnel"`
+}
+
+// AutoStartModel describes the auto_start_target attribute.
+type AutoStartModel struct {
+	StopOnShutdown types.Bool   `tfsdk:"stop_on_shutdown"`
+	Timeout        types.String `tfsdk:"timeout"`
+}
+
+// BastionModel describes the ephemeral_bastion attribute.
+type BastionModel struct {
+	Cluster        types.String   `tfsdk:"cluster"`
+	TaskDefinition types.String   `tfsdk:"task_definition"`
+	Subnets        []types.String `tfsdk:"subnets"`
+	SecurityGroups []types.String `tfsdk:"security_groups"`
+	AssignPublicIP types.Bool     `tfsdk:"assign_public_ip"`
+	Container      types.String   `tfsdk:"container"`
+	Timeout        types.String   `tfsdk:"timeout"`
+}
+
+// EndpointsModel describes the custom AWS service endpoints.
+type EndpointsModel struct {
+	SSM types.String `tfsdk:"ssm"`
+	EC2 types.String `tfsdk:"ec2"`
+	ECS types.String `tfsdk:"ecs"`
+	KMS types.String `tfsdk:"kms"`
 }
 
 func (p *AwsSSMTunnelsProvider) Metadata(ctx context.Context, req provider.MetadataRequest, resp *provider.MetadataResponse) {
@@ -127,7 +119,7 @@ func (p *AwsSSMTunnelsProvider) Schema(ctx context.Context, req provider.SchemaR
 			"region": schema.StringAttribute{
 				Required: true,
 				Description: "The region where AWS operations will take place. Examples\n" +
-					"are us-east-1, us-west-2, etc.",
+					"are us-east-1, us-west-2, etc. Tunnels can override it.",
 			},
 			"access_key": schema.StringAttribute{
 				Optional: true,
@@ -154,8 +146,155 @@ func (p *AwsSSMTunnelsProvider) Schema(ctx context.Context, req provider.SchemaR
 				Description: "The AWS profile to use",
 			},
 			"target": schema.StringAttribute{
-				Required:    true,
-				Description: "The target to start the remote tunnel, such as an instance ID",
+				Optional:    true,
+				Description: "The target to start the remote tunnel, such as an instance ID. Tunnels can override it.",
+			},
+			"targets": schema.ListAttribute{
+				ElementType: types.StringType,
+				Optional:    true,
+				Description: "Targets tried in order instead of a single target. Tunnels fail over to the next one when a target is not connected, including when the session of a running tunnel is lost. Tunnels can override it.",
+			},
+			"target_selector": schema.SingleNestedAttribute{
+				Optional:    true,
+				Description: "Selects the target among the online managed instances instead of naming it in target. Tunnels can override it.",
+				Attributes: map[string]schema.Attribute{
+					"tags": schema.MapAttribute{
+						ElementType: types.StringType,
+						Optional:    true,
+						Description: targetSelectorTagsDescription,
+					},
+					"ssm_filters": schema.MapAttribute{
+						ElementType: types.ListType{ElemType: types.StringType},
+						Optional:    true,
+						Description: targetSelectorSSMFiltersDescription,
+					},
+					"strategy": schema.StringAttribute{
+						Optional:    true,
+						Description: targetSelectorStrategyDescription,
+					},
+				},
+			},
+			"ecs_target": schema.SingleNestedAttribute{
+				Optional:    true,
+				Description: ecsTargetDescription + ". Tunnels can override it.",
+				Attributes: map[string]schema.Attribute{
+					"cluster": schema.StringAttribute{
+						Required:    true,
+						Description: ecsTargetClusterDescription,
+					},
+					"service": schema.StringAttribute{
+						Optional:    true,
+						Description: ecsTargetServiceDescription,
+					},
+					"family": schema.StringAttribute{
+						Optional:    true,
+						Description: ecsTargetFamilyDescription,
+					},
+					"container": schema.StringAttribute{
+						Required:    true,
+						Description: ecsTargetContainerDescription,
+					},
+				},
+			},
+			"auto_start_target": schema.SingleNestedAttribute{
+				Optional: true,
+				Description: "Starts the target with `ec2:StartInstances` when it is a stopped EC2 instance, and waits for it to be running and for its agent to be online " +
+					"before opening the tunnel. Only targets named by target or targets are started, and only the first one of targets.",
+				Attributes: map[string]schema.Attribute{
+					"stop_on_shutdown": schema.BoolAttribute{
+						Optional:    true,
+						Description: "Stops the instances the provider started once it shuts down. Defaults to false",
+					},
+					"timeout": schema.StringAttribute{
+						Optional:    true,
+						Description: fmt.Sprintf("How long to wait for a started instance to be online, as a duration such as `5m`. Defaults to `%s`", DefaultAutoStartTimeout),
+					},
+				},
+			},
+			"ephemeral_bastion": schema.SingleNestedAttribute{
+				Optional: true,
+				Description: "Launches a short-lived bastion, a Fargate task with ECS Exec enabled, when a tunnel is first needed, and starts every tunnel on it " +
+					"instead of a target. The task is stopped when the provider shuts down. It runs in the provider's region.",
+				Attributes: map[string]schema.Attribute{
+					"cluster": schema.StringAttribute{
+						Required:    true,
+						Description: "The name or ARN of the cluster to run the task in",
+					},
+					"task_definition": schema.StringAttribute{
+						Required:    true,
+						Description: "The family, `family:revision` or ARN of the task definition of the bastion",
+					},
+					"subnets": schema.ListAttribute{
+						ElementType: types.StringType,
+						Required:    true,
+						Description: "The subnets to run the task in",
+					},
+					"security_groups": schema.ListAttribute{
+						ElementType: types.StringType,
+						Optional:    true,
+						Description: "The security groups of the task. Defaults to the default security group of the VPC",
+					},
+					"assign_public_ip": schema.BoolAttribute{
+						Optional:    true,
+						Description: "Assigns a public IP to the task, for subnets without a NAT gateway or VPC endpoints. Defaults to false",
+					},
+					"container": schema.StringAttribute{
+						Optional:    true,
+						Description: "The container to start sessions on. Defaults to the first container of the task",
+					},
+					"timeout": schema.StringAttribute{
+						Optional:    true,
+						Description: fmt.Sprintf("How long to wait for the task to run with ECS Exec ready, as a duration such as `5m`. Defaults to `%s`", DefaultBastionTimeout),
+					},
+				},
+			},
+			"endpoints": schema.SingleNestedAttribute{
+				Optional:    true,
+				Description: "Custom AWS service endpoints, for example to use a local stand-in for SSM",
+				Attributes: map[string]schema.Attribute{
+					"ssm": schema.StringAttribute{
+						Optional:    true,
+						Description: "The endpoint URL of the SSM API",
+					},
+					"ec2": schema.StringAttribute{
+						Optional:    true,
+						Description: "The endpoint URL of the EC2 API",
+					},
+					"ecs": schema.StringAttribute{
+						Optional:    true,
+						Description: "The endpoint URL of the ECS API",
+					},
+					"kms": schema.StringAttribute{
+						Optional:    true,
+						Description: "The endpoint URL of the KMS API, used by sessions encrypted with KMS",
+					},
+				},
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"tunnel": schema.ListNestedBlock{
+				Description: "Tunnels started when the provider is configured, through its target, and held until it shuts down. " +
+					"As their local ports are fixed, other providers can be configured with them from the first plan, without a resource or a keepalive.",
+				NestedObject: schema.NestedBlockObject{
+					Attributes: map[string]schema.Attribute{
+						"name": schema.StringAttribute{
+							Required:    true,
+							Description: "The name of the tunnel, unique among the provider's tunnels",
+						},
+						"remote_host": schema.StringAttribute{
+							Optional:    true,
+							Description: tunnelRemoteHostDescription,
+						},
+						"remote_port": schema.Int64Attribute{
+							Required:    true,
+							Description: tunnelRemotePortDescription,
+						},
+						"local_port": schema.Int64Attribute{
+							Required:    true,
+							Description: "The local port number the tunnel listens on, on 127.0.0.1",
+						},
+					},
+				},
 			},
 		},
 	}
@@ -170,6 +309,85 @@ func (p *AwsSSMTunnelsProvider) Configure(ctx context.Context, req provider.Conf
 		return
 	}
 
+	targets := make([]string, 0, len(data.Targets))
+	for _, target := range data.Targets {
+		targets = append(targets, target.ValueString())
+	}
+	if countSet(data.Target.ValueString() != "", len(targets) > 0, data.TargetSelector != nil, data.ECSTarget != nil, data.EphemeralBastion != nil) > 1 {
+		resp.Diagnostics.AddError(
+			"Conflicting targets",
+			"Only one of target, targets, target_selector, ecs_target and ephemeral_bastion can be set",
+		)
+		return
+	}
+
+	resp.Diagnostics.Append(validateProviderTunnels(data.Tunnels)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var targetSelector *ssmtunnels.TargetSelector
+	if data.TargetSelector != nil {
+		var diags diag.Diagnostics
+		targetSelector, diags = data.TargetSelector.selector(ctx, path.Root("target_selector"))
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	var ecsTarget *ssmtunnels.ECSTarget
+	if data.ECSTarget != nil {
+		var diags diag.Diagnostics
+		ecsTarget, diags = data.ECSTarget.ecsTarget(path.Root("ecs_target"))
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	var bastion *BastionConfig
+	if data.EphemeralBastion != nil {
+		bastion = &BastionConfig{
+			Task: ssmtunnels.BastionTask{
+				Cluster:        data.EphemeralBastion.Cluster.ValueString(),
+				TaskDefinition: data.EphemeralBastion.TaskDefinition.ValueString(),
+				AssignPublicIP: data.EphemeralBastion.AssignPublicIP.ValueBool(),
+				Container:      data.EphemeralBastion.Container.ValueString(),
+			},
+			Region: data.Region.ValueString(),
+		}
+		for _, subnet := range data.EphemeralBastion.Subnets {
+			bastion.Task.Subnets = append(bastion.Task.Subnets, subnet.ValueString())
+		}
+		for _, group := range data.EphemeralBastion.SecurityGroups {
+			bastion.Task.SecurityGroups = append(bastion.Task.SecurityGroups, group.ValueString())
+		}
+		if err := bastion.Task.Validate(); err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("ephemeral_bastion"),
+				"Invalid ephemeral bastion",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		bastion.Timeout = parseDuration(data.EphemeralBastion.Timeout, path.Root("ephemeral_bastion").AtName("timeout"), &resp.Diagnostics)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	var autoStart *AutoStartConfig
+	if data.AutoStartTarget != nil {
+		autoStart = &AutoStartConfig{
+			StopOnShutdown: data.AutoStartTarget.StopOnShutdown.ValueBool(),
+		}
+		autoStart.Timeout = parseDuration(data.AutoStartTarget.Timeout, path.Root("auto_start_target").AtName("timeout"), &resp.Diagnostics)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
 	var awsCfg aws.Config
 	var err error
 	if len(data.SharedConfigFiles) > 0 {
@@ -230,18 +448,87 @@ func (p *AwsSSMTunnelsProvider) Configure(ctx context.Context, req provider.Conf
 		}
 	}
 
-	svc := ssm.NewFromConfig(awsCfg)
-	tracker := NewTunnelTracker(svc)
+	tracker, err := NewTunnelTracker(func(region string) ssmtunnels.SSMClient {
+		return ssm.NewFromConfig(awsCfg, func(o *ssm.Options) {
+			o.Region = region
+			if data.Endpoints != nil && data.Endpoints.SSM.ValueString() != "" {
+				o.BaseEndpoint = aws.String(data.Endpoints.SSM.ValueString())
+			}
+		})
+	}, func(region string) ssmtunnels.EC2Client {
+		return ec2.NewFromConfig(awsCfg, func(o *ec2.Options) {
+			o.Region = region
+			if data.Endpoints != nil && data.Endpoints.EC2.ValueString() != "" {
+				o.BaseEndpoint = aws.String(data.Endpoints.EC2.ValueString())
+			}
+		})
+	}, func(region string) ssmtunnels.ECSClient {
+		return ecs.NewFromConfig(awsCfg, func(o *ecs.Options) {
+			o.Region = region
+			if data.Endpoints != nil && data.Endpoints.ECS.ValueString() != "" {
+				o.BaseEndpoint = aws.String(data.Endpoints.ECS.ValueString())
+			}
+		})
+	}, func(region string) ssmtunnels.KMSClient {
+		return kms.NewFromConfig(awsCfg, func(o *kms.Options) {
+			o.Region = region
+			if data.Endpoints != nil && data.Endpoints.KMS.ValueString() != "" {
+				o.BaseEndpoint = aws.String(data.Endpoints.KMS.ValueString())
+			}
+		})
+	})
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to create tunnel tracker",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+	if autoStart != nil {
+		tracker.SetAutoStart(*autoStart)
+	}
+	if bastion != nil {
+		tracker.SetBastion(*bastion)
+	}
+	// Shutdown outlives the request, and logs through its logger
+	logCtx := context.WithoutCancel(ctx)
+	p.shutdown.Add(1)
+	context.AfterFunc(p.ctx, func() {
+		defer p.shutdown.Done()
+		if err := tracker.Shutdown(shutdownGracePeriod); err != nil {
+			tflog.Error(logCtx, "Error closing tunnels", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	})
 	// NOTE: We should make a "client" struct which hides the SSM client, and has a method to start a tunnel and it keeps track of the tunnel session
 	// It should also handle the cancellation via context signalling
 
 	configData := &ProvidedConfigData{
-		Tracker: tracker,
-		Region:  data.Region.ValueString(),
-		Target:  data.Target.ValueString(),
+		Tracker:          tracker,
+		Region:           data.Region.ValueString(),
+		Target:           data.Target.ValueString(),
+		Targets:          targets,
+		TargetSelector:   targetSelector,
+		ECSTarget:        ecsTarget,
+		EphemeralBastion: bastion != nil,
 	}
 	resp.DataSourceData = configData
 	resp.ResourceData = configData
+	resp.EphemeralResourceData = configData
+
+	// Tunnel blocks start concurrently, and report in order
+	var wg sync.WaitGroup
+	tunnelDiags := make([]diag.Diagnostics, len(data.Tunnels))
+	for i, tunnel := range data.Tunnels {
+		wg.Go(func() {
+			tunnelDiags[i] = startProviderTunnel(ctx, configData, tunnel, path.Root("tunnel").AtListIndex(i))
+		})
+	}
+	wg.Wait()
+	for _, diags := range tunnelDiags {
+		resp.Diagnostics.Append(diags...)
+	}
 }
 
 func (p *AwsSSMTunnelsProvider) Resources(ctx context.Context) []func() resource.Resource {
@@ -250,16 +537,26 @@ func (p *AwsSSMTunnelsProvider) Resources(ctx context.Context) []func() resource
 	}
 }
 
+func (p *AwsSSMTunnelsProvider) EphemeralResources(ctx context.Context) []func() ephemeral.EphemeralResource {
+	return []func() ephemeral.EphemeralResource{
+		NewRemoteTunnelEphemeralResource,
+	}
+}
+
 func (p *AwsSSMTunnelsProvider) DataSources(ctx context.Context) []func() datasource.DataSource {
 	return []func() datasource.DataSource{
 		NewKeepaliveDataSource,
 	}
 }
 
-func New(version string) func() provider.Provider {
+// New returns the provider factory. The tunnels opened by the provider are
+// closed when ctx is canceled, and shutdown is done once they are.
+func New(ctx context.Context, version string, shutdown *sync.WaitGroup) func() provider.Provider {
 	return func() provider.Provider {
 		return &AwsSSMTunnelsProvider{
-			version: version,
+			version:  version,
+			ctx:      ctx,
+			shutdown: shutdown,
 		}
 	}
 }
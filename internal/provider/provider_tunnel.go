@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// providerTunnelIDPrefix starts the IDs the tunnels of the provider's tunnel
+// blocks are registered under with the tracker.
+const providerTunnelIDPrefix = "provider:"
+
+// ProviderTunnelModel describes a tunnel block of the provider.
+type ProviderTunnelModel struct {
+	Name       types.String `tfsdk:"name"`
+	RemoteHost types.String `tfsdk:"remote_host"`
+	RemotePort types.Int64  `tfsdk:"remote_port"`
+	LocalPort  types.Int64  `tfsdk:"local_port"`
+}
+
+// isKnown reports whether the tunnel can be started, as its settings may
+// depend on resources that are not created yet.
+func (m ProviderTunnelModel) isKnown() bool {
+	return !m.Name.IsUnknown() && !m.RemoteHost.IsUnknown() && !m.RemotePort.IsUnknown() && !m.LocalPort.IsUnknown()
+}
+
+// validateProviderTunnels checks the ports of the tunnel blocks, and that
+// their names and local ports are unique.
+func validateProviderTunnels(tunnels []ProviderTunnelModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+	names := make(map[string]bool)
+	localPorts := make(map[int64]bool)
+	for i, tunnel := range tunnels {
+		p := path.Root("tunnel").AtListIndex(i)
+		validatePort(tunnel.RemotePort, p.AtName("remote_port"), &diags)
+		validatePort(tunnel.LocalPort, p.AtName("local_port"), &diags)
+		if !tunnel.Name.IsUnknown() {
+			if names[tunnel.Name.ValueString()] {
+				diags.AddAttributeError(
+					p.AtName("name"),
+					"Duplicate tunnel name",
+					fmt.Sprintf("Another tunnel is named %q", tunnel.Name.ValueString()),
+				)
+			}
+			names[tunnel.Name.ValueString()] = true
+		}
+		if !tunnel.LocalPort.IsUnknown() {
+			if localPorts[tunnel.LocalPort.ValueInt64()] {
+				diags.AddAttributeError(
+					p.AtName("local_port"),
+					"Duplicate local port",
+					fmt.Sprintf("Another tunnel listens on port %d", tunnel.LocalPort.ValueInt64()),
+				)
+			}
+			localPorts[tunnel.LocalPort.ValueInt64()] = true
+		}
+	}
+	return diags
+}
+
+// startProviderTunnel starts the tunnel of a tunnel block through the
+// provider's target. It is held until the provider shuts down.
+func startProviderTunnel(ctx context.Context, configData *ProvidedConfigData, tunnel ProviderTunnelModel, p path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !tunnel.isKnown() {
+		diags.AddAttributeWarning(
+			p,
+			"Tunnel not started",
+			"The settings of the tunnel are not known yet, so it is only started once they are",
+		)
+		return diags
+	}
+
+	// Tunnel blocks start like resources without a target of their own
+	r := &RemoteTunnelResource{}
+	diags.Append(r.configure(configData)...)
+	data := SSMRemoteTunnelResourceModel{
+		Target:             types.StringNull(),
+		Targets:            types.ListNull(types.StringType),
+		Region:             types.StringNull(),
+		DocumentName:       types.StringNull(),
+		DocumentParameters: types.MapNull(types.StringType),
+		RemoteHost:         tunnel.RemoteHost,
+		RemotePort:         tunnel.RemotePort,
+		LocalPort:          tunnel.LocalPort,
+	}
+	readiness := ReadinessConfig{}
+	failover, resolveDiags := r.resolveTarget(ctx, &data, resolveForRead, readiness)
+	diags.Append(resolveDiags...)
+	if diags.HasError() {
+		return diags
+	}
+
+	spec, specDiags := r.tunnelSpec(ctx, data)
+	spec.FailoverTargets = failover
+	diags.Append(specDiags...)
+	if diags.HasError() {
+		return diags
+	}
+
+	if _, err := configData.Tracker.StartTunnel(ctx, providerTunnelIDPrefix+tunnel.Name.ValueString(), spec, readiness); err != nil {
+		diags.AddAttributeError(
+			p,
+			"Failed to start remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+	return diags
+}
@@ -0,0 +1,205 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/provider"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// configureProvider configures a provider with config. Its tunnels are
+// closed when the test ends.
+func configureProvider(t *testing.T, config AwsSSMTunnelsProviderModel) (*ProvidedConfigData, diag.Diagnostics) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var shutdown sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		shutdown.Wait()
+	})
+	p, ok := New(ctx, "test", &shutdown)().(*AwsSSMTunnelsProvider)
+	if !ok {
+		t.Fatal("unexpected provider type")
+	}
+
+	var schemaResp provider.SchemaResponse
+	p.Schema(ctx, provider.SchemaRequest{}, &schemaResp)
+	s := schemaResp.Schema
+	raw := tfsdk.State{Schema: s, Raw: tftypes.NewValue(s.Type().TerraformType(ctx), nil)}
+	if diags := raw.Set(ctx, &config); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	var resp provider.ConfigureResponse
+	p.Configure(ctx, provider.ConfigureRequest{Config: tfsdk.Config{Schema: s, Raw: raw.Raw}}, &resp)
+	configData, _ := resp.ResourceData.(*ProvidedConfigData)
+	return configData, resp.Diagnostics
+}
+
+// testProviderConfig returns the config of a provider using the stand-in SSM
+// service at endpoint.
+func testProviderConfig(endpoint string) AwsSSMTunnelsProviderModel {
+	return AwsSSMTunnelsProviderModel{
+		Region:       types.StringValue("us-east-1"),
+		AccessKey:    types.StringValue("test"),
+		SecretKey:    types.StringValue("test"),
+		SessionToken: types.StringNull(),
+		Profile:      types.StringNull(),
+		Target:       types.StringValue(testTarget),
+		Endpoints: &EndpointsModel{
+			SSM: types.StringValue(endpoint),
+			EC2: types.StringNull(),
+			ECS: types.StringNull(),
+			KMS: types.StringNull(),
+		},
+	}
+}
+
+// openPort returns a local port nothing listens on.
+func openPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listenerPort(t, listener)
+}
+
+func listenerPort(t *testing.T, listener net.Listener) int {
+	t.Helper()
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("unexpected listener address %s", listener.Addr())
+	}
+	return addr.Port
+}
+
+func TestProviderTunnelBlocks(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	config := testProviderConfig(server.URL)
+	ports := make([]int, 3)
+	for i := range ports {
+		echo := newEchoServer(t)
+		ports[i] = openPort(t)
+		config.Tunnels = append(config.Tunnels, ProviderTunnelModel{
+			Name:       types.StringValue(string(rune('a' + i))),
+			RemoteHost: types.StringValue(echo.Host()),
+			RemotePort: types.Int64Value(int64(echo.Port())),
+			LocalPort:  types.Int64Value(int64(ports[i])),
+		})
+	}
+
+	configData, diags := configureProvider(t, config)
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	for _, port := range ports {
+		roundTrip(t, port, "hello")
+	}
+	if tunnels := configData.Tracker.Tunnels([]string{providerTunnelIDPrefix + "a"}); len(tunnels) != 1 {
+		t.Errorf("got tunnels %v, want the tunnel of block a", tunnels)
+	}
+	if sessions := server.Sessions(); len(sessions) != len(ports) {
+		t.Errorf("got %d sessions, want %d", len(sessions), len(ports))
+	}
+}
+
+func TestProviderTunnelBlockFailure(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	config := testProviderConfig(server.URL)
+	echo := newEchoServer(t)
+	// The local port of the second block is taken
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := openPort(t)
+	for i, localPort := range []int{port, listenerPort(t, listener)} {
+		config.Tunnels = append(config.Tunnels, ProviderTunnelModel{
+			Name:       types.StringValue(string(rune('a' + i))),
+			RemoteHost: types.StringValue(echo.Host()),
+			RemotePort: types.Int64Value(int64(echo.Port())),
+			LocalPort:  types.Int64Value(int64(localPort)),
+		})
+	}
+
+	_, diags := configureProvider(t, config)
+	if diags.ErrorsCount() != 1 {
+		t.Fatalf("got %v, want an error for the second block", diags)
+	}
+	errorDiag, ok := diags.Errors()[0].(diag.DiagnosticWithPath)
+	if !ok || !errorDiag.Path().Equal(path.Root("tunnel").AtListIndex(1)) {
+		t.Errorf("got error %v, want it on the second block", diags.Errors()[0])
+	}
+	roundTrip(t, port, "a is up")
+}
+
+func TestValidateProviderTunnels(t *testing.T) {
+	tunnel := func(name string, remotePort, localPort int64) ProviderTunnelModel {
+		return ProviderTunnelModel{
+			Name:       types.StringValue(name),
+			RemoteHost: types.StringValue("db.internal"),
+			RemotePort: types.Int64Value(remotePort),
+			LocalPort:  types.Int64Value(localPort),
+		}
+	}
+
+	tests := map[string]struct {
+		tunnels []ProviderTunnelModel
+		want    []path.Path
+	}{
+		"valid": {
+			tunnels: []ProviderTunnelModel{tunnel("a", 5432, 17001), tunnel("b", 5432, 17002)},
+		},
+		"duplicate name": {
+			tunnels: []ProviderTunnelModel{tunnel("a", 5432, 17001), tunnel("a", 5432, 17002)},
+			want:    []path.Path{path.Root("tunnel").AtListIndex(1).AtName("name")},
+		},
+		"duplicate local port": {
+			tunnels: []ProviderTunnelModel{tunnel("a", 5432, 17001), tunnel("b", 6379, 17001)},
+			want:    []path.Path{path.Root("tunnel").AtListIndex(1).AtName("local_port")},
+		},
+		"local port out of range": {
+			tunnels: []ProviderTunnelModel{tunnel("a", 5432, 0), tunnel("b", 5432, 70000)},
+			want: []path.Path{
+				path.Root("tunnel").AtListIndex(0).AtName("local_port"),
+				path.Root("tunnel").AtListIndex(1).AtName("local_port"),
+			},
+		},
+		"remote port out of range": {
+			tunnels: []ProviderTunnelModel{tunnel("a", 65536, 17001)},
+			want:    []path.Path{path.Root("tunnel").AtListIndex(0).AtName("remote_port")},
+		},
+		"unknown port": {
+			tunnels: []ProviderTunnelModel{{
+				Name:       types.StringValue("a"),
+				RemoteHost: types.StringValue("db.internal"),
+				RemotePort: types.Int64Value(5432),
+				LocalPort:  types.Int64Unknown(),
+			}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			diags := validateProviderTunnels(test.tunnels)
+			if diags.ErrorsCount() != len(test.want) {
+				t.Fatalf("got %v, want %d errors", diags, len(test.want))
+			}
+			for i, want := range test.want {
+				got, ok := diags.Errors()[i].(diag.DiagnosticWithPath)
+				if !ok || !got.Path().Equal(want) {
+					t.Errorf("got error %v, want it on %s", diags.Errors()[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ ephemeral.EphemeralResource = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithConfigure = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithValidateConfig = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithRenew = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithClose = &RemoteTunnelEphemeralResource{}
+
+// ephemeralTunnelKey is the private data key of the opened tunnel.
+const ephemeralTunnelKey = "tunnel"
+
+// ephemeralRenewInterval is how often Terraform has the tunnel checked while
+// it is in use, so a tunnel that stopped is started again.
+const ephemeralRenewInterval = time.Minute
+
+func NewRemoteTunnelEphemeralResource() ephemeral.EphemeralResource {
+	return &RemoteTunnelEphemeralResource{}
+}
+
+// RemoteTunnelEphemeralResource opens a tunnel for as long as Terraform uses
+// it, without storing it in state. Its target is resolved like the one of the
+// remote_tunnel resource.
+type RemoteTunnelEphemeralResource struct {
+	resource RemoteTunnelResource
+}
+
+// RemoteTunnelEphemeralModel describes the ephemeral resource data model.
+type RemoteTunnelEphemeralModel struct {
+	Target              types.String         `tfsdk:"target"`
+	Targets             types.List           `tfsdk:"targets"`
+	TargetSelector      *TargetSelectorModel `tfsdk:"target_selector"`
+	ECSTarget           *ECSTargetModel      `tfsdk:"ecs_target"`
+	ResolvedTarget      types.String         `tfsdk:"resolved_target"`
+	Region              types.String         `tfsdk:"region"`
+	DocumentName        types.String         `tfsdk:"document_name"`
+	DocumentParameters  types.Map            `tfsdk:"document_parameters"`
+	RemoteHost          types.String         `tfsdk:"remote_host"`
+	RemotePort          types.Int64          `tfsdk:"remote_port"`
+	LocalPort           types.Int64          `tfsdk:"local_port"`
+	LocalHost           types.String         `tfsdk:"local_host"`
+	ReadyTimeout        types.String         `tfsdk:"ready_timeout"`
+	TargetOnlineTimeout types.String         `tfsdk:"target_online_timeout"`
+	TargetPollInterval  types.String         `tfsdk:"target_poll_interval"`
+	Probe               types.Bool           `tfsdk:"probe"`
+}
+
+// resourceModel returns the settings of the tunnel as the remote_tunnel
+// resource holds them.
+func (m RemoteTunnelEphemeralModel) resourceModel() SSMRemoteTunnelResourceModel {
+	return SSMRemoteTunnelResourceModel{
+		Target:              m.Target,
+		Targets:             m.Targets,
+		TargetSelector:      m.TargetSelector,
+		ECSTarget:           m.ECSTarget,
+		ResolvedTarget:      m.ResolvedTarget,
+		Region:              m.Region,
+		DocumentName:        m.DocumentName,
+		DocumentParameters:  m.DocumentParameters,
+		RemoteHost:          m.RemoteHost,
+		RemotePort:          m.RemotePort,
+		LocalPort:           m.LocalPort,
+		LocalHost:           m.LocalHost,
+		ReadyTimeout:        m.ReadyTimeout,
+		TargetOnlineTimeout: m.TargetOnlineTimeout,
+		TargetPollInterval:  m.TargetPollInterval,
+		Probe:               m.Probe,
+	}
+}
+
+// ephemeralTunnel is the private data of an opened tunnel, which lets Renew
+// start it again and Close release it.
+type ephemeralTunnel struct {
+	ID        string
+	Spec      TunnelSpec
+	Readiness ReadinessConfig
+}
+
+func (r *RemoteTunnelEphemeralResource) Metadata(ctx context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_remote_tunnel"
+}
+
+func (r *RemoteTunnelEphemeralResource) Schema(ctx context.Context, req ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "AWS SSM remote tunnel that is open while Terraform uses it, and never stored in state. " +
+			"Reference its `local_host` and `local_port` from the configuration of other providers.",
+
+		Attributes: map[string]schema.Attribute{
+			"target": schema.StringAttribute{
+				MarkdownDescription: tunnelTargetDescription,
+				Optional:            true,
+			},
+			"targets": schema.ListAttribute{
+				MarkdownDescription: tunnelTargetsDescription,
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"target_selector": schema.SingleNestedAttribute{
+				MarkdownDescription: tunnelTargetSelectorDescription,
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"tags": schema.MapAttribute{
+						MarkdownDescription: targetSelectorTagsDescription,
+						ElementType:         types.StringType,
+						Optional:            true,
+					},
+					"ssm_filters": schema.MapAttribute{
+						MarkdownDescription: targetSelectorSSMFiltersDescription,
+						ElementType:         types.ListType{ElemType: types.StringType},
+						Optional:            true,
+					},
+					"strategy": schema.StringAttribute{
+						MarkdownDescription: targetSelectorStrategyDescription,
+						Optional:            true,
+					},
+				},
+			},
+			"ecs_target": schema.SingleNestedAttribute{
+				MarkdownDescription: ecsTargetDescription + ". Defaults to the provider's `ecs_target`",
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"cluster": schema.StringAttribute{
+						MarkdownDescription: ecsTargetClusterDescription,
+						Required:            true,
+					},
+					"service": schema.StringAttribute{
+						MarkdownDescription: ecsTargetServiceDescription,
+						Optional:            true,
+					},
+					"family": schema.StringAttribute{
+						MarkdownDescription: ecsTargetFamilyDescription,
+						Optional:            true,
+					},
+					"container": schema.StringAttribute{
+						MarkdownDescription: ecsTargetContainerDescription,
+						Required:            true,
+					},
+				},
+			},
+			"resolved_target": schema.StringAttribute{
+				MarkdownDescription: tunnelResolvedTargetDescription,
+				Computed:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: tunnelRegionDescription,
+				Optional:            true,
+			},
+			"document_name": schema.StringAttribute{
+				MarkdownDescription: tunnelDocumentNameDescription,
+				Optional:            true,
+			},
+			"document_parameters": schema.MapAttribute{
+				MarkdownDescription: tunnelDocumentParametersDescription,
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"remote_host": schema.StringAttribute{
+				MarkdownDescription: tunnelRemoteHostDescription,
+				Optional:            true,
+			},
+			"remote_port": schema.Int64Attribute{
+				MarkdownDescription: tunnelRemotePortDescription,
+				Required:            true,
+			},
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: tunnelLocalHostDescription,
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: tunnelLocalPortDescription,
+				Optional:            true,
+				Computed:            true,
+			},
+			"ready_timeout": schema.StringAttribute{
+				MarkdownDescription: tunnelReadyTimeoutDescription,
+				Optional:            true,
+			},
+			"target_online_timeout": schema.StringAttribute{
+				MarkdownDescription: tunnelTargetOnlineTimeoutDescription,
+				Optional:            true,
+			},
+			"target_poll_interval": schema.StringAttribute{
+				MarkdownDescription: tunnelTargetPollIntervalDescription,
+				Optional:            true,
+			},
+			"probe": schema.BoolAttribute{
+				MarkdownDescription: tunnelProbeDescription,
+				Optional:            true,
+			},
+		},
+	}
+}
+
+func (r *RemoteTunnelEphemeralResource) Configure(ctx context.Context, req ephemeral.ConfigureRequest, resp *ephemeral.ConfigureResponse) {
+	resp.Diagnostics.Append(r.resource.configure(req.ProviderData)...)
+}
+
+func (r *RemoteTunnelEphemeralResource) ValidateConfig(ctx context.Context, req ephemeral.ValidateConfigRequest, resp *ephemeral.ValidateConfigResponse) {
+	var data RemoteTunnelEphemeralModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(validateTunnelConfig(ctx, data.resourceModel())...)
+}
+
+func (r *RemoteTunnelEphemeralResource) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	var data RemoteTunnelEphemeralModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	model := data.resourceModel()
+	readiness, diags := readinessConfig(model)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	failover, diags := r.resource.resolveTarget(ctx, &model, resolveForApply, readiness)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	spec, diags := r.resource.tunnelSpec(ctx, model)
+	spec.FailoverTargets = failover
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The ID is registered with the tracker as a user of the tunnel
+	tunnel := ephemeralTunnel{
+		ID:        uuid.New().String(),
+		Spec:      spec,
+		Readiness: readiness,
+	}
+	tunnelInfo, err := r.resource.tracker.StartTunnel(ctx, tunnel.ID, spec, readiness)
+
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to start remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	if target := tunnelInfo.Tunnel.Target(); target != spec.Target {
+		resp.Diagnostics.AddWarning(
+			"Remote tunnel failed over",
+			fmt.Sprintf("The tunnel goes through %s, as %s was not available", target, spec.Target),
+		)
+	}
+	data.ResolvedTarget = basetypes.NewStringValue(tunnelInfo.Tunnel.Target())
+
+	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
+	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
+
+	resp.Diagnostics.Append(resp.Result.Set(ctx, &data)...)
+
+	// A tunnel started again by Renew keeps its local port
+	tunnel.Spec.LocalPort = tunnelInfo.LocalPort
+	resp.Diagnostics.Append(setEphemeralTunnel(ctx, resp.Private.SetKey, tunnel)...)
+	resp.RenewAt = time.Now().Add(ephemeralRenewInterval)
+}
+
+// Renew starts the tunnel again if it stopped, so it stays usable for as long
+// as Terraform needs it.
+func (r *RemoteTunnelEphemeralResource) Renew(ctx context.Context, req ephemeral.RenewRequest, resp *ephemeral.RenewResponse) {
+	tunnel, diags := getEphemeralTunnel(ctx, req.Private.GetKey)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if _, err := r.resource.tracker.StartTunnel(ctx, tunnel.ID, tunnel.Spec, tunnel.Readiness); err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to renew remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+	resp.RenewAt = time.Now().Add(ephemeralRenewInterval)
+}
+
+func (r *RemoteTunnelEphemeralResource) Close(ctx context.Context, req ephemeral.CloseRequest, resp *ephemeral.CloseResponse) {
+	tunnel, diags := getEphemeralTunnel(ctx, req.Private.GetKey)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Terraform closes it once it is done with the providers using it
+	if err := r.resource.tracker.Release(ctx, tunnel.ID, 0); err != nil {
+		resp.Diagnostics.AddWarning(
+			"Failed to close remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+}
+
+// setEphemeralTunnel stores tunnel in the private data with setKey.
+func setEphemeralTunnel(ctx context.Context, setKey func(context.Context, string, []byte) diag.Diagnostics, tunnel ephemeralTunnel) diag.Diagnostics {
+	var diags diag.Diagnostics
+	value, err := json.Marshal(tunnel)
+	if err != nil {
+		diags.AddError(
+			"Failed to store remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return diags
+	}
+	return setKey(ctx, ephemeralTunnelKey, value)
+}
+
+// getEphemeralTunnel reads the tunnel from the private data with getKey.
+func getEphemeralTunnel(ctx context.Context, getKey func(context.Context, string) ([]byte, diag.Diagnostics)) (ephemeralTunnel, diag.Diagnostics) {
+	var tunnel ephemeralTunnel
+	value, diags := getKey(ctx, ephemeralTunnelKey)
+	if diags.HasError() {
+		return tunnel, diags
+	}
+	if err := json.Unmarshal(value, &tunnel); err != nil {
+		diags.AddError(
+			"Failed to read remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+	return tunnel, diags
+}
@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// newEphemeralTunnel returns an ephemeral remote_tunnel resource of a
+// provider using the stand-in SSM service at endpoint.
+func newEphemeralTunnel(t *testing.T, endpoint string) (*RemoteTunnelEphemeralResource, *ProvidedConfigData) {
+	t.Helper()
+	configData, diags := configureProvider(t, testProviderConfig(endpoint))
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	r := &RemoteTunnelEphemeralResource{}
+	var resp ephemeral.ConfigureResponse
+	r.Configure(context.Background(), ephemeral.ConfigureRequest{ProviderData: configData}, &resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	return r, configData
+}
+
+// ephemeralEchoConfig returns the config of an ephemeral tunnel to echo.
+func ephemeralEchoConfig(echo *ssmtunnelstest.EchoServer) RemoteTunnelEphemeralModel {
+	return RemoteTunnelEphemeralModel{
+		Target:              types.StringNull(),
+		Targets:             types.ListNull(types.StringType),
+		ResolvedTarget:      types.StringNull(),
+		Region:              types.StringNull(),
+		DocumentName:        types.StringNull(),
+		DocumentParameters:  types.MapNull(types.StringType),
+		RemoteHost:          types.StringValue(echo.Host()),
+		RemotePort:          types.Int64Value(int64(echo.Port())),
+		LocalPort:           types.Int64Null(),
+		LocalHost:           types.StringNull(),
+		ReadyTimeout:        types.StringNull(),
+		TargetOnlineTimeout: types.StringNull(),
+		TargetPollInterval:  types.StringNull(),
+		Probe:               types.BoolNull(),
+	}
+}
+
+// newPrivateData sets private to empty private data, whose type is internal
+// to the framework.
+func newPrivateData[T any](private **T) {
+	*private = new(T)
+}
+
+// openEphemeralTunnel opens r with config, and returns its result and the
+// response holding its private data.
+func openEphemeralTunnel(t *testing.T, r *RemoteTunnelEphemeralResource, config RemoteTunnelEphemeralModel) (RemoteTunnelEphemeralModel, *ephemeral.OpenResponse) {
+	t.Helper()
+	ctx := context.Background()
+	var schemaResp ephemeral.SchemaResponse
+	r.Schema(ctx, ephemeral.SchemaRequest{}, &schemaResp)
+	s := schemaResp.Schema
+	raw := tfsdk.State{Schema: s, Raw: tftypes.NewValue(s.Type().TerraformType(ctx), nil)}
+	if diags := raw.Set(ctx, &config); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	resp := &ephemeral.OpenResponse{
+		Result: tfsdk.EphemeralResultData{Schema: s, Raw: tftypes.NewValue(s.Type().TerraformType(ctx), nil)},
+	}
+	newPrivateData(&resp.Private)
+	r.Open(ctx, ephemeral.OpenRequest{Config: tfsdk.Config{Schema: s, Raw: raw.Raw}}, resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	var result RemoteTunnelEphemeralModel
+	if diags := resp.Result.Get(ctx, &result); diags.HasError() {
+		t.Fatal(diags)
+	}
+	return result, resp
+}
+
+func TestEphemeralTunnelPrivateData(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	r, _ := newEphemeralTunnel(t, server.URL)
+	echo := newEchoServer(t)
+
+	result, resp := openEphemeralTunnel(t, r, ephemeralEchoConfig(echo))
+	roundTrip(t, int(result.LocalPort.ValueInt64()), "hello")
+	if result.ResolvedTarget.ValueString() != testTarget {
+		t.Errorf("got resolved target %s, want %s", result.ResolvedTarget, testTarget)
+	}
+	if resp.RenewAt.IsZero() {
+		t.Error("renewal was not scheduled")
+	}
+
+	tunnel, diags := getEphemeralTunnel(context.Background(), resp.Private.GetKey)
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if tunnel.ID == "" {
+		t.Error("no tunnel user was stored")
+	}
+	want := TunnelSpec{
+		Target:     testTarget,
+		Region:     "us-east-1",
+		RemoteHost: echo.Host(),
+		RemotePort: echo.Port(),
+		LocalPort:  int(result.LocalPort.ValueInt64()),
+	}
+	if tunnel.Spec.key() != want.key() {
+		t.Errorf("got spec %+v, want %+v", tunnel.Spec, want)
+	}
+}
+
+func TestEphemeralTunnelRenewReopensDeadTunnel(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	r, configData := newEphemeralTunnel(t, server.URL)
+	echo := newEchoServer(t)
+
+	result, openResp := openEphemeralTunnel(t, r, ephemeralEchoConfig(echo))
+	port := int(result.LocalPort.ValueInt64())
+	for _, tunnels := range configData.Tracker.Tunnels(nil) {
+		for _, tunnel := range tunnels {
+			_ = tunnel.Close()
+		}
+	}
+
+	var resp ephemeral.RenewResponse
+	r.Renew(context.Background(), ephemeral.RenewRequest{Private: openResp.Private}, &resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	if resp.RenewAt.IsZero() {
+		t.Error("next renewal was not scheduled")
+	}
+	// The tunnel is reopened on the local port other providers were given
+	roundTrip(t, port, "reopened")
+	if sessions := server.Sessions(); len(sessions) != 2 {
+		t.Errorf("got %d sessions, want a new one", len(sessions))
+	}
+}
+
+func TestEphemeralTunnelCloseReleasesTunnel(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	r, configData := newEphemeralTunnel(t, server.URL)
+	echo := newEchoServer(t)
+
+	// Both instances share the tunnel
+	_, first := openEphemeralTunnel(t, r, ephemeralEchoConfig(echo))
+	result, second := openEphemeralTunnel(t, r, ephemeralEchoConfig(echo))
+	if sessions := server.Sessions(); len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want a shared one", len(sessions))
+	}
+
+	var resp ephemeral.CloseResponse
+	r.Close(context.Background(), ephemeral.CloseRequest{Private: first.Private}, &resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	if tunnels := configData.Tracker.Tunnels(nil); len(tunnels) != 1 {
+		t.Fatalf("got users %v, want the second instance only", tunnels)
+	}
+	roundTrip(t, int(result.LocalPort.ValueInt64()), "still open")
+
+	r.Close(context.Background(), ephemeral.CloseRequest{Private: second.Private}, &resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	if tunnels := configData.Tracker.Tunnels(nil); len(tunnels) != 0 {
+		t.Errorf("got users %v after closing", tunnels)
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were not terminated", active)
+	}
+}
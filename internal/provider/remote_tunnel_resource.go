@@ -2,21 +2,49 @@ package provider
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ports"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
 	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 )
 
+// Descriptions of the attributes shared by the remote_tunnel resource and
+// ephemeral resource.
+const (
+	tunnelTargetDescription              = "The target to start the remote tunnel, such as an instance ID. Defaults to the provider's `target`, `targets`, `target_selector` or `ecs_target`"
+	tunnelTargetsDescription             = "Targets tried in order instead of a single `target`. The tunnel fails over to the next one when a target is not connected, including when the session of a running tunnel is lost. Defaults to the provider's `targets`"
+	tunnelTargetSelectorDescription      = "Selects the target among the online managed instances instead of naming it in `target`. Defaults to the provider's `target_selector`"
+	tunnelResolvedTargetDescription      = "The target the tunnel goes through: `target`, the one of `targets` it failed over to, the instance picked by `target_selector`, the container picked by `ecs_target`, or the provider's ephemeral bastion"
+	tunnelRegionDescription              = "The region of the target. Defaults to the provider's `region`"
+	tunnelDocumentNameDescription        = "The Session Manager document starting the session: `" + ssmtunnels.DocumentPortForwardingToRemoteHost + "` to forward to `remote_host`, `" + ssmtunnels.DocumentPortForwarding + "` to forward to a port on the target itself, or a custom port forwarding document. Defaults to the first when `remote_host` is set, and to the second otherwise"
+	tunnelDocumentParametersDescription  = "Parameters for a custom `document_name`, checked against the parameters the document declares when planning. `portNumber` and `host` default to `remote_port` and `remote_host` when the document declares them, and `localPortNumber` is set to the local port"
+	tunnelRemoteHostDescription          = "The DNS name or IP address of the remote host. Leave unset to forward to a port on the target itself"
+	tunnelRemotePortDescription          = "The port number of the remote host"
+	tunnelLocalHostDescription           = "The DNS name or IP address of the local host"
+	tunnelLocalPortDescription           = "The local port number to use for the tunnel"
+	tunnelReadyTimeoutDescription        = "How long to wait for the tunnel to become ready, as a duration such as `30s` or `2m`. Defaults to `60s`"
+	tunnelTargetOnlineTimeoutDescription = "How long to wait for the SSM agent of the target to be online before starting the session, as a duration such as `10m`. Set it when the target is created in the same run, as its agent takes a while to register. The session is started right away when unset"
+	tunnelTargetPollIntervalDescription  = "How often the status of the target is checked while waiting for it to be online, as a duration. Defaults to `10s`"
+	tunnelProbeDescription               = "Open a test connection through the tunnel to check the remote port is reachable before the tunnel is considered ready"
+)
+
 // Ensure provider defined types fully satisfy framework interfaces.
 var _ resource.Resource = &RemoteTunnelResource{}
 var _ resource.ResourceWithImportState = &RemoteTunnelResource{}
+var _ resource.ResourceWithValidateConfig = &RemoteTunnelResource{}
+var _ resource.ResourceWithModifyPlan = &RemoteTunnelResource{}
 
 func NewRemoteTunnelResource() resource.Resource {
 	return &RemoteTunnelResource{}
@@ -24,19 +52,38 @@ func NewRemoteTunnelResource() resource.Resource {
 
 // RemoteTunnelResource defines the resource implementation.
 type RemoteTunnelResource struct {
-	tracker *TunnelTracker
-	region  string
-	target  string
+	tracker        *TunnelTracker
+	region         string
+	target         string
+	targets        []string
+	targetSelector *ssmtunnels.TargetSelector
+	ecsTarget      *ssmtunnels.ECSTarget
+	// ephemeralBastion is set when the provider's tunnels go through the
+	// bastion task launched by the tracker.
+	ephemeralBastion bool
 }
 
 // SSMRemoteTunnelDataSourceModel describes the data source data model.
 type SSMRemoteTunnelResourceModel struct {
-	RefreshId  types.String `tfsdk:"refresh_id"`
-	RemoteHost types.String `tfsdk:"remote_host"`
-	RemotePort types.Int64  `tfsdk:"remote_port"`
-	LocalPort  types.Int64  `tfsdk:"local_port"`
-	LocalHost  types.String `tfsdk:"local_host"`
-	Id         types.String `tfsdk:"id"`
+	RefreshId           types.String         `tfsdk:"refresh_id"`
+	Target              types.String         `tfsdk:"target"`
+	Targets             types.List           `tfsdk:"targets"`
+	TargetSelector      *TargetSelectorModel `tfsdk:"target_selector"`
+	ECSTarget           *ECSTargetModel      `tfsdk:"ecs_target"`
+	ResolvedTarget      types.String         `tfsdk:"resolved_target"`
+	Region              types.String         `tfsdk:"region"`
+	DocumentName        types.String         `tfsdk:"document_name"`
+	DocumentParameters  types.Map            `tfsdk:"document_parameters"`
+	RemoteHost          types.String         `tfsdk:"remote_host"`
+	RemotePort          types.Int64          `tfsdk:"remote_port"`
+	LocalPort           types.Int64          `tfsdk:"local_port"`
+	LocalHost           types.String         `tfsdk:"local_host"`
+	ReadyTimeout        types.String         `tfsdk:"ready_timeout"`
+	TargetOnlineTimeout types.String         `tfsdk:"target_online_timeout"`
+	TargetPollInterval  types.String         `tfsdk:"target_poll_interval"`
+	Probe               types.Bool           `tfsdk:"probe"`
+	DrainTimeout        types.String         `tfsdk:"drain_timeout"`
+	Id                  types.String         `tfsdk:"id"`
 }
 
 func (d *RemoteTunnelResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
@@ -49,26 +96,115 @@ func (d *RemoteTunnelResource) Schema(ctx context.Context, req resource.SchemaRe
 
 		Attributes: map[string]schema.Attribute{
 			"refresh_id": schema.StringAttribute{
-				MarkdownDescription: "Any value as this will trigger a refresh",
-				Required:            true,
+				MarkdownDescription: "Not used anymore, as the tunnel is checked and reopened when needed on every refresh",
+				Optional:            true,
+				DeprecationMessage:  "refresh_id is not needed anymore and can be removed",
+			},
+			"target": schema.StringAttribute{
+				MarkdownDescription: tunnelTargetDescription,
+				Optional:            true,
+			},
+			"targets": schema.ListAttribute{
+				MarkdownDescription: tunnelTargetsDescription,
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"target_selector": schema.SingleNestedAttribute{
+				MarkdownDescription: tunnelTargetSelectorDescription,
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"tags": schema.MapAttribute{
+						MarkdownDescription: targetSelectorTagsDescription,
+						ElementType:         types.StringType,
+						Optional:            true,
+					},
+					"ssm_filters": schema.MapAttribute{
+						MarkdownDescription: targetSelectorSSMFiltersDescription,
+						ElementType:         types.ListType{ElemType: types.StringType},
+						Optional:            true,
+					},
+					"strategy": schema.StringAttribute{
+						MarkdownDescription: targetSelectorStrategyDescription,
+						Optional:            true,
+					},
+				},
+			},
+			"ecs_target": schema.SingleNestedAttribute{
+				MarkdownDescription: ecsTargetDescription + ". Defaults to the provider's `ecs_target`",
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"cluster": schema.StringAttribute{
+						MarkdownDescription: ecsTargetClusterDescription,
+						Required:            true,
+					},
+					"service": schema.StringAttribute{
+						MarkdownDescription: ecsTargetServiceDescription,
+						Optional:            true,
+					},
+					"family": schema.StringAttribute{
+						MarkdownDescription: ecsTargetFamilyDescription,
+						Optional:            true,
+					},
+					"container": schema.StringAttribute{
+						MarkdownDescription: ecsTargetContainerDescription,
+						Required:            true,
+					},
+				},
+			},
+			"resolved_target": schema.StringAttribute{
+				MarkdownDescription: tunnelResolvedTargetDescription,
+				Computed:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: tunnelRegionDescription,
+				Optional:            true,
+			},
+			"document_name": schema.StringAttribute{
+				MarkdownDescription: tunnelDocumentNameDescription,
+				Optional:            true,
+			},
+			"document_parameters": schema.MapAttribute{
+				MarkdownDescription: tunnelDocumentParametersDescription,
+				ElementType:         types.StringType,
+				Optional:            true,
 			},
 			"remote_host": schema.StringAttribute{
-				MarkdownDescription: "The DNS name or IP address of the remote host",
-				Required:            true,
+				MarkdownDescription: tunnelRemoteHostDescription,
+				Optional:            true,
 			},
 			"remote_port": schema.Int64Attribute{
-				MarkdownDescription: "The port number of the remote host",
+				MarkdownDescription: tunnelRemotePortDescription,
 				Required:            true,
 			},
 			"local_host": schema.StringAttribute{
-				MarkdownDescription: "The DNS name or IP address of the local host",
+				MarkdownDescription: tunnelLocalHostDescription,
 				Computed:            true,
 			},
 			"local_port": schema.Int64Attribute{
-				MarkdownDescription: "The local port number to use for the tunnel",
+				MarkdownDescription: tunnelLocalPortDescription + ". When unset, an open port is picked while planning a new tunnel and kept in the plan",
 				Optional:            true,
 				Computed:            true,
 			},
+			"ready_timeout": schema.StringAttribute{
+				MarkdownDescription: tunnelReadyTimeoutDescription,
+				Optional:            true,
+			},
+			"target_online_timeout": schema.StringAttribute{
+				MarkdownDescription: tunnelTargetOnlineTimeoutDescription,
+				Optional:            true,
+			},
+			"target_poll_interval": schema.StringAttribute{
+				MarkdownDescription: tunnelTargetPollIntervalDescription,
+				Optional:            true,
+			},
+			"probe": schema.BoolAttribute{
+				MarkdownDescription: tunnelProbeDescription,
+				Optional:            true,
+			},
+			"drain_timeout": schema.StringAttribute{
+				MarkdownDescription: fmt.Sprintf("How long to wait for the client connections of the tunnel to finish when it is destroyed or replaced, as a duration such as `30s`. Connections still open afterwards are dropped. Defaults to `%s`", DefaultDrainTimeout),
+				Optional:            true,
+			},
 			"id": schema.StringAttribute{
 				MarkdownDescription: "Example identifier", // TODO: Figure this out
 				Computed:            true,
@@ -78,24 +214,37 @@ func (d *RemoteTunnelResource) Schema(ctx context.Context, req resource.SchemaRe
 }
 
 func (d *RemoteTunnelResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	resp.Diagnostics.Append(d.configure(req.ProviderData)...)
+}
+
+// configure takes the provider's tracker and default targets from
+// providerData.
+func (d *RemoteTunnelResource) configure(providerData any) diag.Diagnostics {
+	var diags diag.Diagnostics
+
 	// Prevent panic if the provider has not been configured.
-	if req.ProviderData == nil {
-		return
+	if providerData == nil {
+		return diags
 	}
 
-	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	configData, ok := providerData.(*ProvidedConfigData)
 	if !ok {
-		resp.Diagnostics.AddError(
+		diags.AddError(
 			"Unexpected Data Source Configure Type",
-			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", providerData),
 		)
 
-		return
+		return diags
 	}
 
 	d.tracker = configData.Tracker
 	d.region = configData.Region
 	d.target = configData.Target
+	d.targets = configData.Targets
+	d.targetSelector = configData.TargetSelector
+	d.ecsTarget = configData.ECSTarget
+	d.ephemeralBastion = configData.EphemeralBastion
+	return diags
 }
 
 func (d *RemoteTunnelResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
@@ -108,29 +257,44 @@ func (d *RemoteTunnelResource) Create(ctx context.Context, req resource.CreateRe
 		return
 	}
 
-	var port int
-	var err error
-	port = int(data.LocalPort.ValueInt64())
-	if port == 0 {
-		port, err = ports.FindOpenPort(16000, 26000)
-		if err != nil {
-			resp.Diagnostics.AddError(
-				"Failed to find open port",
-				fmt.Sprintf("Error: %s", err),
-			)
-			return
-		}
+	// The ID is registered with the tracker as a user of the tunnel. The ID
+	// and local port of a tunnel opened while planning are pinned in the plan
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("id"), &data.Id)...)
+	resp.Diagnostics.Append(plannedLocalPort(ctx, req.Plan, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.Id.IsUnknown() {
+		data.Id = basetypes.NewStringValue(uuid.New().String())
+	}
+
+	readiness, diags := readinessConfig(data)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// A selected instance shown in the plan is used as is
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("resolved_target"), &data.ResolvedTarget)...)
+	failover, diags := d.resolveTarget(ctx, &data, resolveForApply, readiness)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
 	}
 
-	tunnelInfo, err := d.tracker.StartTunnel(
-		ctx,
-		data.Id.ValueString(),
-		d.target,
-		data.RemoteHost.ValueString(),
-		int(data.RemotePort.ValueInt64()),
-		port,
-		d.region,
-	)
+	spec, diags := d.tunnelSpec(ctx, data)
+	spec.FailoverTargets = failover
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tunnelInfo, err := d.tracker.StartTunnel(ctx, data.Id.ValueString(), spec, readiness)
 
 	if err != nil {
 		resp.Diagnostics.AddError(
@@ -140,7 +304,14 @@ func (d *RemoteTunnelResource) Create(ctx context.Context, req resource.CreateRe
 		return
 	}
 
-	data.Id = basetypes.NewStringValue(uuid.New().String())
+	if target := tunnelInfo.Tunnel.Target(); target != spec.Target {
+		resp.Diagnostics.AddWarning(
+			"Remote tunnel failed over",
+			fmt.Sprintf("The tunnel goes through %s, as %s was not available", target, spec.Target),
+		)
+	}
+	data.ResolvedTarget = basetypes.NewStringValue(tunnelInfo.Tunnel.Target())
+
 	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
 	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
 
@@ -157,29 +328,41 @@ func (d *RemoteTunnelResource) Read(ctx context.Context, req resource.ReadReques
 		return
 	}
 
-	var port int
-	var err error
-	port = int(data.LocalPort.ValueInt64())
-	if port == 0 {
-		port, err = ports.FindOpenPort(16000, 26000)
-		if err != nil {
-			resp.Diagnostics.AddError(
-				"Failed to find open port",
-				fmt.Sprintf("Error: %s", err),
-			)
-			return
-		}
+	readiness, diags := readinessConfig(data)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
 	}
 
-	tunnelInfo, err := d.tracker.StartTunnel(
-		ctx,
-		data.Id.ValueString(),
-		d.target,
-		data.RemoteHost.ValueString(),
-		int(data.RemotePort.ValueInt64()),
-		port,
-		d.region,
-	)
+	// A tunnel still running in this provider process is kept as is, and only
+	// a dead one, or one from a previous run, is reopened
+	if tunnelInfo, ok := d.tracker.LiveTunnel(ctx, data.Id.ValueString(), readiness); ok {
+		data.ResolvedTarget = basetypes.NewStringValue(tunnelInfo.Tunnel.Target())
+		data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
+		data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
+
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
+	}
+
+	previous := data.ResolvedTarget.ValueString()
+	failover, diags := d.resolveTarget(ctx, &data, resolveForRead, readiness)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	spec, diags := d.tunnelSpec(ctx, data)
+	spec.FailoverTargets = failover
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tunnelInfo, err := d.tracker.StartTunnel(ctx, data.Id.ValueString(), spec, readiness)
 
 	if err != nil {
 		resp.Diagnostics.AddError(
@@ -189,7 +372,15 @@ func (d *RemoteTunnelResource) Read(ctx context.Context, req resource.ReadReques
 		return
 	}
 
-	data.RefreshId = basetypes.NewStringValue(uuid.New().String()) // NOTE: We always change this in order to force an update
+	// Every run launches its own bastion
+	if target := tunnelInfo.Tunnel.Target(); previous != "" && target != previous && !d.usesBastion(data) {
+		resp.Diagnostics.AddWarning(
+			"Remote tunnel moved to another target",
+			fmt.Sprintf("The tunnel goes through %s instead of %s", target, previous),
+		)
+	}
+	data.ResolvedTarget = basetypes.NewStringValue(tunnelInfo.Tunnel.Target())
+
 	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
 	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
 
@@ -206,29 +397,48 @@ func (d *RemoteTunnelResource) Update(ctx context.Context, req resource.UpdateRe
 		return
 	}
 
-	var port int
-	var err error
-	port = int(data.LocalPort.ValueInt64())
-	if port == 0 {
-		port, err = ports.FindOpenPort(16000, 26000)
-		if err != nil {
-			resp.Diagnostics.AddError(
-				"Failed to find open port",
-				fmt.Sprintf("Error: %s", err),
-			)
-			return
-		}
+	// Keep the ID the tunnel was registered under
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("id"), &data.Id)...)
+
+	if resp.Diagnostics.HasError() {
+		return
 	}
 
-	tunnelInfo, err := d.tracker.StartTunnel(
-		ctx,
-		data.Id.ValueString(),
-		d.target,
-		data.RemoteHost.ValueString(),
-		int(data.RemotePort.ValueInt64()),
-		port,
-		d.region,
-	)
+	readiness, diags := readinessConfig(data)
+	resp.Diagnostics.Append(diags...)
+	drainTimeout := parseDrainTimeout(data, &resp.Diagnostics)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// A selected instance shown in the plan is used as is
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("resolved_target"), &data.ResolvedTarget)...)
+	failover, diags := d.resolveTarget(ctx, &data, resolveForApply, readiness)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	spec, diags := d.tunnelSpec(ctx, data)
+	spec.FailoverTargets = failover
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The previous tunnel is closed first, as the new one may listen on the
+	// same local port
+	if err := d.tracker.ReleaseOthers(ctx, data.Id.ValueString(), spec, drainTimeout); err != nil {
+		resp.Diagnostics.AddWarning(
+			"Failed to close previous remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+
+	tunnelInfo, err := d.tracker.StartTunnel(ctx, data.Id.ValueString(), spec, readiness)
 
 	if err != nil {
 		resp.Diagnostics.AddError(
@@ -238,7 +448,14 @@ func (d *RemoteTunnelResource) Update(ctx context.Context, req resource.UpdateRe
 		return
 	}
 
-	data.Id = basetypes.NewStringValue(uuid.New().String())
+	if target := tunnelInfo.Tunnel.Target(); target != spec.Target {
+		resp.Diagnostics.AddWarning(
+			"Remote tunnel failed over",
+			fmt.Sprintf("The tunnel goes through %s, as %s was not available", target, spec.Target),
+		)
+	}
+	data.ResolvedTarget = basetypes.NewStringValue(tunnelInfo.Tunnel.Target())
+
 	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
 	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
 
@@ -254,15 +471,514 @@ func (d *RemoteTunnelResource) Delete(ctx context.Context, req resource.DeleteRe
 	if resp.Diagnostics.HasError() {
 		return
 	}
+
+	drainTimeout := parseDrainTimeout(data, &resp.Diagnostics)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if err := d.tracker.Release(ctx, data.Id.ValueString(), drainTimeout); err != nil {
+		resp.Diagnostics.AddWarning(
+			"Failed to close remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+}
+
+// parseDrainTimeout returns how long closing the tunnel waits for its client
+// connections.
+func parseDrainTimeout(data SSMRemoteTunnelResourceModel, diags *diag.Diagnostics) time.Duration {
+	timeout := parseDuration(data.DrainTimeout, path.Root("drain_timeout"), diags)
+	if timeout == 0 {
+		return DefaultDrainTimeout
+	}
+	return timeout
+}
+
+func (d *RemoteTunnelResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var data SSMRemoteTunnelResourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(validateTunnelConfig(ctx, data)...)
+}
+
+// validateTunnelConfig checks the tunnel settings do not conflict.
+func validateTunnelConfig(ctx context.Context, data SSMRemoteTunnelResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if countSet(!data.Target.IsNull(), !data.Targets.IsNull(), data.TargetSelector != nil, data.ECSTarget != nil) > 1 {
+		diags.AddError(
+			"Conflicting targets",
+			"Only one of target, targets, target_selector and ecs_target can be set",
+		)
+	}
+	if data.TargetSelector != nil {
+		if data.TargetSelector.isKnown() {
+			_, selectorDiags := data.TargetSelector.selector(ctx, path.Root("target_selector"))
+			diags.Append(selectorDiags...)
+		}
+	}
+	if data.ECSTarget.isKnown() {
+		_, ecsTargetDiags := data.ECSTarget.ecsTarget(path.Root("ecs_target"))
+		diags.Append(ecsTargetDiags...)
+	}
+	validatePort(data.RemotePort, path.Root("remote_port"), &diags)
+	validatePort(data.LocalPort, path.Root("local_port"), &diags)
+
+	// Unknown values are checked once they are known, when the tunnel starts.
+	if data.DocumentName.IsUnknown() || data.RemoteHost.IsUnknown() {
+		return diags
+	}
+
+	documentName := data.DocumentName.ValueString()
+	switch documentName {
+	case ssmtunnels.DocumentPortForwardingToRemoteHost:
+		if data.RemoteHost.IsNull() {
+			diags.AddAttributeError(
+				path.Root("remote_host"),
+				"Missing remote host",
+				fmt.Sprintf("remote_host must be set to use %s", ssmtunnels.DocumentPortForwardingToRemoteHost),
+			)
+		}
+	case ssmtunnels.DocumentPortForwarding:
+		if !data.RemoteHost.IsNull() {
+			diags.AddAttributeError(
+				path.Root("remote_host"),
+				"Unexpected remote host",
+				fmt.Sprintf("remote_host can not be used with %s, which forwards to a port on the target itself", ssmtunnels.DocumentPortForwarding),
+			)
+		}
+	}
+	if (documentName == "" || ssmtunnels.IsAWSDocument(documentName)) && !data.DocumentParameters.IsNull() {
+		diags.AddAttributeError(
+			path.Root("document_parameters"),
+			"Unexpected document parameters",
+			"document_parameters can only be used with a custom document_name",
+		)
+	}
+	return diags
+}
+
+// ModifyPlan shows the target the tunnel goes through in the plan, checks
+// the parameters of custom documents against the ones the document declares,
+// so mistakes are reported before apply, and opens the tunnel of a new
+// resource for the providers using it during plan.
+func (d *RemoteTunnelResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Nothing to check when destroying, or before the provider is configured
+	if req.Plan.Raw.IsNull() || d.tracker == nil {
+		return
+	}
+
+	var data SSMRemoteTunnelResourceModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(d.checkDocument(ctx, data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if !data.Target.IsUnknown() && isFullyKnown(data.Targets) && !data.Region.IsUnknown() && (data.TargetSelector == nil || data.TargetSelector.isKnown()) && (data.ECSTarget == nil || data.ECSTarget.isKnown()) {
+		// The current instance is kept while it still matches
+		if !req.State.Raw.IsNull() {
+			resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("resolved_target"), &data.ResolvedTarget)...)
+		}
+		// Invalid durations are reported when the tunnel starts
+		readiness, _ := readinessConfig(data)
+		failover, diags := d.resolveTarget(ctx, &data, resolveForPlan, readiness)
+		resp.Diagnostics.Append(diags...)
+
+		if resp.Diagnostics.HasError() {
+			return
+		}
+
+		// With failover targets, the target is only known once the tunnel
+		// started, and so is an instance that is not online yet
+		if len(failover) == 0 && !data.ResolvedTarget.IsUnknown() {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("resolved_target"), data.ResolvedTarget)...)
+		}
+
+		// An existing tunnel was opened when refreshing it
+		if req.State.Raw.IsNull() {
+			d.planTunnel(ctx, req, resp, data, failover)
+		}
+	}
+}
+
+// checkDocument checks the parameters of a custom document against the ones
+// the document declares, once they are known.
+func (d *RemoteTunnelResource) checkDocument(ctx context.Context, data SSMRemoteTunnelResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	documentName := data.DocumentName.ValueString()
+	if documentName == "" || ssmtunnels.IsAWSDocument(documentName) {
+		return diags
+	}
+	if data.DocumentName.IsUnknown() || !isFullyKnown(data.DocumentParameters) || data.RemoteHost.IsUnknown() || data.RemotePort.IsUnknown() || data.Region.IsUnknown() {
+		return diags
+	}
+
+	spec, diags := d.tunnelSpec(ctx, data)
+
+	if diags.HasError() {
+		return diags
+	}
+
+	document, err := ssmtunnels.DescribeSessionDocument(ctx, d.tracker.Client(spec.Region), documentName)
+	if err != nil {
+		diags.AddAttributeError(
+			path.Root("document_name"),
+			"Invalid document",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return diags
+	}
+	_, parameters, err := spec.remoteTunnelConfig().SessionDocument(document)
+	if err != nil {
+		diags.AddAttributeError(
+			path.Root("document_name"),
+			"Invalid document",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return diags
+	}
+
+	for _, problem := range ssmtunnels.CheckDocumentParameters(document, parameters) {
+		attribute := path.Root("document_parameters")
+		if _, ok := data.DocumentParameters.Elements()[problem.Parameter]; ok {
+			attribute = attribute.AtMapKey(problem.Parameter)
+		}
+		diags.AddAttributeError(
+			attribute,
+			"Invalid document parameter",
+			fmt.Sprintf("Error: %s", problem),
+		)
+	}
+	return diags
+}
+
+// planTunnel opens the tunnel of a new resource while planning, so the
+// providers configured with its local_host and local_port can reach it during
+// the first plan, and pins its ID and local port in the plan for apply to use
+// the same tunnel. Nothing is opened while the tunnel settings are unknown, or
+// for the ephemeral bastion, which is only launched during apply.
+func (d *RemoteTunnelResource) planTunnel(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse, data SSMRemoteTunnelResourceModel, failover []string) {
+	if d.usesBastion(data) || data.ResolvedTarget.IsUnknown() {
+		return
+	}
+	if data.DocumentName.IsUnknown() || !isFullyKnown(data.DocumentParameters) || data.RemoteHost.IsUnknown() || data.RemotePort.IsUnknown() {
+		return
+	}
+	if data.ReadyTimeout.IsUnknown() || data.TargetOnlineTimeout.IsUnknown() || data.TargetPollInterval.IsUnknown() || data.Probe.IsUnknown() {
+		return
+	}
+
+	// The planned local port is unknown unless configured
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("local_port"), &data.LocalPort)...)
+
+	if resp.Diagnostics.HasError() || data.LocalPort.IsUnknown() {
+		return
+	}
+
+	readiness, diags := readinessConfig(data)
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	spec, diags := d.tunnelSpec(ctx, data)
+	spec.FailoverTargets = failover
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	id, preferredPort := planTunnelID(spec)
+	spec.PreferredLocalPort = preferredPort
+	tunnelInfo, err := d.tracker.StartTunnel(ctx, id, spec, readiness)
+
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to start remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("id"), id)...)
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("local_port"), int64(tunnelInfo.LocalPort))...)
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("local_host"), tunnelInfo.LocalHost)...)
+}
+
+// planTunnelNamespace namespaces the IDs of tunnels opened while planning.
+var planTunnelNamespace = uuid.MustParse("5c0f3d1e-8a7b-4e52-9f61-2d4b7c9e0a13")
+
+// planTunnelID returns the ID a tunnel opened while planning is registered
+// under, and the port its search for an open local port starts at. Terraform
+// plans again during apply, in a new provider process, and fails when the
+// values pinned in the plan change, so both are derived from spec instead of
+// being random. Identical tunnels get the same ID, and share the tunnel.
+func planTunnelID(spec TunnelSpec) (string, int) {
+	id := uuid.NewSHA1(planTunnelNamespace, fmt.Appendf(nil, "%+v", spec.key()))
+	size := localPortRangeUpper - localPortRangeLower + 1
+	port := localPortRangeLower + int(binary.BigEndian.Uint32(id[:4])%uint32(size))
+	return id.String(), port
+}
+
+// resolveMode is the step of the resource lifecycle a target is resolved for.
+type resolveMode int
+
+const (
+	// resolveForPlan checks the selected instance still matches, without
+	// waiting for one to come online.
+	resolveForPlan resolveMode = iota
+	// resolveForApply keeps the instance selected in the plan.
+	resolveForApply
+	// resolveForRead checks the selected instance still matches.
+	resolveForRead
+)
+
+// resolveTarget sets the resolved_target of data to the target the tunnel
+// starts on, and returns the targets it fails over to. The resource's target,
+// targets, target_selector or ecs_target take precedence over the provider's.
+// An instance picked by a selector, or a container picked by an ECS target, is
+// kept while it still matches. When nothing matches, it waits as long as
+// readiness allows, or leaves the target unknown while planning.
+func (d *RemoteTunnelResource) resolveTarget(ctx context.Context, data *SSMRemoteTunnelResourceModel, mode resolveMode, readiness ReadinessConfig) ([]string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	if d.usesBastion(*data) {
+		return nil, d.resolveBastion(ctx, data, mode, readiness)
+	}
+
+	targets, selector, ecsTarget := d.targets, d.targetSelector, d.ecsTarget
+	if d.target != "" {
+		targets = []string{d.target}
+	}
+	switch {
+	case data.Target.ValueString() != "":
+		targets, selector, ecsTarget = []string{data.Target.ValueString()}, nil, nil
+	case len(data.Targets.Elements()) > 0:
+		targets, selector, ecsTarget = nil, nil, nil
+		diags.Append(data.Targets.ElementsAs(ctx, &targets, false)...)
+		if diags.HasError() {
+			return nil, diags
+		}
+	case data.TargetSelector != nil:
+		targets, ecsTarget = nil, nil
+		selector, diags = data.TargetSelector.selector(ctx, path.Root("target_selector"))
+		if diags.HasError() {
+			return nil, diags
+		}
+	case data.ECSTarget != nil:
+		targets, selector = nil, nil
+		ecsTarget, diags = data.ECSTarget.ecsTarget(path.Root("ecs_target"))
+		if diags.HasError() {
+			return nil, diags
+		}
+	}
+
+	if selector == nil && ecsTarget == nil {
+		if len(targets) == 0 {
+			diags.AddAttributeError(
+				path.Root("target"),
+				"Missing target",
+				"target, targets, target_selector or ecs_target must be set on the resource or on the provider, unless the provider has an ephemeral_bastion",
+			)
+			return nil, diags
+		}
+		data.ResolvedTarget = basetypes.NewStringValue(targets[0])
+		return targets[1:], diags
+	}
+
+	current := data.ResolvedTarget
+	if mode == resolveForApply && !current.IsUnknown() && current.ValueString() != "" {
+		return nil, diags
+	}
+
+	// Planning does not wait for an instance, which may only come online
+	// during apply
+	waiting := readiness.TargetTimeout > 0
+	if mode == resolveForPlan {
+		readiness.TargetTimeout = 0
+	}
+	var resolved string
+	var err error
+	attribute := path.Root("target_selector")
+	if ecsTarget != nil {
+		attribute = path.Root("ecs_target")
+		resolved, err = d.tracker.ResolveECSTarget(ctx, d.tunnelRegion(*data), *ecsTarget, current.ValueString(), readiness)
+	} else {
+		resolved, err = d.tracker.ResolveTarget(ctx, d.tunnelRegion(*data), *selector, current.ValueString(), readiness)
+	}
+	if mode == resolveForPlan && waiting && (errors.Is(err, ssmtunnels.ErrNoTarget) || errors.Is(err, ssmtunnels.ErrNoECSTask)) {
+		data.ResolvedTarget = basetypes.NewStringUnknown()
+		return nil, diags
+	}
+	if err != nil {
+		diags.AddAttributeError(
+			attribute,
+			"Failed to select target",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return nil, diags
+	}
+	data.ResolvedTarget = basetypes.NewStringValue(resolved)
+	return nil, diags
+}
+
+// usesBastion reports whether the tunnel goes through the provider's ephemeral
+// bastion, as the resource does not set a target.
+func (d *RemoteTunnelResource) usesBastion(data SSMRemoteTunnelResourceModel) bool {
+	return d.ephemeralBastion && data.Target.ValueString() == "" && len(data.Targets.Elements()) == 0 && data.TargetSelector == nil && data.ECSTarget == nil
+}
+
+// resolveBastion sets the resolved_target of data to the ephemeral bastion,
+// launching it when needed. Every run launches its own bastion, so the target
+// is only known once applied.
+func (d *RemoteTunnelResource) resolveBastion(ctx context.Context, data *SSMRemoteTunnelResourceModel, mode resolveMode, readiness ReadinessConfig) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if d.tunnelRegion(*data) != d.region {
+		diags.AddAttributeError(
+			path.Root("region"),
+			"Unexpected region",
+			"The ephemeral bastion runs in the provider's region. Set a target to start the tunnel in another region",
+		)
+		return diags
+	}
+	if mode == resolveForPlan {
+		data.ResolvedTarget = basetypes.NewStringUnknown()
+		return diags
+	}
+
+	target, err := d.tracker.Bastion(ctx, readiness.pollInterval())
+	if err != nil {
+		diags.AddError(
+			"Failed to launch ephemeral bastion",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return diags
+	}
+	data.ResolvedTarget = basetypes.NewStringValue(target)
+	return diags
+}
+
+// tunnelRegion returns the region of the target.
+func (d *RemoteTunnelResource) tunnelRegion(data SSMRemoteTunnelResourceModel) string {
+	if data.Region.ValueString() != "" {
+		return data.Region.ValueString()
+	}
+	return d.region
+}
+
+// tunnelSpec describes the tunnel the resource asks for, through the target
+// resolved by resolveTarget.
+func (d *RemoteTunnelResource) tunnelSpec(ctx context.Context, data SSMRemoteTunnelResourceModel) (TunnelSpec, diag.Diagnostics) {
+	spec := TunnelSpec{
+		Target:       data.ResolvedTarget.ValueString(),
+		Region:       d.tunnelRegion(data),
+		DocumentName: data.DocumentName.ValueString(),
+		RemoteHost:   data.RemoteHost.ValueString(),
+		RemotePort:   int(data.RemotePort.ValueInt64()),
+		LocalPort:    int(data.LocalPort.ValueInt64()),
+	}
+
+	var diags diag.Diagnostics
+	if !data.DocumentParameters.IsNull() {
+		var parameters map[string]string
+		diags.Append(data.DocumentParameters.ElementsAs(ctx, &parameters, false)...)
+		spec.DocumentParameters = make(map[string][]string, len(parameters))
+		for name, value := range parameters {
+			spec.DocumentParameters[name] = []string{value}
+		}
+	}
+	return spec, diags
+}
+
+// plannedLocalPort sets the local_port of data to the one pinned in plan, if
+// any.
+func plannedLocalPort(ctx context.Context, plan tfsdk.Plan, data *SSMRemoteTunnelResourceModel) diag.Diagnostics {
+	var localPort types.Int64
+	diags := plan.GetAttribute(ctx, path.Root("local_port"), &localPort)
+	if !localPort.IsUnknown() && !localPort.IsNull() {
+		data.LocalPort = localPort
+	}
+	return diags
+}
+
+// readinessConfig builds the readiness settings from the resource attributes.
+func readinessConfig(data SSMRemoteTunnelResourceModel) (ReadinessConfig, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	readiness := ReadinessConfig{
+		Probe: data.Probe.ValueBool(),
+	}
+	readiness.Timeout = parseDuration(data.ReadyTimeout, path.Root("ready_timeout"), &diags)
+	readiness.TargetTimeout = parseDuration(data.TargetOnlineTimeout, path.Root("target_online_timeout"), &diags)
+	readiness.TargetPollInterval = parseDuration(data.TargetPollInterval, path.Root("target_poll_interval"), &diags)
+	return readiness, diags
+}
+
+// parseDuration parses the positive duration in value, which is 0 when unset.
+func parseDuration(value types.String, p path.Path, diags *diag.Diagnostics) time.Duration {
+	if value.ValueString() == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(value.ValueString())
+	if err == nil && duration <= 0 {
+		err = fmt.Errorf("%s must be positive", p)
+	}
+	if err != nil {
+		diags.AddAttributeError(
+			p,
+			"Invalid duration",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+	return duration
+}
+
+// validatePort checks the port in value is between 1 and 65535, unless it is
+// unset or unknown.
+func validatePort(value types.Int64, p path.Path, diags *diag.Diagnostics) {
+	if value.IsNull() || value.IsUnknown() {
+		return
+	}
+	if port := value.ValueInt64(); port < 1 || port > 65535 {
+		diags.AddAttributeError(
+			p,
+			"Invalid port",
+			fmt.Sprintf("%s must be between 1 and 65535, got %d", p, port),
+		)
+	}
 }
 
 func (r *RemoteTunnelResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
 	parts := strings.Split(req.ID, "|")
 	// TODO: Decide if we need the local_host set. Also do we need the local_port?
-	if len(parts) != 4 {
+	target, region := "", ""
+	switch len(parts) {
+	case 4:
+	case 6:
+		// The target and region override the provider's
+		target, region = parts[0], parts[5]
+		parts = parts[1:5]
+	default:
 		resp.Diagnostics.AddError(
 			"Invalid import ID",
-			"Import ID must be in the format `remote_host|remote_port|local_port|local_host`",
+			"Import ID must be in the format `remote_host|remote_port|local_port|local_host` or `target|remote_host|remote_port|local_port|local_host|region`",
 		)
 		return
 	}
@@ -288,12 +1004,29 @@ func (r *RemoteTunnelResource) ImportState(ctx context.Context, req resource.Imp
 		return
 	}
 
+	// An empty remote host imports a tunnel to a port on the target itself
+	remoteHostValue := basetypes.NewStringNull()
+	if remoteHost != "" {
+		remoteHostValue = basetypes.NewStringValue(remoteHost)
+	}
+
+	targetValue, regionValue := basetypes.NewStringNull(), basetypes.NewStringNull()
+	if target != "" {
+		targetValue = basetypes.NewStringValue(target)
+	}
+	if region != "" {
+		regionValue = basetypes.NewStringValue(region)
+	}
+
 	resp.State.Set(ctx, &SSMRemoteTunnelResourceModel{
 		// TODO: Figure out if we need to set the ID here
-		Id:         basetypes.NewStringValue(uuid.New().String()),
-		RemoteHost: basetypes.NewStringValue(remoteHost),
-		RemotePort: basetypes.NewInt64Value(int64(remotePortInt)),
-		LocalPort:  basetypes.NewInt64Value(int64(localPortInt)),
-		LocalHost:  basetypes.NewStringValue(localHost),
+		Id:                 basetypes.NewStringValue(uuid.New().String()),
+		Target:             targetValue,
+		Region:             regionValue,
+		RemoteHost:         remoteHostValue,
+		RemotePort:         basetypes.NewInt64Value(int64(remotePortInt)),
+		LocalPort:          basetypes.NewInt64Value(int64(localPortInt)),
+		LocalHost:          basetypes.NewStringValue(localHost),
+		DocumentParameters: basetypes.NewMapNull(types.StringType),
 	})
 }
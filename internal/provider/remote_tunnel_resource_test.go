@@ -0,0 +1,195 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// newRemoteTunnel returns a remote_tunnel resource of a new provider using
+// the stand-in SSM service at endpoint, as each Terraform command starts the
+// provider again.
+func newRemoteTunnel(t *testing.T, endpoint string) (*RemoteTunnelResource, *ProvidedConfigData) {
+	t.Helper()
+	configData, diags := configureProvider(t, testProviderConfig(endpoint))
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	r := &RemoteTunnelResource{}
+	var resp resource.ConfigureResponse
+	r.Configure(context.Background(), resource.ConfigureRequest{ProviderData: configData}, &resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	return r, configData
+}
+
+// remoteTunnelEchoConfig returns the config of a tunnel to echo.
+func remoteTunnelEchoConfig(echo *ssmtunnelstest.EchoServer) SSMRemoteTunnelResourceModel {
+	return SSMRemoteTunnelResourceModel{
+		RefreshId:           types.StringNull(),
+		Target:              types.StringNull(),
+		Targets:             types.ListNull(types.StringType),
+		ResolvedTarget:      types.StringNull(),
+		Region:              types.StringNull(),
+		DocumentName:        types.StringNull(),
+		DocumentParameters:  types.MapNull(types.StringType),
+		RemoteHost:          types.StringValue(echo.Host()),
+		RemotePort:          types.Int64Value(int64(echo.Port())),
+		LocalPort:           types.Int64Null(),
+		LocalHost:           types.StringNull(),
+		ReadyTimeout:        types.StringNull(),
+		TargetOnlineTimeout: types.StringNull(),
+		TargetPollInterval:  types.StringNull(),
+		Probe:               types.BoolNull(),
+		DrainTimeout:        types.StringNull(),
+		Id:                  types.StringNull(),
+	}
+}
+
+// remoteTunnelValue returns data as a value of the resource schema s.
+func remoteTunnelValue(t *testing.T, s schema.Schema, data SSMRemoteTunnelResourceModel) tftypes.Value {
+	t.Helper()
+	ctx := context.Background()
+	state := tfsdk.State{Schema: s, Raw: tftypes.NewValue(s.Type().TerraformType(ctx), nil)}
+	if diags := state.Set(ctx, &data); diags.HasError() {
+		t.Fatal(diags)
+	}
+	return state.Raw
+}
+
+// planRemoteTunnel plans to create r with config, and returns the plan.
+func planRemoteTunnel(t *testing.T, r *RemoteTunnelResource, config SSMRemoteTunnelResourceModel) SSMRemoteTunnelResourceModel {
+	t.Helper()
+	ctx := context.Background()
+	var schemaResp resource.SchemaResponse
+	r.Schema(ctx, resource.SchemaRequest{}, &schemaResp)
+	s := schemaResp.Schema
+
+	// Terraform proposes the config, with the computed attributes unknown
+	proposed := config
+	proposed.ResolvedTarget = types.StringUnknown()
+	proposed.LocalHost = types.StringUnknown()
+	proposed.Id = types.StringUnknown()
+	if proposed.LocalPort.IsNull() {
+		proposed.LocalPort = types.Int64Unknown()
+	}
+	plan := tfsdk.Plan{Schema: s, Raw: remoteTunnelValue(t, s, proposed)}
+
+	resp := &resource.ModifyPlanResponse{Plan: plan}
+	r.ModifyPlan(ctx, resource.ModifyPlanRequest{
+		Config: tfsdk.Config{Schema: s, Raw: remoteTunnelValue(t, s, config)},
+		Plan:   plan,
+		State:  tfsdk.State{Schema: s, Raw: tftypes.NewValue(s.Type().TerraformType(ctx), nil)},
+	}, resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	var planned SSMRemoteTunnelResourceModel
+	if diags := resp.Plan.Get(ctx, &planned); diags.HasError() {
+		t.Fatal(diags)
+	}
+	return planned
+}
+
+// createRemoteTunnel creates r with config as planned, and returns its state.
+func createRemoteTunnel(t *testing.T, r *RemoteTunnelResource, config, planned SSMRemoteTunnelResourceModel) SSMRemoteTunnelResourceModel {
+	t.Helper()
+	ctx := context.Background()
+	var schemaResp resource.SchemaResponse
+	r.Schema(ctx, resource.SchemaRequest{}, &schemaResp)
+	s := schemaResp.Schema
+
+	resp := &resource.CreateResponse{
+		State: tfsdk.State{Schema: s, Raw: tftypes.NewValue(s.Type().TerraformType(ctx), nil)},
+	}
+	r.Create(ctx, resource.CreateRequest{
+		Config: tfsdk.Config{Schema: s, Raw: remoteTunnelValue(t, s, config)},
+		Plan:   tfsdk.Plan{Schema: s, Raw: remoteTunnelValue(t, s, planned)},
+	}, resp)
+	if resp.Diagnostics.HasError() {
+		t.Fatal(resp.Diagnostics)
+	}
+	var state SSMRemoteTunnelResourceModel
+	if diags := resp.State.Get(ctx, &state); diags.HasError() {
+		t.Fatal(diags)
+	}
+	return state
+}
+
+func TestRemoteTunnelPlanOpensTunnel(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+	config := remoteTunnelEchoConfig(echo)
+
+	// The first plan of a workspace without state
+	r, configData := newRemoteTunnel(t, server.URL)
+	planned := planRemoteTunnel(t, r, config)
+	if planned.Id.IsUnknown() || planned.LocalPort.IsUnknown() || planned.LocalHost.IsUnknown() {
+		t.Fatalf("got id %s, local_port %s and local_host %s, want them pinned in the plan", planned.Id, planned.LocalPort, planned.LocalHost)
+	}
+	// The providers using the tunnel reach it while planning
+	roundTrip(t, int(planned.LocalPort.ValueInt64()), "planning")
+	if err := configData.Tracker.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply plans again in a new provider process, which has to pin the
+	// same values
+	r, configData = newRemoteTunnel(t, server.URL)
+	replanned := planRemoteTunnel(t, r, config)
+	if !replanned.Id.Equal(planned.Id) || !replanned.LocalPort.Equal(planned.LocalPort) || !replanned.LocalHost.Equal(planned.LocalHost) {
+		t.Fatalf("got id %s and local_port %s when planning again, want %s and %s", replanned.Id, replanned.LocalPort, planned.Id, planned.LocalPort)
+	}
+
+	state := createRemoteTunnel(t, r, config, replanned)
+	if !state.Id.Equal(planned.Id) || !state.LocalPort.Equal(planned.LocalPort) {
+		t.Errorf("got id %s and local_port %s, want the planned %s and %s", state.Id, state.LocalPort, planned.Id, planned.LocalPort)
+	}
+	roundTrip(t, int(state.LocalPort.ValueInt64()), "applying")
+	// Create uses the tunnel opened while planning again
+	if sessions := server.Sessions(); len(sessions) != 2 {
+		t.Errorf("got %d sessions, want one for each provider process", len(sessions))
+	}
+	if tunnels := configData.Tracker.Tunnels([]string{state.Id.ValueString()}); len(tunnels[state.Id.ValueString()]) != 1 {
+		t.Errorf("got tunnels %v, want the planned one", tunnels)
+	}
+}
+
+func TestRemoteTunnelPlanKeepsConfiguredLocalPort(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	r, _ := newRemoteTunnel(t, server.URL)
+	echo := newEchoServer(t)
+
+	config := remoteTunnelEchoConfig(echo)
+	config.LocalPort = types.Int64Value(int64(openPort(t)))
+	planned := planRemoteTunnel(t, r, config)
+	if !planned.LocalPort.Equal(config.LocalPort) {
+		t.Fatalf("got local_port %s, want the configured %s", planned.LocalPort, config.LocalPort)
+	}
+	roundTrip(t, int(planned.LocalPort.ValueInt64()), "planning")
+}
+
+func TestRemoteTunnelPlanWithUnknownSettings(t *testing.T) {
+	_, server := newTestTracker(t, nil)
+	r, _ := newRemoteTunnel(t, server.URL)
+	echo := newEchoServer(t)
+
+	// The remote host is only known once another resource is created
+	config := remoteTunnelEchoConfig(echo)
+	config.RemoteHost = types.StringUnknown()
+	planned := planRemoteTunnel(t, r, config)
+	if !planned.Id.IsUnknown() || !planned.LocalPort.IsUnknown() {
+		t.Errorf("got id %s and local_port %s, want them unknown until apply", planned.Id, planned.LocalPort)
+	}
+	if sessions := server.Sessions(); len(sessions) != 0 {
+		t.Errorf("got sessions %+v while the tunnel settings are unknown", sessions)
+	}
+}
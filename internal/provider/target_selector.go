@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Descriptions of the target_selector attribute, shared by the provider and
+// the resource schemas.
+const (
+	targetSelectorTagsDescription       = "EC2 tags the instance must have. Values can use the `*` and `?` wildcards"
+	targetSelectorSSMFiltersDescription = "Filters of `ssm:DescribeInstanceInformation` the instance must match, such as `PlatformTypes` or `tag:Name`. Only instances whose agent is online are selected"
+)
+
+var targetSelectorStrategyDescription = fmt.Sprintf("How to pick among the matching instances: `%s`, `%s` or `%s`. Defaults to `%s`. A selected instance is kept as long as it matches",
+	ssmtunnels.TargetStrategyOldest, ssmtunnels.TargetStrategyNewest, ssmtunnels.TargetStrategyRandom, ssmtunnels.TargetStrategyOldest)
+
+// TargetSelectorModel describes the target_selector attribute.
+type TargetSelectorModel struct {
+	Tags       types.Map    `tfsdk:"tags"`
+	SSMFilters types.Map    `tfsdk:"ssm_filters"`
+	Strategy   types.String `tfsdk:"strategy"`
+}
+
+// isKnown reports whether the selector can be resolved during plan.
+func (m *TargetSelectorModel) isKnown() bool {
+	return m != nil && isFullyKnown(m.Tags) && isFullyKnown(m.SSMFilters) && !m.Strategy.IsUnknown()
+}
+
+// selector converts the model, reporting errors on the attribute at p.
+func (m *TargetSelectorModel) selector(ctx context.Context, p path.Path) (*ssmtunnels.TargetSelector, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	selector := &ssmtunnels.TargetSelector{
+		Strategy: m.Strategy.ValueString(),
+	}
+	if !m.Tags.IsNull() && !m.Tags.IsUnknown() {
+		diags.Append(m.Tags.ElementsAs(ctx, &selector.Tags, false)...)
+	}
+	if !m.SSMFilters.IsNull() && !m.SSMFilters.IsUnknown() {
+		diags.Append(m.SSMFilters.ElementsAs(ctx, &selector.Filters, false)...)
+	}
+	if diags.HasError() {
+		return nil, diags
+	}
+
+	if err := selector.Validate(); err != nil {
+		diags.AddAttributeError(
+			p,
+			"Invalid target selector",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return nil, diags
+	}
+	for key := range selector.Tags {
+		if strings.HasPrefix(key, "tag:") {
+			diags.AddAttributeError(
+				p.AtName("tags").AtMapKey(key),
+				"Invalid target selector",
+				"tags are keyed by the tag name, without the tag: prefix",
+			)
+		}
+	}
+	return selector, diags
+}
+
+// isFullyKnown reports whether value and the values nested in it are known.
+func isFullyKnown(value attr.Value) bool {
+	if value.IsUnknown() {
+		return false
+	}
+	switch v := value.(type) {
+	case types.Map:
+		for _, element := range v.Elements() {
+			if !isFullyKnown(element) {
+				return false
+			}
+		}
+	case types.List:
+		for _, element := range v.Elements() {
+			if !isFullyKnown(element) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// countSet returns how many of the mutually exclusive ways to pick a target
+// are set.
+func countSet(set ...bool) int {
+	count := 0
+	for _, ok := range set {
+		if ok {
+			count++
+		}
+	}
+	return count
+}
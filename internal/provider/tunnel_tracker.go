@@ -0,0 +1,916 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ports"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// errTrackerClosed is returned when a tunnel is requested while the provider
+// is shutting down.
+var errTrackerClosed = errors.New("the provider is shutting down")
+
+// errTunnelGone is returned when a tunnel was closed between its lookup and
+// its use, so it has to be looked up again.
+var errTunnelGone = errors.New("the tunnel was closed")
+
+// DefaultReadyTimeout is how long StartTunnel waits for a tunnel to become
+// ready when no timeout is configured.
+const DefaultReadyTimeout = 60 * time.Second
+
+// Tunnels without a local port listen on a port of this range.
+const (
+	localPortRangeLower = 16000
+	localPortRangeUpper = 26000
+)
+
+// DefaultDrainTimeout is how long a tunnel being closed waits for its client
+// connections when no timeout is configured.
+const DefaultDrainTimeout = 10 * time.Second
+
+// ReadinessConfig controls when StartTunnel considers a tunnel to be up.
+type ReadinessConfig struct {
+	// Timeout bounds the wait for the listener, the data channel handshake and the probe.
+	Timeout time.Duration
+	// Probe opens a connection through the tunnel to check the remote port is reachable.
+	Probe bool
+	// TargetTimeout, when set, is how long to wait for the agent of the
+	// target to be online before starting the session.
+	TargetTimeout time.Duration
+	// TargetPollInterval is how often the target is checked while waiting.
+	// Defaults to ssmtunnels.DefaultTargetPollInterval.
+	TargetPollInterval time.Duration
+}
+
+func (r ReadinessConfig) pollInterval() time.Duration {
+	if r.TargetPollInterval == 0 {
+		return ssmtunnels.DefaultTargetPollInterval
+	}
+	return r.TargetPollInterval
+}
+
+// DefaultAutoStartTimeout is how long a stopped target is waited for when no
+// timeout is configured.
+const DefaultAutoStartTimeout = 10 * time.Minute
+
+// AutoStartConfig controls starting stopped EC2 instances targeted by tunnels.
+type AutoStartConfig struct {
+	// Timeout bounds the wait for a started instance to be running and for
+	// its agent to be online.
+	Timeout time.Duration
+	// StopOnShutdown stops the instances the tracker started once the
+	// provider shuts down.
+	StopOnShutdown bool
+}
+
+// DefaultBastionTimeout is how long the ephemeral bastion is waited for when
+// no timeout is configured.
+const DefaultBastionTimeout = 5 * time.Minute
+
+// BastionConfig describes the ephemeral bastion task the tunnels go through.
+type BastionConfig struct {
+	Task   ssmtunnels.BastionTask
+	Region string
+	// Timeout bounds the wait for the task to run with ECS Exec ready.
+	Timeout time.Duration
+}
+
+// TunnelSpec describes the tunnel a resource asks for.
+type TunnelSpec struct {
+	Target string
+	// FailoverTargets are tried in order when Target is not available.
+	FailoverTargets []string
+	Region          string
+	// DocumentName is the Session Manager document starting the session.
+	// When empty, it is picked depending on whether RemoteHost is set.
+	DocumentName string
+	// DocumentParameters are passed to custom documents.
+	DocumentParameters map[string][]string
+	RemoteHost         string
+	RemotePort         int
+	// LocalPort is the port to listen on, or 0 to use any open port.
+	LocalPort int
+	// PreferredLocalPort is where the search for an open port starts when
+	// LocalPort is 0, instead of a random port of the range.
+	PreferredLocalPort int
+}
+
+func (s TunnelSpec) key() tunnelKey {
+	return tunnelKey{
+		Target:          s.Target,
+		FailoverTargets: fmt.Sprint(s.FailoverTargets),
+		Region:          s.Region,
+		DocumentName:    s.DocumentName,
+		// fmt prints maps sorted by key
+		DocumentParameters: fmt.Sprint(s.DocumentParameters),
+		RemoteHost:         s.RemoteHost,
+		RemotePort:         s.RemotePort,
+		LocalPort:          s.LocalPort,
+	}
+}
+
+// remoteTunnelConfig returns the config starting the tunnel, without a client.
+func (s TunnelSpec) remoteTunnelConfig() ssmtunnels.RemoteTunnelConfig {
+	return ssmtunnels.RemoteTunnelConfig{
+		Target:             s.Target,
+		FailoverTargets:    s.FailoverTargets,
+		Region:             s.Region,
+		DocumentName:       s.DocumentName,
+		DocumentParameters: s.DocumentParameters,
+		RemoteHost:         s.RemoteHost,
+		RemotePort:         s.RemotePort,
+		LocalPort:          s.LocalPort,
+	}
+}
+
+type OtherTunnelInfo struct {
+	LocalPort int
+	LocalHost string
+	Tunnel    *ssmtunnels.Tunnel
+}
+
+// tunnelKey identifies tunnels forwarding the same remote host and port
+// through the same targets. A LocalPort of 0 matches any local port.
+type tunnelKey struct {
+	Target             string
+	FailoverTargets    string
+	Region             string
+	DocumentName       string
+	DocumentParameters string
+	RemoteHost         string
+	RemotePort         int
+	LocalPort          int
+}
+
+// trackedTunnel is a tunnel in the tracker's registry, along with the IDs of
+// the resources using it.
+type trackedTunnel struct {
+	key   tunnelKey
+	spec  TunnelSpec
+	users map[string]struct{}
+
+	// started is closed once starting the tunnel finished. info and err are
+	// only set before that.
+	started chan struct{}
+	info    *OtherTunnelInfo
+	err     error
+
+	// waiters counts the StartTunnel calls waiting for the tunnel to start,
+	// guarded by the tracker's mu.
+	waiters int
+	// cancelStart cancels starting the tunnel, once every waiter gave up.
+	cancelStart context.CancelFunc
+	// broken is set once the tunnel failed a probe while other resources
+	// still used it. It is not reused, and is closed once they moved to a
+	// new tunnel. Guarded by the tracker's mu.
+	broken bool
+}
+
+func (e *trackedTunnel) isStarted() bool {
+	select {
+	case <-e.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// localPort returns the requested local port, or the bound one once the
+// tunnel started. It returns 0 while an OS-chosen port is not known yet.
+func (e *trackedTunnel) localPort() int {
+	if e.key.LocalPort != 0 {
+		return e.key.LocalPort
+	}
+	if e.isStarted() && e.info != nil {
+		return e.info.LocalPort
+	}
+	return 0
+}
+
+func (e *trackedTunnel) matches(key tunnelKey) bool {
+	ignoringLocalPort := e.key
+	ignoringLocalPort.LocalPort = key.LocalPort
+	if ignoringLocalPort != key {
+		return false
+	}
+	return key.LocalPort == 0 || e.localPort() == key.LocalPort
+}
+
+// isDead reports whether the tunnel started and has stopped since.
+func (e *trackedTunnel) isDead() bool {
+	if !e.isStarted() || e.info == nil {
+		return false
+	}
+	select {
+	case <-e.info.Tunnel.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// TunnelTracker is the registry of tunnels opened by the provider. Identical
+// tunnel requests share one tunnel, which is closed once no resource uses it.
+// It is safe for concurrent use, as Terraform calls resources in parallel.
+type TunnelTracker struct {
+	newClient    func(region string) ssmtunnels.SSMClient
+	newEC2Client func(region string) ssmtunnels.EC2Client
+	newECSClient func(region string) ssmtunnels.ECSClient
+	newKMSClient func(region string) ssmtunnels.KMSClient
+
+	// ctx is canceled on shutdown, which stops the tunnels being started.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	clients    map[string]ssmtunnels.SSMClient
+	ec2Clients map[string]ssmtunnels.EC2Client
+	ecsClients map[string]ssmtunnels.ECSClient
+	kmsClients map[string]ssmtunnels.KMSClient
+	tunnels    []*trackedTunnel
+	closed     bool
+	// ports reserves the local ports of the tunnels.
+	ports *ports.Allocator
+
+	autoStart *AutoStartConfig
+	// startedInstances are the instances the tracker started, by region.
+	startedInstances map[string][]string
+
+	bastion *BastionConfig
+	// bastionMu serializes launching the bastion, which is only done once.
+	bastionMu sync.Mutex
+	// bastionTask is the ARN of the launched bastion task, guarded by mu.
+	bastionTask string
+	// bastionTarget is set once the bastion is ready, guarded by bastionMu.
+	bastionTarget string
+}
+
+// NewTunnelTracker returns a tracker creating SSM, EC2, ECS and KMS clients
+// for each region with newClient, newEC2Client, newECSClient and newKMSClient.
+func NewTunnelTracker(newClient func(region string) ssmtunnels.SSMClient, newEC2Client func(region string) ssmtunnels.EC2Client, newECSClient func(region string) ssmtunnels.ECSClient, newKMSClient func(region string) ssmtunnels.KMSClient) (*TunnelTracker, error) {
+	allocator, err := ports.NewAllocator(localPortRangeLower, localPortRangeUpper)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port allocator: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TunnelTracker{
+		newClient:    newClient,
+		newEC2Client: newEC2Client,
+		newECSClient: newECSClient,
+		newKMSClient: newKMSClient,
+		ctx:          ctx,
+		cancel:       cancel,
+		clients:      make(map[string]ssmtunnels.SSMClient),
+		ec2Clients:   make(map[string]ssmtunnels.EC2Client),
+		ecsClients:   make(map[string]ssmtunnels.ECSClient),
+		kmsClients:   make(map[string]ssmtunnels.KMSClient),
+		ports:        allocator,
+	}, nil
+}
+
+// SetAutoStart makes the tracker start the stopped EC2 instance a tunnel
+// targets before opening it. It must be called before any tunnel is started.
+func (t *TunnelTracker) SetAutoStart(config AutoStartConfig) {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultAutoStartTimeout
+	}
+	t.autoStart = &config
+	t.startedInstances = make(map[string][]string)
+}
+
+// Client returns the SSM client for region, creating it on first use.
+func (t *TunnelTracker) Client(region string) ssmtunnels.SSMClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, ok := t.clients[region]
+	if !ok {
+		client = t.newClient(region)
+		t.clients[region] = client
+	}
+	return client
+}
+
+// EC2Client returns the EC2 client for region, creating it on first use.
+func (t *TunnelTracker) EC2Client(region string) ssmtunnels.EC2Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, ok := t.ec2Clients[region]
+	if !ok {
+		client = t.newEC2Client(region)
+		t.ec2Clients[region] = client
+	}
+	return client
+}
+
+// ECSClient returns the ECS client for region, creating it on first use.
+func (t *TunnelTracker) ECSClient(region string) ssmtunnels.ECSClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, ok := t.ecsClients[region]
+	if !ok {
+		client = t.newECSClient(region)
+		t.ecsClients[region] = client
+	}
+	return client
+}
+
+// KMSClient returns the KMS client for region, creating it on first use.
+func (t *TunnelTracker) KMSClient(region string) ssmtunnels.KMSClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, ok := t.kmsClients[region]
+	if !ok {
+		client = t.newKMSClient(region)
+		t.kmsClients[region] = client
+	}
+	return client
+}
+
+// SetBastion makes the tracker launch an ephemeral bastion task the first time
+// Bastion is called, and stop it on shutdown. It must be called before any
+// tunnel is started.
+func (t *TunnelTracker) SetBastion(config BastionConfig) {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultBastionTimeout
+	}
+	t.bastion = &config
+}
+
+// HasBastion reports whether tunnels go through an ephemeral bastion.
+func (t *TunnelTracker) HasBastion() bool {
+	return t.bastion != nil
+}
+
+// Bastion returns the SSM target of the ephemeral bastion, launching it and
+// waiting for it to be ready on first use. A bastion that failed to get ready
+// is stopped, and launched again by the next call.
+func (t *TunnelTracker) Bastion(ctx context.Context, interval time.Duration) (string, error) {
+	t.bastionMu.Lock()
+	defer t.bastionMu.Unlock()
+	if t.bastionTarget != "" {
+		return t.bastionTarget, nil
+	}
+
+	client := t.ECSClient(t.bastion.Region)
+	taskArn, err := t.bastion.Task.Launch(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	closed := t.closed
+	if !closed {
+		// Recorded right away, so Shutdown stops it even while it starts
+		t.bastionTask = taskArn
+	}
+	t.mu.Unlock()
+	if closed {
+		return "", errors.Join(errTrackerClosed, t.bastion.Task.Stop(context.WithoutCancel(ctx), client, taskArn))
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, t.bastion.Timeout)
+	defer cancel()
+	target, err := t.bastion.Task.WaitTarget(waitCtx, client, taskArn, interval)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("bastion task was not ready after %s", t.bastion.Timeout)
+		}
+		t.mu.Lock()
+		t.bastionTask = ""
+		t.mu.Unlock()
+		return "", errors.Join(err, t.bastion.Task.Stop(context.WithoutCancel(ctx), client, taskArn))
+	}
+	t.bastionTarget = target
+	return target, nil
+}
+
+// ResolveTarget picks the instance selector selects in region, keeping
+// current while it still matches. With a readiness TargetTimeout, it waits for
+// a matching instance to come online.
+func (t *TunnelTracker) ResolveTarget(ctx context.Context, region string, selector ssmtunnels.TargetSelector, current string, readiness ReadinessConfig) (string, error) {
+	if readiness.TargetTimeout == 0 {
+		return selector.Resolve(ctx, t.Client(region), t.EC2Client(region), current)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, readiness.TargetTimeout)
+	defer cancel()
+	target, err := selector.WaitResolve(waitCtx, t.Client(region), t.EC2Client(region), current, readiness.pollInterval())
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("no instance matching the target selector was online after %s", readiness.TargetTimeout)
+	}
+	return target, err
+}
+
+// ResolveECSTarget picks the container ecsTarget designates in region, keeping
+// current while its task is running. With a readiness TargetTimeout, it waits
+// for a matching task to run.
+func (t *TunnelTracker) ResolveECSTarget(ctx context.Context, region string, ecsTarget ssmtunnels.ECSTarget, current string, readiness ReadinessConfig) (string, error) {
+	if readiness.TargetTimeout == 0 {
+		return ecsTarget.Resolve(ctx, t.ECSClient(region), current)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, readiness.TargetTimeout)
+	defer cancel()
+	target, err := ecsTarget.WaitResolve(waitCtx, t.ECSClient(region), current, readiness.pollInterval())
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("no task matching the ECS target was running after %s", readiness.TargetTimeout)
+	}
+	return target, err
+}
+
+// StartTunnel returns a ready tunnel matching spec, registering id as one of
+// its users. A live tunnel that matches is reused; concurrent calls for the
+// same tunnel wait for a single start. A LocalPort of 0 reuses a tunnel on any
+// local port, or picks an open one.
+func (t *TunnelTracker) StartTunnel(ctx context.Context, id string, spec TunnelSpec, readiness ReadinessConfig) (*OtherTunnelInfo, error) {
+	key := spec.key()
+	for {
+		entry, err := t.join(ctx, key, spec, readiness)
+		if err != nil {
+			return nil, err
+		}
+		info, err := t.use(ctx, id, entry)
+		if errors.Is(err, errTunnelGone) {
+			continue
+		}
+		return info, err
+	}
+}
+
+// join returns the tracked tunnel matching key, counting the caller as one of
+// its waiters. When none matches, a new one is started in the background.
+func (t *TunnelTracker) join(ctx context.Context, key tunnelKey, spec TunnelSpec, readiness ReadinessConfig) (*trackedTunnel, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, errTrackerClosed
+	}
+	if entry := t.lookup(key); entry != nil {
+		entry.waiters++
+		return entry, nil
+	}
+
+	// The start is shared by every waiter, so it is not canceled with the
+	// caller's ctx, but on shutdown or once every waiter gave up. It keeps
+	// ctx's values so it is logged through the provider logger.
+	startCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(t.ctx, cancel)
+	entry := &trackedTunnel{
+		key:         key,
+		spec:        spec,
+		users:       make(map[string]struct{}),
+		started:     make(chan struct{}),
+		waiters:     1,
+		cancelStart: cancel,
+	}
+	t.tunnels = append(t.tunnels, entry)
+	go func() {
+		defer stop()
+		defer cancel()
+		t.start(startCtx, entry, readiness)
+	}()
+	return entry, nil
+}
+
+// use waits for entry to start, and registers id as one of its users. It
+// returns errTunnelGone when the tunnel was closed since it started, by a
+// release or a failed probe of its last user.
+func (t *TunnelTracker) use(ctx context.Context, id string, entry *trackedTunnel) (*OtherTunnelInfo, error) {
+	select {
+	case <-entry.started:
+	case <-ctx.Done():
+		t.abandon(entry)
+		return nil, ctx.Err()
+	}
+
+	t.mu.Lock()
+	entry.waiters--
+	if entry.err != nil {
+		t.mu.Unlock()
+		return nil, entry.err
+	}
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errTrackerClosed
+	}
+	if !slices.Contains(t.tunnels, entry) || entry.broken || entry.isDead() {
+		t.mu.Unlock()
+		return nil, errTunnelGone
+	}
+	entry.users[id] = struct{}{}
+	broken := t.detach(id, entry)
+	t.mu.Unlock()
+
+	for _, previous := range broken {
+		previous.info.Tunnel.Close()
+	}
+
+	return entry.info, nil
+}
+
+// abandon stops waiting for entry to start. The last waiter giving up cancels
+// the start, or closes the tunnel if it started without any users, so it does
+// not linger.
+func (t *TunnelTracker) abandon(entry *trackedTunnel) {
+	t.mu.Lock()
+	entry.waiters--
+	var unused bool
+	if entry.waiters == 0 && len(entry.users) == 0 && slices.Contains(t.tunnels, entry) {
+		switch {
+		case !entry.isStarted():
+			t.remove(entry)
+			entry.cancelStart()
+		case entry.err == nil:
+			t.remove(entry)
+			unused = true
+		}
+	}
+	t.mu.Unlock()
+
+	if unused {
+		entry.info.Tunnel.Close()
+	}
+}
+
+// detach removes id from the users of the broken tunnels other than current,
+// and returns the ones left without users, which the caller must close. Must
+// be called with t.mu held.
+func (t *TunnelTracker) detach(id string, current *trackedTunnel) []*trackedTunnel {
+	var unused []*trackedTunnel
+	for _, entry := range t.tunnels {
+		if _, ok := entry.users[id]; !ok || entry == current || !entry.broken {
+			continue
+		}
+		delete(entry.users, id)
+		if len(entry.users) == 0 {
+			unused = append(unused, entry)
+		}
+	}
+	for _, entry := range unused {
+		t.remove(entry)
+	}
+	return unused
+}
+
+// Release removes id from the users of its tunnels, and closes the tunnels
+// that are left without users once their client connections are done,
+// waiting at most drainTimeout for them.
+func (t *TunnelTracker) Release(ctx context.Context, id string, drainTimeout time.Duration) error {
+	return t.release(ctx, id, nil, drainTimeout)
+}
+
+// ReleaseOthers is Release for the tunnels of id that do not match spec, for
+// when the settings of the tunnel changed.
+func (t *TunnelTracker) ReleaseOthers(ctx context.Context, id string, spec TunnelSpec, drainTimeout time.Duration) error {
+	key := spec.key()
+	return t.release(ctx, id, func(entry *trackedTunnel) bool {
+		return entry.matches(key)
+	}, drainTimeout)
+}
+
+// release removes id from the users of the tunnels keep does not match.
+func (t *TunnelTracker) release(ctx context.Context, id string, keep func(*trackedTunnel) bool, drainTimeout time.Duration) error {
+	var unused []*trackedTunnel
+
+	t.mu.Lock()
+	for _, entry := range t.tunnels {
+		if _, ok := entry.users[id]; !ok || (keep != nil && keep(entry)) {
+			continue
+		}
+		delete(entry.users, id)
+		if len(entry.users) == 0 {
+			unused = append(unused, entry)
+		}
+	}
+	for _, entry := range unused {
+		t.remove(entry)
+	}
+	t.mu.Unlock()
+
+	// Connections still open after drainTimeout are dropped
+	drainCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+	var err error
+	for _, entry := range unused {
+		_ = entry.info.Tunnel.Drain(drainCtx)
+		err = errors.Join(err, entry.info.Tunnel.Close())
+	}
+	return err
+}
+
+// LiveTunnel returns the tunnel id uses if it is still running. With
+// readiness.Probe, the remote port is checked to be reachable through it. A
+// tunnel failing the check is closed when id is its only user, and is marked
+// broken otherwise, so the next StartTunnel of each user reopens it.
+func (t *TunnelTracker) LiveTunnel(ctx context.Context, id string, readiness ReadinessConfig) (*OtherTunnelInfo, bool) {
+	var current *trackedTunnel
+	t.mu.Lock()
+	// The tunnel id was registered with last is the current one
+	for _, entry := range slices.Backward(t.tunnels) {
+		if _, ok := entry.users[id]; ok && entry.isStarted() && entry.info != nil && !entry.isDead() && !entry.broken {
+			current = entry
+			break
+		}
+	}
+	t.mu.Unlock()
+	if current == nil {
+		return nil, false
+	}
+	info := current.info
+
+	if readiness.Probe {
+		timeout := readiness.Timeout
+		if timeout == 0 {
+			timeout = DefaultReadyTimeout
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := info.Tunnel.Probe(probeCtx); err != nil {
+			tflog.Warn(ctx, "Tunnel failed the probe, reopening it", map[string]interface{}{
+				"id":    id,
+				"error": err.Error(),
+			})
+			t.mu.Lock()
+			_, used := current.users[id]
+			last := used && len(current.users) == 1
+			if last {
+				t.remove(current)
+			} else {
+				current.broken = true
+			}
+			t.mu.Unlock()
+			if last {
+				info.Tunnel.Close()
+			}
+			return nil, false
+		}
+	}
+	return info, true
+}
+
+// Tunnels returns the running tunnels used by each of ids, or by every user
+// when ids is empty. IDs without a running tunnel are left out.
+func (t *TunnelTracker) Tunnels(ids []string) map[string][]*ssmtunnels.Tunnel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tunnels := make(map[string][]*ssmtunnels.Tunnel)
+	for _, entry := range t.tunnels {
+		if !entry.isStarted() || entry.info == nil || entry.isDead() {
+			continue
+		}
+		for id := range entry.users {
+			if len(ids) == 0 || slices.Contains(ids, id) {
+				tunnels[id] = append(tunnels[id], entry.info.Tunnel)
+			}
+		}
+	}
+	return tunnels
+}
+
+// Shutdown closes every tunnel and terminates their sessions, while it stops
+// the ephemeral bastion, and the instances it started when auto start is
+// configured to. It waits for every session to be terminated, which tunnels
+// bound by themselves, and at most gracePeriod for the stops. No tunnels can
+// be started afterwards.
+func (t *TunnelTracker) Shutdown(gracePeriod time.Duration) error {
+	t.mu.Lock()
+	t.closed = true
+	var running []*ssmtunnels.Tunnel
+	for _, entry := range t.tunnels {
+		if entry.isStarted() && entry.info != nil {
+			running = append(running, entry.info.Tunnel)
+		}
+	}
+	t.tunnels = nil
+	var started map[string][]string
+	if t.autoStart != nil && t.autoStart.StopOnShutdown {
+		started = t.startedInstances
+	}
+	t.startedInstances = nil
+	bastionTask := t.bastionTask
+	t.bastionTask = ""
+	t.mu.Unlock()
+	// Tunnels still starting are stopped, and report the tracker closed
+	t.cancel()
+
+	// Nothing waits for the sessions to be terminated before stopping their
+	// targets, so the plugin exits as soon as possible
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	var wg sync.WaitGroup
+	var closeErr, stopErr error
+	wg.Go(func() {
+		closeErr = closeTunnels(running)
+	})
+	wg.Go(func() {
+		stopErr = t.stop(ctx, started, bastionTask)
+	})
+	wg.Wait()
+	return errors.Join(closeErr, stopErr)
+}
+
+// stop stops instances, by region, and the bastion task when set,
+// concurrently.
+func (t *TunnelTracker) stop(ctx context.Context, instances map[string][]string, bastionTask string) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(instances)+1)
+	for region, ids := range instances {
+		wg.Go(func() {
+			errs <- ssmtunnels.StopTargets(ctx, t.EC2Client(region), ids)
+		})
+	}
+	if bastionTask != "" {
+		wg.Go(func() {
+			errs <- t.bastion.Task.Stop(ctx, t.ECSClient(t.bastion.Region), bastionTask)
+		})
+	}
+	wg.Wait()
+	close(errs)
+
+	var err error
+	for stopErr := range errs {
+		err = errors.Join(err, stopErr)
+	}
+	return err
+}
+
+// closeTunnels closes tunnels concurrently, and waits for their sessions to
+// be terminated.
+func closeTunnels(running []*ssmtunnels.Tunnel) error {
+	errs := make([]error, len(running))
+	var wg sync.WaitGroup
+	for i, tunnel := range running {
+		wg.Go(func() {
+			errs[i] = tunnel.Close()
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// lookup returns the live tunnel matching key, dropping dead ones it comes
+// across. Broken tunnels are skipped. Must be called with t.mu held.
+func (t *TunnelTracker) lookup(key tunnelKey) *trackedTunnel {
+	for _, entry := range slices.Clone(t.tunnels) {
+		if !entry.matches(key) || entry.broken {
+			continue
+		}
+		if entry.isDead() {
+			t.remove(entry)
+			continue
+		}
+		return entry
+	}
+	return nil
+}
+
+// remove drops entry from the registry. Must be called with t.mu held.
+func (t *TunnelTracker) remove(entry *trackedTunnel) {
+	t.tunnels = slices.DeleteFunc(t.tunnels, func(e *trackedTunnel) bool {
+		return e == entry
+	})
+}
+
+// start opens the tunnel for entry and waits for it to be ready. The outcome
+// is published to concurrent callers by closing entry.started.
+func (t *TunnelTracker) start(ctx context.Context, entry *trackedTunnel, readiness ReadinessConfig) {
+	info, err := t.open(ctx, entry.spec, readiness)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer close(entry.started)
+
+	switch {
+	case t.closed:
+		// Shutdown ran while the tunnel was starting and could not see it.
+		if err == nil {
+			go info.Tunnel.Close()
+		}
+		info, err = nil, errTrackerClosed
+	case err == nil && !slices.Contains(t.tunnels, entry):
+		// Every waiter gave up as the tunnel was ready.
+		go info.Tunnel.Close()
+		info, err = nil, context.Canceled
+	}
+	entry.info = info
+	entry.err = err
+	if err != nil {
+		t.remove(entry)
+	}
+}
+
+func (t *TunnelTracker) open(ctx context.Context, spec TunnelSpec, readiness ReadinessConfig) (*OtherTunnelInfo, error) {
+	if t.autoStart != nil && ssmtunnels.IsEC2Instance(spec.Target) {
+		if err := t.startTarget(ctx, spec.Region, spec.Target, readiness.pollInterval()); err != nil {
+			return nil, err
+		}
+	}
+
+	// ECS tasks are not managed instances, and are waited for when resolved
+	targets := slices.DeleteFunc(append([]string{spec.Target}, spec.FailoverTargets...), ssmtunnels.IsECSTask)
+	if readiness.TargetTimeout > 0 && len(targets) > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, readiness.TargetTimeout)
+		err := ssmtunnels.WaitForTarget(waitCtx, t.Client(spec.Region), targets, readiness.pollInterval())
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("target was not online after %s", readiness.TargetTimeout)
+			}
+			return nil, err
+		}
+	}
+
+	// The listener is handed to the tunnel, so the port can not be taken
+	// before the tunnel listens on it
+	var listener net.Listener
+	var err error
+	if spec.LocalPort == 0 && spec.PreferredLocalPort != 0 {
+		listener, err = t.ports.ListenFrom(spec.PreferredLocalPort)
+	} else {
+		listener, err = t.ports.Listen(spec.LocalPort)
+	}
+	if err != nil {
+		if spec.LocalPort == 0 {
+			return nil, fmt.Errorf("failed to find open port: %w", err)
+		}
+		return nil, fmt.Errorf("failed to listen on port %d: %w", spec.LocalPort, err)
+	}
+
+	// The tunnel has to outlive the request that started it, so it is not
+	// canceled with ctx. It keeps ctx's values so its reconnects are logged
+	// through the provider logger. Closing the tunnel terminates its session.
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("unexpected listener address %s", listener.Addr())
+	}
+	cfg := spec.remoteTunnelConfig()
+	cfg.Client = t.Client(spec.Region)
+	cfg.KMSClient = t.KMSClient(spec.Region)
+	cfg.LocalPort = addr.Port
+	cfg.Listener = listener
+	tunnel, err := ssmtunnels.StartRemoteTunnel(context.WithoutCancel(ctx), cfg)
+	if err != nil {
+		tflog.Error(ctx, "Error starting tunnel", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return nil, err
+	}
+
+	info := &OtherTunnelInfo{
+		LocalPort: tunnel.LocalPort(),
+		LocalHost: "127.0.0.1",
+		Tunnel:    tunnel,
+	}
+
+	timeout := readiness.Timeout
+	if timeout == 0 {
+		timeout = DefaultReadyTimeout
+	}
+	readyCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = tunnel.WaitReady(readyCtx)
+	if err == nil && readiness.Probe {
+		err = tunnel.Probe(readyCtx)
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("tunnel was not ready after %s", timeout)
+		}
+		tflog.Error(ctx, "Error starting tunnel", map[string]interface{}{
+			"error": err.Error(),
+		})
+		tunnel.Close()
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// startTarget starts the instance target when it is stopped, and waits for it
+// to be online. Instances it started are recorded to be stopped on shutdown.
+func (t *TunnelTracker) startTarget(ctx context.Context, region, target string, interval time.Duration) error {
+	startCtx, cancel := context.WithTimeout(ctx, t.autoStart.Timeout)
+	defer cancel()
+	started, err := ssmtunnels.StartTarget(startCtx, t.EC2Client(region), t.Client(region), target, interval)
+	if started {
+		t.mu.Lock()
+		if t.startedInstances != nil && !slices.Contains(t.startedInstances[region], target) {
+			t.startedInstances[region] = append(t.startedInstances[region], target)
+		}
+		t.mu.Unlock()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("target was not started after %s", t.autoStart.Timeout)
+	}
+	return err
+}
@@ -0,0 +1,914 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+)
+
+const testTarget = "i-0123456789abcdef0"
+
+// newTestTracker returns a tracker whose clients talk to a stand-in SSM
+// service backed by fleet, which may be nil. The tracker is shut down when
+// the test ends.
+func newTestTracker(t *testing.T, fleet *ssmtunnelstest.Fleet) (*TunnelTracker, *ssmtunnelstest.Server) {
+	t.Helper()
+	server := ssmtunnelstest.NewServer()
+	server.Fleet = fleet
+	server.Logf = t.Logf
+	t.Cleanup(server.Close)
+
+	tracker, err := NewTunnelTracker(func(region string) ssmtunnels.SSMClient {
+		return server.Client()
+	}, func(region string) ssmtunnels.EC2Client {
+		return fleet
+	}, func(region string) ssmtunnels.ECSClient {
+		return server.ECSClient()
+	}, func(region string) ssmtunnels.KMSClient {
+		return server.KMSClient()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = tracker.Shutdown(5 * time.Second)
+	})
+	return tracker, server
+}
+
+// newEchoServer starts an echo server closed when the test ends.
+func newEchoServer(t *testing.T) *ssmtunnelstest.EchoServer {
+	t.Helper()
+	echo, err := ssmtunnelstest.NewEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = echo.Close()
+	})
+	return echo
+}
+
+// echoSpec returns the spec of a tunnel to echo through the test target.
+func echoSpec(echo *ssmtunnelstest.EchoServer) TunnelSpec {
+	return TunnelSpec{
+		Target:     testTarget,
+		Region:     "us-east-1",
+		RemoteHost: echo.Host(),
+		RemotePort: echo.Port(),
+	}
+}
+
+// roundTrip sends message through the local port of a tunnel and checks it
+// is echoed back.
+func roundTrip(t *testing.T, port int, message string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != message {
+		t.Errorf("got %q back, want %q", reply, message)
+	}
+}
+
+// isClosed reports whether tunnel stopped.
+func isClosed(tunnel *ssmtunnels.Tunnel) bool {
+	select {
+	case <-tunnel.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestStartTunnelForwards(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{Probe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LocalPort < localPortRangeLower || info.LocalPort > localPortRangeUpper {
+		t.Errorf("local port %d is outside of the tracker's range", info.LocalPort)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+}
+
+func TestStartTunnelEncryptedWithKMS(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	server.KMSKeyID = "alias/session-manager"
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+	if keys := server.DataKeys(); len(keys) != 1 {
+		t.Errorf("got %d data keys, want the tunnel's client to generate one", len(keys))
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{
+		ID:         testTarget,
+		Tags:       map[string]string{"Role": "bastion"},
+		PingStatus: "ConnectionLost",
+	})
+	tracker, _ := newTestTracker(t, fleet)
+	selector := ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}}
+
+	if _, err := tracker.ResolveTarget(t.Context(), "us-east-1", selector, "", ReadinessConfig{}); !errors.Is(err, ssmtunnels.ErrNoTarget) {
+		t.Errorf("got %v, want ErrNoTarget without a target timeout", err)
+	}
+	readiness := ReadinessConfig{TargetTimeout: 100 * time.Millisecond, TargetPollInterval: 20 * time.Millisecond}
+	if _, err := tracker.ResolveTarget(t.Context(), "us-east-1", selector, "", readiness); err == nil {
+		t.Error("resolved a target that is not online")
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		fleet.SetPingStatus(testTarget, "Online")
+	})
+	readiness.TargetTimeout = 10 * time.Second
+	target, err := tracker.ResolveTarget(t.Context(), "us-east-1", selector, "", readiness)
+	if err != nil || target != testTarget {
+		t.Errorf("got target %q and error %v, want the instance once online", target, err)
+	}
+}
+
+func TestStartTunnelFailsOver(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(
+		ssmtunnelstest.Instance{ID: testTarget, PingStatus: "ConnectionLost"},
+		ssmtunnelstest.Instance{ID: "i-0fedcba9876543210"},
+	)
+	tracker, _ := newTestTracker(t, fleet)
+	echo := newEchoServer(t)
+
+	spec := echoSpec(echo)
+	spec.FailoverTargets = []string{"i-0fedcba9876543210"}
+	info, err := tracker.StartTunnel(t.Context(), "a", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+	if info.Tunnel.Target() != "i-0fedcba9876543210" {
+		t.Errorf("tunnel runs on %s, want the failover target", info.Tunnel.Target())
+	}
+}
+
+func TestStartTunnelWaitsForTarget(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, PingStatus: "ConnectionLost"})
+	tracker, server := newTestTracker(t, fleet)
+	echo := newEchoServer(t)
+	readiness := ReadinessConfig{TargetTimeout: 10 * time.Second, TargetPollInterval: 20 * time.Millisecond}
+
+	time.AfterFunc(200*time.Millisecond, func() {
+		fleet.SetPingStatus(testTarget, "Online")
+	})
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), readiness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+	if sessions := server.Sessions(); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want a single one once the target is online", len(sessions))
+	}
+}
+
+func TestStartTunnelTargetTimeout(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, PingStatus: "ConnectionLost"})
+	tracker, server := newTestTracker(t, fleet)
+	echo := newEchoServer(t)
+	readiness := ReadinessConfig{TargetTimeout: 100 * time.Millisecond, TargetPollInterval: 20 * time.Millisecond}
+
+	_, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), readiness)
+	if err == nil || !strings.Contains(err.Error(), "not online after 100ms") {
+		t.Fatalf("got %v, want the target timeout to be reported", err)
+	}
+	if sessions := server.Sessions(); len(sessions) != 0 {
+		t.Errorf("got %d sessions, want none on an offline target", len(sessions))
+	}
+}
+
+func TestResolveECSTarget(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet()
+	tracker, _ := newTestTracker(t, fleet)
+	ecsTarget := ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "shell"}
+
+	if _, err := tracker.ResolveECSTarget(t.Context(), "us-east-1", ecsTarget, "", ReadinessConfig{}); !errors.Is(err, ssmtunnels.ErrNoECSTask) {
+		t.Errorf("got %v, want ErrNoECSTask without a target timeout", err)
+	}
+
+	task := ssmtunnelstest.Task{Cluster: "apps", ID: "0123456789abcdef", Service: "bastion", Containers: map[string]string{"shell": "0123456789abcdef-1"}}
+	time.AfterFunc(100*time.Millisecond, func() {
+		fleet.AddTask(task)
+	})
+	readiness := ReadinessConfig{TargetTimeout: 10 * time.Second, TargetPollInterval: 20 * time.Millisecond}
+	target, err := tracker.ResolveECSTarget(t.Context(), "us-east-1", ecsTarget, "", readiness)
+	if err != nil || target != task.Target("shell") {
+		t.Fatalf("got target %q and error %v, want the task once running", target, err)
+	}
+
+	echo := newEchoServer(t)
+	spec := echoSpec(echo)
+	spec.Target = target
+	info, err := tracker.StartTunnel(t.Context(), "a", spec, readiness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+}
+
+func TestStartTunnelStartsOnceConcurrently(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	const count = 8
+	var wg sync.WaitGroup
+	infos := make([]*OtherTunnelInfo, count)
+	errs := make([]error, count)
+	for i := range count {
+		wg.Go(func() {
+			infos[i], errs[i] = tracker.StartTunnel(t.Context(), fmt.Sprint(i), echoSpec(echo), ReadinessConfig{})
+		})
+	}
+	wg.Wait()
+
+	for i := range count {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if infos[i] != infos[0] {
+			t.Errorf("call %d got another tunnel", i)
+		}
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(sessions))
+	}
+	if tunnels := tracker.Tunnels(nil); len(tunnels) != count {
+		t.Errorf("got %d users, want %d", len(tunnels), count)
+	}
+}
+
+func TestStartTunnelSeparatesLocalPorts(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	first, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := echoSpec(echo)
+	spec.LocalPort = first.LocalPort
+	same, err := tracker.StartTunnel(t.Context(), "b", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != first {
+		t.Error("the tunnel on the requested port was not reused")
+	}
+
+	spec.RemotePort++
+	if _, err := tracker.StartTunnel(t.Context(), "c", spec, ReadinessConfig{}); err == nil {
+		t.Error("another tunnel was started on a port in use")
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(sessions))
+	}
+}
+
+func TestReleaseClosesUnusedTunnels(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.StartTunnel(t.Context(), "b", echoSpec(echo), ReadinessConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tracker.Release(t.Context(), "a", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if isClosed(info.Tunnel) {
+		t.Fatal("tunnel was closed while still used")
+	}
+	roundTrip(t, info.LocalPort, "still open")
+
+	if err := tracker.Release(t.Context(), "b", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(info.Tunnel) {
+		t.Error("unused tunnel was not closed")
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were not terminated", active)
+	}
+}
+
+func TestReleaseDrainsConnections(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(info.LocalPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connection is forwarded once it carried data
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(300*time.Millisecond, func() {
+		conn.Close()
+	})
+
+	start := time.Now()
+	if err := tracker.Release(t.Context(), "a", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("release returned after %s, before the connection closed", elapsed)
+	}
+	if !isClosed(info.Tunnel) {
+		t.Error("tunnel was not closed")
+	}
+}
+
+func TestStartTunnelWaiterGivingUp(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, PingStatus: "ConnectionLost"})
+	tracker, _ := newTestTracker(t, fleet)
+	echo := newEchoServer(t)
+	readiness := ReadinessConfig{TargetTimeout: 10 * time.Second, TargetPollInterval: 50 * time.Millisecond}
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), readiness)
+		started <- err
+	}()
+	waitFor(t, func() bool {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		return len(tracker.tunnels) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := tracker.StartTunnel(ctx, "b", echoSpec(echo), readiness); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to be exceeded", err)
+	}
+
+	fleet.SetPingStatus(testTarget, "Online")
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	tunnels := tracker.Tunnels(nil)
+	if len(tunnels["a"]) != 1 || len(tunnels["b"]) != 0 {
+		t.Errorf("got users %v, want only a", tunnels)
+	}
+}
+
+func TestStartTunnelFirstCallerGivingUp(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, PingStatus: "ConnectionLost"})
+	tracker, server := newTestTracker(t, fleet)
+	echo := newEchoServer(t)
+	readiness := ReadinessConfig{TargetTimeout: 10 * time.Second, TargetPollInterval: 50 * time.Millisecond}
+
+	// The caller starting the tunnel gives up while another waits for it
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, err := tracker.StartTunnel(ctx, "a", echoSpec(echo), readiness)
+		first <- err
+	}()
+	waitFor(t, func() bool {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		return len(tracker.tunnels) == 1
+	})
+	second := make(chan error, 1)
+	go func() {
+		_, err := tracker.StartTunnel(t.Context(), "b", echoSpec(echo), readiness)
+		second <- err
+	}()
+
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to be exceeded", err)
+	}
+	fleet.SetPingStatus(testTarget, "Online")
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	tunnels := tracker.Tunnels(nil)
+	if len(tunnels["a"]) != 0 || len(tunnels["b"]) != 1 {
+		t.Errorf("got users %v, want only b", tunnels)
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(sessions))
+	}
+}
+
+func TestStartTunnelEveryCallerGivingUp(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, PingStatus: "ConnectionLost"})
+	tracker, server := newTestTracker(t, fleet)
+	echo := newEchoServer(t)
+	readiness := ReadinessConfig{TargetTimeout: 10 * time.Second, TargetPollInterval: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := tracker.StartTunnel(ctx, "a", echoSpec(echo), readiness); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to be exceeded", err)
+	}
+	// Nobody waits for the tunnel anymore, so it is not started
+	fleet.SetPingStatus(testTarget, "Online")
+	time.Sleep(200 * time.Millisecond)
+	if sessions := server.Sessions(); len(sessions) != 0 {
+		t.Errorf("got sessions %v for an abandoned tunnel", sessions)
+	}
+	if tunnels := tracker.Tunnels(nil); len(tunnels) != 0 {
+		t.Errorf("got users %v", tunnels)
+	}
+}
+
+func TestStartTunnelRacingFailedProbe(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := echoSpec(echo)
+	_ = echo.Close()
+
+	// b finds the tunnel of a, which is closed by a failed probe before b
+	// registers as its user
+	entry, err := tracker.join(t.Context(), spec.key(), spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tracker.LiveTunnel(t.Context(), "a", ReadinessConfig{Probe: true}); ok {
+		t.Fatal("unreachable tunnel is live")
+	}
+	if !isClosed(info.Tunnel) {
+		t.Fatal("tunnel failing the probe was not closed")
+	}
+	if _, err := tracker.use(t.Context(), "b", entry); !errors.Is(err, errTunnelGone) {
+		t.Fatalf("got %v, want %v", err, errTunnelGone)
+	}
+
+	reopened, err := tracker.StartTunnel(t.Context(), "b", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened == info || isClosed(reopened.Tunnel) {
+		t.Error("b got the closed tunnel")
+	}
+	if sessions := server.Sessions(); len(sessions) != 2 {
+		t.Errorf("got %d sessions, want a new one", len(sessions))
+	}
+}
+
+func TestStartTunnelRacingRelease(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	// b starts the tunnel a keeps releasing, and always gets a running one
+	for i := range 20 {
+		if _, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Go(func() {
+			_ = tracker.Release(t.Context(), "a", time.Second)
+		})
+		info, err := tracker.StartTunnel(t.Context(), "b", echoSpec(echo), ReadinessConfig{})
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isClosed(info.Tunnel) {
+			t.Fatalf("attempt %d got a closed tunnel", i)
+		}
+		if err := tracker.Release(t.Context(), "b", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAbandonClosesTunnelWithoutUsers(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only caller gave up as the tunnel was started
+	tracker.mu.Lock()
+	entry := tracker.tunnels[0]
+	delete(entry.users, "a")
+	entry.waiters = 1
+	tracker.mu.Unlock()
+	tracker.abandon(entry)
+
+	if !isClosed(info.Tunnel) {
+		t.Error("tunnel without users was not closed")
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were not terminated", active)
+	}
+	if _, err := tracker.StartTunnel(t.Context(), "b", echoSpec(echo), ReadinessConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if sessions := server.Sessions(); len(sessions) != 2 {
+		t.Errorf("got %d sessions, want a new one", len(sessions))
+	}
+}
+
+func TestShutdownClosesTunnels(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+
+	var infos []*OtherTunnelInfo
+	for i := range 3 {
+		echo := newEchoServer(t)
+		info, err := tracker.StartTunnel(t.Context(), fmt.Sprint(i), echoSpec(echo), ReadinessConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+
+	if err := tracker.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if !isClosed(info.Tunnel) {
+			t.Error("tunnel was not closed")
+		}
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were not terminated", active)
+	}
+
+	echo := newEchoServer(t)
+	if _, err := tracker.StartTunnel(t.Context(), "late", echoSpec(echo), ReadinessConfig{}); !errors.Is(err, errTrackerClosed) {
+		t.Errorf("got %v, want %v", err, errTrackerClosed)
+	}
+}
+
+func TestShutdownWhileStarting(t *testing.T) {
+	tracker, server := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Go(func() {
+			_, _ = tracker.StartTunnel(t.Context(), fmt.Sprint(i), echoSpec(echo), ReadinessConfig{})
+		})
+	}
+	_ = tracker.Shutdown(5 * time.Second)
+	wg.Wait()
+
+	waitFor(t, func() bool {
+		return len(server.ActiveSessions()) == 0
+	})
+}
+
+// slowTerminateClient is an SSM client taking a while to terminate sessions.
+type slowTerminateClient struct {
+	ssmtunnels.SSMClient
+}
+
+func (c slowTerminateClient) TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	time.Sleep(500 * time.Millisecond)
+	return c.SSMClient.TerminateSession(ctx, params, optFns...)
+}
+
+func TestShutdownWaitsForSessions(t *testing.T) {
+	server := ssmtunnelstest.NewServer()
+	server.Logf = t.Logf
+	t.Cleanup(server.Close)
+	tracker, err := NewTunnelTracker(func(region string) ssmtunnels.SSMClient {
+		return slowTerminateClient{server.Client()}
+	}, func(region string) ssmtunnels.EC2Client {
+		return nil
+	}, func(region string) ssmtunnels.ECSClient {
+		return server.ECSClient()
+	}, func(region string) ssmtunnels.KMSClient {
+		return server.KMSClient()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		echo := newEchoServer(t)
+		if _, err := tracker.StartTunnel(t.Context(), fmt.Sprint(i), echoSpec(echo), ReadinessConfig{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Terminating the sessions outlasts the grace period, which only bounds
+	// stopping targets
+	if err := tracker.Shutdown(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were left open", active)
+	}
+}
+
+// hangingFleet is a fleet whose instances never finish stopping.
+type hangingFleet struct {
+	*ssmtunnelstest.Fleet
+}
+
+func (f hangingFleet) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, State: ec2types.InstanceStateNameStopped})
+	server := ssmtunnelstest.NewServer()
+	server.Fleet = fleet
+	server.Logf = t.Logf
+	t.Cleanup(server.Close)
+	tracker, err := NewTunnelTracker(func(region string) ssmtunnels.SSMClient {
+		return server.Client()
+	}, func(region string) ssmtunnels.EC2Client {
+		return hangingFleet{fleet}
+	}, func(region string) ssmtunnels.ECSClient {
+		return server.ECSClient()
+	}, func(region string) ssmtunnels.KMSClient {
+		return server.KMSClient()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.SetAutoStart(AutoStartConfig{StopOnShutdown: true})
+
+	echo := newEchoServer(t)
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{TargetPollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := tracker.Shutdown(300 * time.Millisecond); err == nil {
+		t.Error("shutdown did not report the instance it failed to stop")
+	}
+	// The grace period bounds stopping the instances
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	if !isClosed(info.Tunnel) {
+		t.Error("tunnel was not closed")
+	}
+}
+
+// waitFor polls condition until it holds, failing the test after a while.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLiveTunnel(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	if _, ok := tracker.LiveTunnel(t.Context(), "a", ReadinessConfig{}); ok {
+		t.Fatal("got a live tunnel before starting one")
+	}
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, ok := tracker.LiveTunnel(t.Context(), "a", ReadinessConfig{Probe: true})
+	if !ok || live != info {
+		t.Fatal("running tunnel is not live")
+	}
+}
+
+func TestLiveTunnelClosesTunnelFailingProbe(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := echoSpec(echo)
+	_ = echo.Close()
+
+	if _, ok := tracker.LiveTunnel(t.Context(), "a", ReadinessConfig{Probe: true}); ok {
+		t.Fatal("unreachable tunnel is live")
+	}
+	if !isClosed(info.Tunnel) {
+		t.Error("tunnel failing the probe was not closed")
+	}
+	reopened, err := tracker.StartTunnel(t.Context(), "a", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened == info {
+		t.Error("tunnel was not reopened")
+	}
+}
+
+func TestLiveTunnelKeepsSharedTunnelFailingProbe(t *testing.T) {
+	tracker, _ := newTestTracker(t, nil)
+	echo := newEchoServer(t)
+
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.StartTunnel(t.Context(), "b", echoSpec(echo), ReadinessConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	spec := echoSpec(echo)
+	_ = echo.Close()
+
+	if _, ok := tracker.LiveTunnel(t.Context(), "a", ReadinessConfig{Probe: true}); ok {
+		t.Fatal("unreachable tunnel is live")
+	}
+	if isClosed(info.Tunnel) {
+		t.Fatal("tunnel was closed while b still used it")
+	}
+	if _, ok := tracker.LiveTunnel(t.Context(), "b", ReadinessConfig{}); ok {
+		t.Error("broken tunnel is live for b")
+	}
+
+	reopened, err := tracker.StartTunnel(t.Context(), "a", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened == info {
+		t.Fatal("broken tunnel was reused")
+	}
+	if isClosed(info.Tunnel) {
+		t.Fatal("tunnel was closed before b moved to the new one")
+	}
+	same, err := tracker.StartTunnel(t.Context(), "b", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != reopened {
+		t.Error("b did not move to the reopened tunnel")
+	}
+	if !isClosed(info.Tunnel) {
+		t.Error("broken tunnel was not closed once unused")
+	}
+}
+
+// instanceState returns the EC2 state of the fleet instance id.
+func instanceState(t *testing.T, fleet *ssmtunnelstest.Fleet, id string) ec2types.InstanceStateName {
+	t.Helper()
+	instance, ok := fleet.Instance(id)
+	if !ok {
+		t.Fatalf("no instance %s", id)
+	}
+	return instance.State
+}
+
+func TestAutoStartStopsStartedInstancesOnShutdown(t *testing.T) {
+	const running = "i-0fedcba9876543210"
+	fleet := ssmtunnelstest.NewFleet(
+		ssmtunnelstest.Instance{ID: testTarget, State: ec2types.InstanceStateNameStopped},
+		ssmtunnelstest.Instance{ID: running},
+	)
+	tracker, server := newTestTracker(t, fleet)
+	tracker.SetAutoStart(AutoStartConfig{StopOnShutdown: true})
+
+	echo := newEchoServer(t)
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{TargetPollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+	spec := echoSpec(echo)
+	spec.Target = running
+	if _, err := tracker.StartTunnel(t.Context(), "b", spec, ReadinessConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tracker.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if state := instanceState(t, fleet, testTarget); state != ec2types.InstanceStateNameStopped {
+		t.Errorf("started instance is %s after shutdown", state)
+	}
+	if state := instanceState(t, fleet, running); state != ec2types.InstanceStateNameRunning {
+		t.Errorf("instance that was already running is %s after shutdown", state)
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were not terminated", active)
+	}
+}
+
+func TestAutoStartKeepsInstancesRunning(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{ID: testTarget, State: ec2types.InstanceStateNameStopped})
+	tracker, _ := newTestTracker(t, fleet)
+	tracker.SetAutoStart(AutoStartConfig{})
+
+	echo := newEchoServer(t)
+	info, err := tracker.StartTunnel(t.Context(), "a", echoSpec(echo), ReadinessConfig{TargetPollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+
+	if err := tracker.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if state := instanceState(t, fleet, testTarget); state != ec2types.InstanceStateNameRunning {
+		t.Errorf("instance is %s after shutdown, want it left running", state)
+	}
+}
+
+// newBastionFleet returns a fleet running bastion tasks in the tunnels cluster.
+func newBastionFleet() (*ssmtunnelstest.Fleet, BastionConfig) {
+	fleet := ssmtunnelstest.NewFleet()
+	fleet.AddTaskDefinition("bastion", "shell")
+	return fleet, BastionConfig{
+		Task: ssmtunnels.BastionTask{
+			Cluster:        "tunnels",
+			TaskDefinition: "bastion",
+			Subnets:        []string{"subnet-0123456789abcdef0"},
+		},
+		Region: "us-east-1",
+	}
+}
+
+func TestBastionStoppedOnShutdown(t *testing.T) {
+	fleet, bastion := newBastionFleet()
+	tracker, _ := newTestTracker(t, fleet)
+	tracker.SetBastion(bastion)
+
+	target, err := tracker.Bastion(t.Context(), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := newEchoServer(t)
+	spec := echoSpec(echo)
+	spec.Target = target
+	info, err := tracker.StartTunnel(t.Context(), "a", spec, ReadinessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, info.LocalPort, "hello")
+
+	tasks := fleet.Tasks()
+	if len(tasks) != 1 {
+		t.Fatalf("got tasks %+v, want a single bastion", tasks)
+	}
+
+	if err := tracker.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if status := fleet.Tasks()[0].LastStatus; status != "STOPPED" {
+		t.Errorf("bastion is %s after shutdown", status)
+	}
+}
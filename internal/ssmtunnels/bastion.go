@@ -0,0 +1,143 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// bastionStartedBy tags the bastion tasks, so they can be told apart.
+const bastionStartedBy = "terraform-provider-aws-ssm-tunnels"
+
+// BastionTask describes a short-lived Fargate task launched to start sessions
+// on, instead of a permanent bastion.
+type BastionTask struct {
+	// Cluster is the name or ARN of the cluster to run the task in.
+	Cluster string
+	// TaskDefinition is the family, family:revision or ARN of the task
+	// definition.
+	TaskDefinition string
+	Subnets        []string
+	SecurityGroups []string
+	AssignPublicIP bool
+	// Container is the container to start sessions on. Defaults to the first
+	// container of the task.
+	Container string
+}
+
+// Validate checks the bastion task can be launched.
+func (b BastionTask) Validate() error {
+	if b.Cluster == "" {
+		return errors.New("cluster must be set")
+	}
+	if b.TaskDefinition == "" {
+		return errors.New("task_definition must be set")
+	}
+	if len(b.Subnets) == 0 {
+		return errors.New("subnets must be set")
+	}
+	return nil
+}
+
+// Launch runs the bastion task on Fargate with ECS Exec enabled, and returns
+// its ARN.
+func (b BastionTask) Launch(ctx context.Context, client ECSClient) (string, error) {
+	if err := b.Validate(); err != nil {
+		return "", err
+	}
+
+	assignPublicIP := ecstypes.AssignPublicIpDisabled
+	if b.AssignPublicIP {
+		assignPublicIP = ecstypes.AssignPublicIpEnabled
+	}
+	output, err := client.RunTask(ctx, &ecs.RunTaskInput{
+		Cluster:              aws.String(b.Cluster),
+		TaskDefinition:       aws.String(b.TaskDefinition),
+		LaunchType:           ecstypes.LaunchTypeFargate,
+		Count:                aws.Int32(1),
+		EnableExecuteCommand: true,
+		StartedBy:            aws.String(bastionStartedBy),
+		NetworkConfiguration: &ecstypes.NetworkConfiguration{
+			AwsvpcConfiguration: &ecstypes.AwsVpcConfiguration{
+				Subnets:        b.Subnets,
+				SecurityGroups: b.SecurityGroups,
+				AssignPublicIp: assignPublicIP,
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to run bastion task: %w", err)
+	}
+	for _, failure := range output.Failures {
+		return "", fmt.Errorf("failed to run bastion task: %s: %s", aws.ToString(failure.Arn), aws.ToString(failure.Reason))
+	}
+	if len(output.Tasks) == 0 {
+		return "", errors.New("failed to run bastion task: no task was started")
+	}
+
+	taskArn := aws.ToString(output.Tasks[0].TaskArn)
+	tflog.Info(ctx, "Launched bastion task", map[string]interface{}{
+		"task": taskArn,
+	})
+	return taskArn, nil
+}
+
+// WaitTarget polls the bastion task every interval until its ECS Exec agent
+// runs, and returns the SSM target of its container. It fails once the task
+// stopped, or when ctx is done.
+func (b BastionTask) WaitTarget(ctx context.Context, client ECSClient, taskArn string, interval time.Duration) (string, error) {
+	ecsTarget := ECSTarget{Cluster: b.Cluster, Container: b.Container}
+	for {
+		output, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(b.Cluster),
+			Tasks:   []string{taskArn},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to describe bastion task: %w", err)
+		}
+		if len(output.Tasks) == 0 {
+			return "", fmt.Errorf("bastion task %s does not exist", taskArn)
+		}
+
+		task := output.Tasks[0]
+		if target, ok := ecsTarget.sessionTarget(task); ok {
+			tflog.Info(ctx, "Bastion task is ready", map[string]interface{}{
+				"target": target,
+			})
+			return target, nil
+		}
+		if aws.ToString(task.LastStatus) == "STOPPED" {
+			return "", fmt.Errorf("bastion task %s stopped: %s", taskArn, aws.ToString(task.StoppedReason))
+		}
+
+		tflog.Info(ctx, "Waiting for bastion task to run", map[string]interface{}{
+			"task":          taskArn,
+			"status":        aws.ToString(task.LastStatus),
+			"poll_interval": interval.String(),
+		})
+		if err := sleep(ctx, interval); err != nil {
+			return "", fmt.Errorf("bastion task %s is not running: %w", taskArn, err)
+		}
+	}
+}
+
+// Stop stops the bastion task.
+func (b BastionTask) Stop(ctx context.Context, client ECSClient, taskArn string) error {
+	if _, err := client.StopTask(ctx, &ecs.StopTaskInput{
+		Cluster: aws.String(b.Cluster),
+		Task:    aws.String(taskArn),
+		Reason:  aws.String("The tunnels through the bastion were closed"),
+	}); err != nil {
+		return fmt.Errorf("failed to stop bastion task %s: %w", taskArn, err)
+	}
+	tflog.Info(ctx, "Stopped bastion task", map[string]interface{}{
+		"task": taskArn,
+	})
+	return nil
+}
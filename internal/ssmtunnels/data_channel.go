@@ -0,0 +1,676 @@
+package ssmtunnels
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/src/config"
+	"github.com/aws/session-manager-plugin/src/encryption"
+	"github.com/aws/session-manager-plugin/src/log"
+	"github.com/aws/session-manager-plugin/src/message"
+	"github.com/aws/session-manager-plugin/src/service"
+	"github.com/aws/session-manager-plugin/src/version"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	twinjuuid "github.com/twinj/uuid"
+)
+
+// errChannelClosed is returned when the service closes the data channel, for
+// example because the session was terminated or timed out.
+var errChannelClosed = errors.New("data channel closed by the service")
+
+// outgoingMessage is a stream message that has been sent but not acknowledged yet.
+type outgoingMessage struct {
+	content        []byte
+	sequenceNumber int64
+	lastSent       time.Time
+	attempts       int
+}
+
+// dataChannel is a cancelable client for the Session Manager data channel
+// protocol. It replaces the session-manager-plugin's session runner, which
+// calls os.Exit when a session ends and cannot be stopped from the outside.
+type dataChannel struct {
+	log       log.T
+	kmsClient KMSClient
+	sessionID string
+	targetID  string
+	clientID  string
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex // Serializes websocket writes
+	sendMu  sync.Mutex // Keeps stream messages in sequence order on the wire
+
+	mu                sync.Mutex
+	streamSeq         int64
+	expectedSeq       int64
+	outgoing          []*outgoingMessage
+	incoming          map[int64]message.ClientMessage
+	rtt               time.Duration
+	rttVariation      time.Duration
+	rto               time.Duration
+	encrypter         encryption.IEncrypter
+	agentVersion      string
+	sessionType       string
+	sessionProperties json.RawMessage
+	// onOutput receives the payload of every output message once the handshake completed.
+	onOutput func(payload []byte) error
+	// onFlag receives flags sent by the agent, such as ConnectToPortError.
+	onFlag func(flag message.PayloadTypeFlag)
+
+	handshakeDone chan struct{}
+	handshakeOnce sync.Once
+	lost          chan error
+	done          chan struct{}
+	closeOnce     sync.Once
+	err           error
+}
+
+func newDataChannel(logger log.T, kmsClient KMSClient, sessionID, targetID string) *dataChannel {
+	return &dataChannel{
+		log:           logger,
+		kmsClient:     kmsClient,
+		sessionID:     sessionID,
+		targetID:      targetID,
+		clientID:      uuid.New().String(),
+		incoming:      make(map[int64]message.ClientMessage),
+		rtt:           config.DefaultRoundTripTime,
+		rttVariation:  config.DefaultRoundTripTimeVariation,
+		rto:           config.DefaultTransmissionTimeout,
+		handshakeDone: make(chan struct{}),
+		lost:          make(chan error, 1),
+		done:          make(chan struct{}),
+	}
+}
+
+// open connects the websocket, sends the token to acknowledge the connection
+// and starts the background loops.
+func (d *dataChannel) open(ctx context.Context, streamURL, token string) error {
+	if err := d.connect(ctx, streamURL, token); err != nil {
+		return err
+	}
+	go d.resendLoop()
+	go d.pingLoop()
+	return nil
+}
+
+// reconnect replaces a lost websocket connection after the session was
+// resumed. Sequence numbers and unacknowledged messages are kept, so the
+// agent side of the session carries on where it left off.
+func (d *dataChannel) reconnect(ctx context.Context, streamURL, token string) error {
+	select {
+	case <-d.done:
+		return errChannelClosed
+	default:
+	}
+	return d.connect(ctx, streamURL, token)
+}
+
+func (d *dataChannel) connect(ctx context.Context, streamURL, token string) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, streamURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open data channel: %w", err)
+	}
+
+	d.writeMu.Lock()
+	previous := d.conn
+	d.conn = conn
+	d.writeMu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	openDataChannelInput, err := json.Marshal(service.OpenDataChannelInput{
+		MessageSchemaVersion: ptr(config.MessageSchemaVersion),
+		RequestId:            ptr(uuid.New().String()),
+		TokenValue:           ptr(token),
+		ClientId:             ptr(d.clientID),
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := d.write(websocket.TextMessage, openDataChannelInput); err != nil {
+		conn.Close()
+		return fmt.Errorf("error sending token for handshake: %w", err)
+	}
+
+	go d.readLoop(conn)
+	return nil
+}
+
+// waitForHandshake blocks until the agent completed the handshake.
+func (d *dataChannel) waitForHandshake(ctx context.Context) error {
+	select {
+	case <-d.handshakeDone:
+		return nil
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setOutputHandler registers where output payloads from the agent go.
+func (d *dataChannel) setOutputHandler(onOutput func(payload []byte) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onOutput = onOutput
+}
+
+// setFlagHandler registers a handler for flags sent by the agent.
+func (d *dataChannel) setFlagHandler(onFlag func(flag message.PayloadTypeFlag)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onFlag = onFlag
+}
+
+// Done is closed once the data channel stopped. Err returns the reason.
+func (d *dataChannel) Done() <-chan struct{} {
+	return d.done
+}
+
+// Lost receives an error whenever the websocket connection drops while the
+// data channel is still open. The session can then be resumed with reconnect.
+func (d *dataChannel) Lost() <-chan error {
+	return d.lost
+}
+
+func (d *dataChannel) Err() error {
+	<-d.done
+	return d.err
+}
+
+// close tears down the data channel. If the agent supports it, it is asked to
+// terminate the session first.
+func (d *dataChannel) close() {
+	d.mu.Lock()
+	agentVersion := d.agentVersion
+	d.mu.Unlock()
+
+	if version.DoesAgentSupportTerminateSessionFlag(d.log, agentVersion) {
+		if err := d.sendFlag(message.TerminateSession); err != nil {
+			d.log.Debugf("Failed to send TerminateSession flag: %v", err)
+		}
+	}
+
+	d.fail(nil)
+}
+
+// fail stops the data channel with the given error. Only the first call has an effect.
+func (d *dataChannel) fail(err error) {
+	d.closeOnce.Do(func() {
+		d.err = err
+		close(d.done)
+
+		d.writeMu.Lock()
+		defer d.writeMu.Unlock()
+		if d.conn != nil {
+			_ = d.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			d.conn.Close()
+		}
+	})
+}
+
+func (d *dataChannel) write(messageType int, data []byte) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.conn.WriteMessage(messageType, data)
+}
+
+func (d *dataChannel) readLoop(conn *websocket.Conn) {
+	for {
+		messageType, raw, err := conn.ReadMessage()
+		if err != nil {
+			d.connectionLost(conn, err)
+			return
+		}
+		if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+			d.log.Errorf("Invalid message type %d received on data channel", messageType)
+			continue
+		}
+		if err := d.handleMessage(raw); err != nil {
+			d.fail(err)
+			return
+		}
+	}
+}
+
+// connectionLost reports a dropped websocket connection, unless the data
+// channel was closed or the connection was already replaced.
+func (d *dataChannel) connectionLost(conn *websocket.Conn, err error) {
+	d.writeMu.Lock()
+	current := d.conn == conn
+	d.writeMu.Unlock()
+
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	if !current {
+		return
+	}
+
+	select {
+	case d.lost <- fmt.Errorf("data channel read failed: %w", err):
+	default:
+	}
+}
+
+func (d *dataChannel) pingLoop() {
+	ticker := time.NewTicker(config.PingTimeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.writeMu.Lock()
+			err := d.conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(10*time.Second))
+			d.writeMu.Unlock()
+			if err != nil {
+				d.log.Debugf("Error while sending websocket ping: %v", err)
+			}
+		}
+	}
+}
+
+// resendLoop resends the oldest unacknowledged message when its
+// retransmission timeout elapsed, mirroring the session-manager-plugin.
+func (d *dataChannel) resendLoop() {
+	ticker := time.NewTicker(config.ResendSleepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		if len(d.outgoing) == 0 || time.Since(d.outgoing[0].lastSent) <= d.rto {
+			d.mu.Unlock()
+			continue
+		}
+		msg := d.outgoing[0]
+		msg.attempts++
+		msg.lastSent = time.Now()
+		attempts := msg.attempts
+		content := msg.content
+		d.mu.Unlock()
+
+		if attempts > config.ResendMaxAttempt {
+			d.fail(fmt.Errorf("stream message %d was not acknowledged after %d attempts", msg.sequenceNumber, config.ResendMaxAttempt))
+			return
+		}
+		d.log.Debugf("Resending stream data message %d, attempt %d", msg.sequenceNumber, attempts)
+		if err := d.write(websocket.BinaryMessage, content); err != nil {
+			d.log.Debugf("Unable to resend stream data message: %v", err)
+		}
+	}
+}
+
+func (d *dataChannel) handleMessage(raw []byte) error {
+	msg := &message.ClientMessage{}
+	if err := msg.DeserializeClientMessage(d.log, raw); err != nil {
+		d.log.Errorf("Cannot deserialize raw message: %v", err)
+		return nil
+	}
+	if err := msg.Validate(); err != nil {
+		d.log.Errorf("Invalid message received: %v", err)
+		return nil
+	}
+
+	switch msg.MessageType {
+	case message.OutputStreamMessage:
+		return d.handleOutputMessage(*msg)
+	case message.AcknowledgeMessage:
+		ack, err := msg.DeserializeDataStreamAcknowledgeContent(d.log)
+		if err != nil {
+			d.log.Errorf("Cannot deserialize acknowledge message: %v", err)
+			return nil
+		}
+		d.processAcknowledge(ack)
+	case message.ChannelClosedMessage:
+		closed, err := msg.DeserializeChannelClosedMessage(d.log)
+		if err == nil && closed.Output != "" {
+			return fmt.Errorf("%w: %s", errChannelClosed, closed.Output)
+		}
+		return errChannelClosed
+	case message.StartPublicationMessage, message.PausePublicationMessage:
+	default:
+		d.log.Warnf("Invalid message type received: %s", msg.MessageType)
+	}
+	return nil
+}
+
+// handleOutputMessage processes stream messages in sequence order, buffering
+// the ones that arrive early.
+func (d *dataChannel) handleOutputMessage(msg message.ClientMessage) error {
+	d.mu.Lock()
+	expected := d.expectedSeq
+	switch {
+	case msg.SequenceNumber > expected:
+		if len(d.incoming) < config.IncomingMessageBufferCapacity {
+			d.incoming[msg.SequenceNumber] = msg
+			d.mu.Unlock()
+			return d.sendAcknowledge(msg)
+		}
+		d.mu.Unlock()
+		return nil
+	case msg.SequenceNumber < expected:
+		// Already processed, the acknowledgement was probably lost.
+		d.mu.Unlock()
+		return d.sendAcknowledge(msg)
+	}
+	d.mu.Unlock()
+
+	for {
+		if err := d.sendAcknowledge(msg); err != nil {
+			return err
+		}
+		if err := d.processPayload(msg); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		d.expectedSeq++
+		next, ok := d.incoming[d.expectedSeq]
+		delete(d.incoming, d.expectedSeq)
+		d.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		msg = next
+	}
+}
+
+func (d *dataChannel) processPayload(msg message.ClientMessage) error {
+	switch message.PayloadType(msg.PayloadType) {
+	case message.HandshakeRequestPayloadType:
+		return d.handleHandshakeRequest(msg)
+	case message.HandshakeCompletePayloadType:
+		complete, err := msg.DeserializeHandshakeComplete(d.log)
+		if err != nil {
+			return err
+		}
+		if complete.CustomerMessage != "" {
+			d.log.Info(complete.CustomerMessage)
+		}
+		d.mu.Lock()
+		sessionType := d.sessionType
+		d.mu.Unlock()
+		if sessionType != config.PortPluginName {
+			return fmt.Errorf("unexpected session type %q, the document must start a port forwarding session", sessionType)
+		}
+		d.handshakeOnce.Do(func() { close(d.handshakeDone) })
+	case message.EncChallengeRequest:
+		return d.handleEncryptionChallenge(msg)
+	case message.Output, message.StdErr, message.ExitCode:
+		payload := msg.Payload
+		d.mu.Lock()
+		encrypter := d.encrypter
+		d.mu.Unlock()
+		if encrypter != nil {
+			var err error
+			if payload, err = encrypter.Decrypt(d.log, payload); err != nil {
+				return fmt.Errorf("unable to decrypt payload: %w", err)
+			}
+		}
+		d.mu.Lock()
+		onOutput := d.onOutput
+		d.mu.Unlock()
+		if message.PayloadType(msg.PayloadType) == message.Output && onOutput != nil {
+			return onOutput(payload)
+		}
+	case message.Flag:
+		var flag message.PayloadTypeFlag
+		if err := binary.Read(bytes.NewReader(msg.Payload), binary.BigEndian, &flag); err != nil {
+			return nil
+		}
+		d.mu.Lock()
+		onFlag := d.onFlag
+		d.mu.Unlock()
+		if onFlag != nil {
+			onFlag(flag)
+		}
+	}
+	return nil
+}
+
+func (d *dataChannel) handleHandshakeRequest(msg message.ClientMessage) error {
+	request, err := msg.DeserializeHandshakeRequest(d.log)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.agentVersion = request.AgentVersion
+	d.mu.Unlock()
+
+	response := message.HandshakeResponsePayload{
+		ClientVersion:          version.Version,
+		ProcessedClientActions: []message.ProcessedClientAction{},
+	}
+	for _, action := range request.RequestedClientActions {
+		processed := message.ProcessedClientAction{ActionType: action.ActionType}
+		switch action.ActionType {
+		case message.SessionType:
+			var sessionTypeRequest struct {
+				SessionType string          `json:"SessionType"`
+				Properties  json.RawMessage `json:"Properties"`
+			}
+			if err := json.Unmarshal(action.ActionParameters, &sessionTypeRequest); err != nil {
+				processed.ActionStatus = message.Failed
+				processed.Error = fmt.Sprintf("Failed to process action %s: %s", message.SessionType, err)
+				break
+			}
+			d.mu.Lock()
+			d.sessionType = sessionTypeRequest.SessionType
+			d.sessionProperties = sessionTypeRequest.Properties
+			d.mu.Unlock()
+			processed.ActionStatus = message.Success
+		case message.KMSEncryption:
+			encrypter, err := d.newEncrypter(action.ActionParameters)
+			if err != nil {
+				processed.ActionStatus = message.Failed
+				processed.Error = fmt.Sprintf("Failed to process action %s: %s", message.KMSEncryption, err)
+				break
+			}
+			processed.ActionStatus = message.Success
+			processed.ActionResult = message.KMSEncryptionResponse{
+				KMSCipherTextKey: encrypter.GetEncryptedDataKey(),
+			}
+			d.mu.Lock()
+			d.encrypter = encrypter
+			d.mu.Unlock()
+		default:
+			processed.ActionResult = message.Unsupported
+			processed.Error = fmt.Sprintf("Unsupported action %s", action.ActionType)
+		}
+		if processed.Error != "" {
+			response.Errors = append(response.Errors, processed.Error)
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return d.sendInput(message.HandshakeResponsePayloadType, payload)
+}
+
+func (d *dataChannel) newEncrypter(parameters json.RawMessage) (encryption.IEncrypter, error) {
+	var request message.KMSEncryptionRequest
+	if err := json.Unmarshal(parameters, &request); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), generateDataKeyTimeout)
+	defer cancel()
+	return newKMSEncrypter(ctx, d.kmsClient, request.KMSKeyID, d.sessionID, d.targetID)
+}
+
+func (d *dataChannel) handleEncryptionChallenge(msg message.ClientMessage) error {
+	d.mu.Lock()
+	encrypter := d.encrypter
+	d.mu.Unlock()
+	if encrypter == nil {
+		return fmt.Errorf("received encryption challenge without encryption being set up")
+	}
+
+	var request message.EncryptionChallengeRequest
+	if err := json.Unmarshal(msg.Payload, &request); err != nil {
+		return fmt.Errorf("could not deserialize encryption challenge: %w", err)
+	}
+	challenge, err := encrypter.Decrypt(d.log, request.Challenge)
+	if err != nil {
+		return err
+	}
+	if challenge, err = encrypter.Encrypt(d.log, challenge); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(message.EncryptionChallengeResponse{Challenge: challenge})
+	if err != nil {
+		return err
+	}
+	return d.sendInput(message.EncChallengeResponse, payload)
+}
+
+func (d *dataChannel) sendAcknowledge(msg message.ClientMessage) error {
+	// message.SerializeClientMessageWithAcknowledgeContent switches the global
+	// UUID format on every call, which races with the other tunnels
+	content, err := message.SerializeClientMessagePayload(d.log, message.AcknowledgeContent{
+		MessageType:         msg.MessageType,
+		MessageId:           msg.MessageId.String(),
+		SequenceNumber:      msg.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	if err != nil {
+		return err
+	}
+	reply := message.ClientMessage{
+		MessageType:   message.AcknowledgeMessage,
+		SchemaVersion: 1,
+		CreatedDate:   uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		Flags:         3,
+		MessageId:     twinjuuid.NewV4(),
+		Payload:       content,
+	}
+	ack, err := reply.SerializeClientMessage(d.log)
+	if err != nil {
+		return err
+	}
+	if err := d.write(websocket.BinaryMessage, ack); err != nil {
+		// The agent resends unacknowledged messages once the connection is back.
+		d.log.Debugf("Error sending acknowledge message: %v", err)
+	}
+	return nil
+}
+
+func (d *dataChannel) processAcknowledge(ack message.AcknowledgeContent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, msg := range d.outgoing {
+		if msg.sequenceNumber != ack.SequenceNumber {
+			continue
+		}
+		d.updateRetransmissionTimeout(time.Since(msg.lastSent))
+		d.outgoing = append(d.outgoing[:i], d.outgoing[i+1:]...)
+		return
+	}
+}
+
+// updateRetransmissionTimeout uses the same estimator as the session-manager-plugin.
+// Must be called with d.mu held.
+func (d *dataChannel) updateRetransmissionTimeout(sample time.Duration) {
+	delta := d.rtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	d.rttVariation = time.Duration((1-config.RTTVConstant)*float64(d.rttVariation) + config.RTTVConstant*float64(delta))
+	d.rtt = time.Duration((1-config.RTTConstant)*float64(d.rtt) + config.RTTConstant*float64(sample))
+	d.rto = d.rtt + max(config.ClockGranularity, 4*d.rttVariation)
+	if d.rto > config.MaxTransmissionTimeout {
+		d.rto = config.MaxTransmissionTimeout
+	}
+}
+
+func (d *dataChannel) sendFlag(flag message.PayloadTypeFlag) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, flag); err != nil {
+		return err
+	}
+	return d.sendInput(message.Flag, buf.Bytes())
+}
+
+// sendInput sends a stream message and keeps it for retransmission until it
+// is acknowledged.
+func (d *dataChannel) sendInput(payloadType message.PayloadType, payload []byte) error {
+	select {
+	case <-d.done:
+		if d.err != nil {
+			return d.err
+		}
+		return errChannelClosed
+	default:
+	}
+
+	d.mu.Lock()
+	encrypter := d.encrypter
+	d.mu.Unlock()
+	if encrypter != nil && payloadType == message.Output {
+		var err error
+		if payload, err = encrypter.Encrypt(d.log, payload); err != nil {
+			return err
+		}
+	}
+
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	d.mu.Lock()
+	seq := d.streamSeq
+	d.mu.Unlock()
+
+	msg := message.ClientMessage{
+		MessageType:    message.InputStreamMessage,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		MessageId:      twinjuuid.NewV4(),
+		PayloadType:    uint32(payloadType),
+		Payload:        payload,
+		SequenceNumber: seq,
+	}
+	content, err := msg.SerializeClientMessage(d.log)
+	if err != nil {
+		return fmt.Errorf("cannot serialize stream data message: %w", err)
+	}
+
+	d.mu.Lock()
+	d.outgoing = append(d.outgoing, &outgoingMessage{
+		content:        content,
+		sequenceNumber: seq,
+		lastSent:       time.Now(),
+	})
+	d.streamSeq++
+	d.mu.Unlock()
+
+	if err := d.write(websocket.BinaryMessage, content); err != nil {
+		// The message stays buffered and is resent once the connection is back.
+		d.log.Debugf("Error sending stream data message %d: %v", seq, err)
+	}
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,166 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// The AWS-owned Session Manager documents starting port forwarding sessions.
+const (
+	// DocumentPortForwardingToRemoteHost forwards to a host reachable from the target.
+	DocumentPortForwardingToRemoteHost = "AWS-StartPortForwardingSessionToRemoteHost"
+	// DocumentPortForwarding forwards to a port on the target itself.
+	DocumentPortForwarding = "AWS-StartPortForwardingSession"
+)
+
+// IsAWSDocument reports whether name is one of the AWS-owned port forwarding documents.
+func IsAWSDocument(name string) bool {
+	return name == DocumentPortForwardingToRemoteHost || name == DocumentPortForwarding
+}
+
+// SessionDocumentName returns the name of the document the session is
+// started with.
+func (cfg RemoteTunnelConfig) SessionDocumentName() string {
+	if cfg.DocumentName != "" {
+		return cfg.DocumentName
+	}
+	if cfg.RemoteHost != "" {
+		return DocumentPortForwardingToRemoteHost
+	}
+	return DocumentPortForwarding
+}
+
+// SessionDocument returns the document the session is started with, and its
+// parameters. document describes a custom document, as returned by
+// DescribeSessionDocument, and is not used with the AWS-owned ones.
+func (cfg RemoteTunnelConfig) SessionDocument(document *types.DocumentDescription) (string, map[string][]string, error) {
+	documentName := cfg.SessionDocumentName()
+
+	switch documentName {
+	case DocumentPortForwardingToRemoteHost:
+		if cfg.RemoteHost == "" {
+			return "", nil, fmt.Errorf("remoteHost must be set to use %s", documentName)
+		}
+	case DocumentPortForwarding:
+		if cfg.RemoteHost != "" {
+			return "", nil, fmt.Errorf("remoteHost can not be used with %s, which forwards to a port on the target", documentName)
+		}
+	}
+	if IsAWSDocument(documentName) {
+		if len(cfg.DocumentParameters) > 0 {
+			return "", nil, fmt.Errorf("document parameters can only be used with custom documents")
+		}
+		parameters := map[string][]string{
+			"portNumber": {
+				strconv.Itoa(cfg.RemotePort),
+			},
+			"localPortNumber": {
+				strconv.Itoa(cfg.LocalPort),
+			},
+		}
+		if cfg.RemoteHost != "" {
+			parameters["host"] = []string{cfg.RemoteHost}
+		}
+		return documentName, parameters, nil
+	}
+
+	// Custom documents only get the parameters that were asked for. The
+	// remote port and host are filled in when the document declares them, as
+	// port forwarding documents conventionally take them as portNumber and
+	// host. localPortNumber is always filled in when declared, as the local
+	// port is only known to the tunnel.
+	parameters := maps.Clone(cfg.DocumentParameters)
+	if parameters == nil {
+		parameters = make(map[string][]string)
+	}
+	declared := declaredParameters(document)
+	if _, ok := parameters["portNumber"]; !ok && declared["portNumber"] && cfg.RemotePort != 0 {
+		parameters["portNumber"] = []string{strconv.Itoa(cfg.RemotePort)}
+	}
+	if _, ok := parameters["host"]; !ok && declared["host"] && cfg.RemoteHost != "" {
+		parameters["host"] = []string{cfg.RemoteHost}
+	}
+	if _, ok := parameters["localPortNumber"]; !ok && declared["localPortNumber"] {
+		parameters["localPortNumber"] = []string{strconv.Itoa(cfg.LocalPort)}
+	}
+	return documentName, parameters, nil
+}
+
+// declaredParameters returns the names of the parameters document declares.
+func declaredParameters(document *types.DocumentDescription) map[string]bool {
+	declared := make(map[string]bool)
+	if document == nil {
+		return declared
+	}
+	for _, parameter := range document.Parameters {
+		declared[aws.ToString(parameter.Name)] = true
+	}
+	return declared
+}
+
+// DescribeSessionDocument describes the document documentName, and checks it
+// is a Session Manager document.
+func DescribeSessionDocument(ctx context.Context, client SSMClient, documentName string) (*types.DocumentDescription, error) {
+	output, err := client.DescribeDocument(ctx, &ssm.DescribeDocumentInput{
+		Name: aws.String(documentName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe document %s: %w", documentName, err)
+	}
+	if output.Document == nil {
+		return nil, fmt.Errorf("document %s not found", documentName)
+	}
+	if output.Document.DocumentType != types.DocumentTypeSession {
+		return nil, fmt.Errorf("document %s is a %s document, not a Session document", documentName, output.Document.DocumentType)
+	}
+	return output.Document, nil
+}
+
+// DocumentParameterError reports a parameter that does not match the
+// parameters declared by a document.
+type DocumentParameterError struct {
+	Parameter string
+	Reason    string
+}
+
+func (e *DocumentParameterError) Error() string {
+	return fmt.Sprintf("parameter %q %s", e.Parameter, e.Reason)
+}
+
+// CheckDocumentParameters checks parameters against the ones document
+// declares. It returns an error per unknown parameter and per required
+// parameter that is missing.
+func CheckDocumentParameters(document *types.DocumentDescription, parameters map[string][]string) []*DocumentParameterError {
+	documentName := aws.ToString(document.Name)
+	declared := make(map[string]types.DocumentParameter)
+	for _, parameter := range document.Parameters {
+		declared[aws.ToString(parameter.Name)] = parameter
+	}
+
+	var problems []*DocumentParameterError
+	for _, name := range slices.Sorted(maps.Keys(parameters)) {
+		if _, ok := declared[name]; !ok {
+			problems = append(problems, &DocumentParameterError{
+				Parameter: name,
+				Reason:    fmt.Sprintf("is not declared by document %s", documentName),
+			})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(declared)) {
+		// Parameters without a default value are required.
+		if _, ok := parameters[name]; !ok && declared[name].DefaultValue == nil {
+			problems = append(problems, &DocumentParameterError{
+				Parameter: name,
+				Reason:    fmt.Sprintf("is required by document %s", documentName),
+			})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,135 @@
+package ssmtunnels_test
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+)
+
+func TestSessionDocumentAWSDocuments(t *testing.T) {
+	cfg := ssmtunnels.RemoteTunnelConfig{RemoteHost: "db.internal", RemotePort: 5432, LocalPort: 17000}
+	name, parameters, err := cfg.SessionDocument(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"host": {"db.internal"}, "portNumber": {"5432"}, "localPortNumber": {"17000"}}
+	if name != ssmtunnels.DocumentPortForwardingToRemoteHost || !maps.EqualFunc(parameters, want, slices.Equal[[]string]) {
+		t.Errorf("got %s with %v", name, parameters)
+	}
+
+	cfg.RemoteHost = ""
+	if name, _, _ := cfg.SessionDocument(nil); name != ssmtunnels.DocumentPortForwarding {
+		t.Errorf("got %s without a remote host", name)
+	}
+
+	cfg.DocumentParameters = map[string][]string{"changeTicket": {"OPS-1234"}}
+	if _, _, err := cfg.SessionDocument(nil); err == nil {
+		t.Error("parameters were accepted for an AWS document")
+	}
+}
+
+func TestSessionDocumentOnlyFillsDeclaredParameters(t *testing.T) {
+	cfg := ssmtunnels.RemoteTunnelConfig{
+		DocumentName:       "MyOrg-PortForwarding",
+		DocumentParameters: map[string][]string{"changeTicket": {"OPS-1234"}},
+		RemoteHost:         "db.internal",
+		RemotePort:         5432,
+		LocalPort:          17000,
+	}
+
+	tests := map[string]struct {
+		declared map[string]*string
+		want     map[string][]string
+	}{
+		"port and host": {
+			declared: map[string]*string{"changeTicket": nil, "portNumber": nil, "host": nil},
+			want:     map[string][]string{"changeTicket": {"OPS-1234"}, "portNumber": {"5432"}, "host": {"db.internal"}},
+		},
+		"port only": {
+			declared: map[string]*string{"changeTicket": nil, "portNumber": aws.String("80")},
+			want:     map[string][]string{"changeTicket": {"OPS-1234"}, "portNumber": {"5432"}},
+		},
+		"neither": {
+			declared: map[string]*string{"changeTicket": nil},
+			want:     map[string][]string{"changeTicket": {"OPS-1234"}},
+		},
+		"local port": {
+			declared: map[string]*string{"changeTicket": nil, "localPortNumber": nil},
+			want:     map[string][]string{"changeTicket": {"OPS-1234"}, "localPortNumber": {"17000"}},
+		},
+		"local port with a default": {
+			declared: map[string]*string{"changeTicket": nil, "localPortNumber": aws.String("0")},
+			want:     map[string][]string{"changeTicket": {"OPS-1234"}, "localPortNumber": {"17000"}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			document := ssmtunnelstest.SessionDocument(cfg.DocumentName, test.declared)
+			documentName, parameters, err := cfg.SessionDocument(&document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if documentName != cfg.DocumentName || !maps.EqualFunc(parameters, test.want, slices.Equal[[]string]) {
+				t.Errorf("got %s with %v, want %v", documentName, parameters, test.want)
+			}
+			if problems := ssmtunnels.CheckDocumentParameters(&document, parameters); len(problems) != 0 {
+				t.Errorf("got problems %v", problems)
+			}
+		})
+	}
+}
+
+func TestSessionDocumentKeepsGivenParameters(t *testing.T) {
+	cfg := ssmtunnels.RemoteTunnelConfig{
+		DocumentName:       "MyOrg-PortForwarding",
+		DocumentParameters: map[string][]string{"portNumber": {"6543"}},
+		RemotePort:         5432,
+	}
+	document := ssmtunnelstest.SessionDocument(cfg.DocumentName, map[string]*string{"portNumber": nil})
+	_, parameters, err := cfg.SessionDocument(&document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := parameters["portNumber"]; len(port) != 1 || port[0] != "6543" {
+		t.Errorf("got portNumber %v, want the given one", port)
+	}
+}
+
+func TestCheckDocumentParameters(t *testing.T) {
+	document := ssmtunnelstest.SessionDocument("MyOrg-PortForwarding", map[string]*string{
+		"portNumber":   nil,
+		"changeTicket": nil,
+		"reason":       aws.String("tunnel"),
+	})
+	problems := ssmtunnels.CheckDocumentParameters(&document, map[string][]string{
+		"portNumber": {"5432"},
+		"ticket":     {"OPS-1234"},
+	})
+	if len(problems) != 2 {
+		t.Fatalf("got problems %v, want an unknown and a missing parameter", problems)
+	}
+	if problems[0].Parameter != "ticket" || problems[1].Parameter != "changeTicket" {
+		t.Errorf("got problems %v", problems)
+	}
+}
+
+func TestDescribeSessionDocument(t *testing.T) {
+	client := ssmtunnelstest.NewFakeSSMClient("ws://127.0.0.1:1")
+	client.AddDocument(ssmtunnelstest.SessionDocument("MyOrg-PortForwarding", nil))
+
+	document, err := ssmtunnels.DescribeSessionDocument(t.Context(), client, "MyOrg-PortForwarding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(document.Name) != "MyOrg-PortForwarding" {
+		t.Errorf("got document %s", aws.ToString(document.Name))
+	}
+	if _, err := ssmtunnels.DescribeSessionDocument(t.Context(), client, "MyOrg-Missing"); err == nil {
+		t.Error("missing document was described")
+	}
+}
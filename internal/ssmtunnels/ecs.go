@@ -0,0 +1,194 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// ECSClient is the subset of the ECS API used to find or launch the tasks to
+// start sessions on. It is satisfied by *ecs.Client, and by fakes in tests.
+type ECSClient interface {
+	ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error)
+	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
+	RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error)
+	StopTask(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error)
+}
+
+var _ ECSClient = (*ecs.Client)(nil)
+
+// ErrNoECSTask is returned when no running task matches an ECS target.
+var ErrNoECSTask = errors.New("no running task with ECS Exec enabled matches the ECS target")
+
+// describeTasksBatch is the most tasks ECS describes at once.
+const describeTasksBatch = 100
+
+// ecsTargetPrefix starts the SSM targets of ECS tasks.
+const ecsTargetPrefix = "ecs:"
+
+// ECSTarget picks a container of a running ECS task to start sessions on
+// through ECS Exec, rather than naming its SSM target, which changes with
+// every deployment.
+type ECSTarget struct {
+	// Cluster is the name or ARN of the cluster.
+	Cluster string
+	// Service is the name of the service running the task.
+	Service string
+	// Family is the task definition family of the task, for tasks that do
+	// not belong to a service.
+	Family string
+	// Container is the name of the container to forward from.
+	Container string
+}
+
+// Validate checks the ECS target can be resolved.
+func (t ECSTarget) Validate() error {
+	if t.Cluster == "" {
+		return errors.New("cluster must be set")
+	}
+	if t.Container == "" {
+		return errors.New("container must be set")
+	}
+	if (t.Service == "") == (t.Family == "") {
+		return errors.New("exactly one of service and family must be set")
+	}
+	return nil
+}
+
+// IsECSTask reports whether target is the SSM target of an ECS container.
+func IsECSTask(target string) bool {
+	return strings.HasPrefix(target, ecsTargetPrefix)
+}
+
+// Candidates returns the SSM targets of the container in the running tasks
+// whose ECS Exec agent is running, oldest task first.
+func (t ECSTarget) Candidates(ctx context.Context, client ECSClient) ([]string, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	input := &ecs.ListTasksInput{
+		Cluster:       aws.String(t.Cluster),
+		DesiredStatus: ecstypes.DesiredStatusRunning,
+	}
+	if t.Service != "" {
+		input.ServiceName = aws.String(t.Service)
+	} else {
+		input.Family = aws.String(t.Family)
+	}
+
+	var arns []string
+	paginator := ecs.NewListTasksPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tasks: %w", err)
+		}
+		arns = append(arns, page.TaskArns...)
+	}
+
+	started := make(map[string]time.Time)
+	for batch := range slices.Chunk(arns, describeTasksBatch) {
+		output, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(t.Cluster),
+			Tasks:   batch,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe tasks: %w", err)
+		}
+		for _, task := range output.Tasks {
+			if target, ok := t.sessionTarget(task); ok {
+				started[target] = aws.ToTime(task.StartedAt)
+			}
+		}
+	}
+
+	candidates := make([]string, 0, len(started))
+	for target := range started {
+		candidates = append(candidates, target)
+	}
+	// Targets break ties, so the order is stable across plans
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := started[candidates[i]], started[candidates[j]]
+		if a.Equal(b) {
+			return candidates[i] < candidates[j]
+		}
+		return a.Before(b)
+	})
+	return candidates, nil
+}
+
+// Resolve returns the SSM target to start sessions on. current, the target
+// resolved before, is kept as long as its task is running, so targets do not
+// move between runs.
+func (t ECSTarget) Resolve(ctx context.Context, client ECSClient, current string) (string, error) {
+	candidates, err := t.Candidates(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoECSTask
+	}
+	if current != "" && slices.Contains(candidates, current) {
+		return current, nil
+	}
+	return candidates[0], nil
+}
+
+// WaitResolve is Resolve, polling every interval while no task matches, for
+// example because the service is still deploying, until ctx is done.
+func (t ECSTarget) WaitResolve(ctx context.Context, client ECSClient, current string, interval time.Duration) (string, error) {
+	for {
+		target, err := t.Resolve(ctx, client, current)
+		if !errors.Is(err, ErrNoECSTask) {
+			return target, err
+		}
+		tflog.Info(ctx, "Waiting for a task matching the ECS target to run", map[string]interface{}{
+			"poll_interval": interval.String(),
+		})
+		if err := sleep(ctx, interval); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrNoECSTask, err)
+		}
+	}
+}
+
+// sessionTarget returns the SSM target of the container in task, which is
+// only reachable once the task runs with the ECS Exec agent started. Without a
+// Container, the first reachable container is used.
+func (t ECSTarget) sessionTarget(task ecstypes.Task) (string, bool) {
+	if aws.ToString(task.LastStatus) != "RUNNING" || !task.EnableExecuteCommand {
+		return "", false
+	}
+	for _, container := range task.Containers {
+		if (t.Container != "" && aws.ToString(container.Name) != t.Container) || aws.ToString(container.RuntimeId) == "" {
+			continue
+		}
+		for _, agent := range container.ManagedAgents {
+			if agent.Name == ecstypes.ManagedAgentNameExecuteCommandAgent && aws.ToString(agent.LastStatus) == "RUNNING" {
+				return ecsSessionTarget(aws.ToString(task.ClusterArn), aws.ToString(task.TaskArn), aws.ToString(container.RuntimeId)), true
+			}
+		}
+	}
+	return "", false
+}
+
+// ecsSessionTarget formats the SSM target of a container, which is made of
+// the cluster name, the task ID and the container runtime ID.
+func ecsSessionTarget(clusterArn, taskArn, runtimeID string) string {
+	return fmt.Sprintf("%s%s_%s_%s", ecsTargetPrefix, lastSegment(clusterArn), lastSegment(taskArn), runtimeID)
+}
+
+// lastSegment returns what follows the last / of an ARN, such as the name of
+// a cluster or the ID of a task.
+func lastSegment(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
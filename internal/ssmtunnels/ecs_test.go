@@ -0,0 +1,163 @@
+package ssmtunnels_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+)
+
+// newServiceFleet returns a fleet running the tasks of a bastion service,
+// started a minute apart, newest first, along with tasks it should not pick.
+func newServiceFleet() (*ssmtunnelstest.Fleet, []ssmtunnelstest.Task) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	containers := func(id string) map[string]string {
+		return map[string]string{"shell": id + "-shell", "sidecar": id + "-sidecar"}
+	}
+	bastions := []ssmtunnelstest.Task{
+		{Cluster: "apps", ID: "0000000000000002", Family: "bastion", Service: "bastion", StartedAt: started.Add(time.Minute), Containers: containers("2")},
+		{Cluster: "apps", ID: "0000000000000001", Family: "bastion", Service: "bastion", StartedAt: started, Containers: containers("1")},
+	}
+	fleet := ssmtunnelstest.NewFleet()
+	for _, task := range bastions {
+		fleet.AddTask(task)
+	}
+	fleet.AddTask(ssmtunnelstest.Task{Cluster: "apps", ID: "000000000000noexec", Family: "bastion", Service: "bastion", StartedAt: started.Add(-time.Minute), ExecDisabled: true, Containers: containers("noexec")})
+	fleet.AddTask(ssmtunnelstest.Task{Cluster: "apps", ID: "0000000000stopped", Family: "bastion", Service: "bastion", StartedAt: started.Add(-time.Minute), LastStatus: "STOPPED", Containers: containers("stopped")})
+	fleet.AddTask(ssmtunnelstest.Task{Cluster: "apps", ID: "00000000000000web", Family: "web", Service: "web", StartedAt: started.Add(-time.Minute), Containers: containers("web")})
+	fleet.AddTask(ssmtunnelstest.Task{Cluster: "jobs", ID: "0000000000000job", Family: "bastion", StartedAt: started.Add(-time.Minute), Containers: containers("job")})
+	return fleet, bastions
+}
+
+func TestECSTargetCandidates(t *testing.T) {
+	fleet, bastions := newServiceFleet()
+	newest, oldest := bastions[0], bastions[1]
+
+	tests := map[string]struct {
+		target ssmtunnels.ECSTarget
+		want   []string
+	}{
+		"service": {
+			target: ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "shell"},
+			want:   []string{oldest.Target("shell"), newest.Target("shell")},
+		},
+		"family": {
+			target: ssmtunnels.ECSTarget{Cluster: "apps", Family: "bastion", Container: "sidecar"},
+			want:   []string{oldest.Target("sidecar"), newest.Target("sidecar")},
+		},
+		"unknown container": {
+			target: ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "db"},
+		},
+		"other cluster": {
+			target: ssmtunnels.ECSTarget{Cluster: "batch", Family: "bastion", Container: "shell"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			candidates, err := test.target.Candidates(t.Context(), fleet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(candidates, test.want) {
+				t.Errorf("got candidates %v, want %v", candidates, test.want)
+			}
+		})
+	}
+}
+
+func TestECSTargetResolve(t *testing.T) {
+	fleet, bastions := newServiceFleet()
+	newest, oldest := bastions[0], bastions[1]
+	server := newFleetServer(t, fleet)
+	ecsTarget := ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "shell"}
+
+	target, err := ecsTarget.Resolve(t.Context(), server.ECSClient(), "")
+	if err != nil || target != oldest.Target("shell") {
+		t.Fatalf("got target %q and error %v, want the oldest task", target, err)
+	}
+	// The current target is kept while its task runs, so tunnels do not move
+	target, err = ecsTarget.Resolve(t.Context(), server.ECSClient(), newest.Target("shell"))
+	if err != nil || target != newest.Target("shell") {
+		t.Errorf("got target %q and error %v, want the current task", target, err)
+	}
+
+	fleet.SetTaskStatus(newest.ID, "STOPPED")
+	target, err = ecsTarget.Resolve(t.Context(), server.ECSClient(), newest.Target("shell"))
+	if err != nil || target != oldest.Target("shell") {
+		t.Errorf("got target %q and error %v, want the stopped task replaced", target, err)
+	}
+
+	fleet.SetTaskStatus(oldest.ID, "STOPPED")
+	if _, err := ecsTarget.Resolve(t.Context(), server.ECSClient(), ""); !errors.Is(err, ssmtunnels.ErrNoECSTask) {
+		t.Errorf("got %v, want ErrNoECSTask", err)
+	}
+}
+
+func TestECSTargetWaitResolve(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet()
+	ecsTarget := ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "shell"}
+
+	// The service is still deploying its first task
+	task := ssmtunnelstest.Task{Cluster: "apps", ID: "0000000000000001", Service: "bastion", Containers: map[string]string{"shell": "1-shell"}}
+	time.AfterFunc(200*time.Millisecond, func() {
+		fleet.AddTask(task)
+	})
+	target, err := ecsTarget.WaitResolve(t.Context(), fleet, "", 20*time.Millisecond)
+	if err != nil || target != task.Target("shell") {
+		t.Fatalf("got target %q and error %v, want the task once running", target, err)
+	}
+
+	fleet.SetTaskStatus(task.ID, "STOPPED")
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := ecsTarget.WaitResolve(ctx, fleet, "", 20*time.Millisecond); !errors.Is(err, ssmtunnels.ErrNoECSTask) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrNoECSTask once the deadline is exceeded", err)
+	}
+}
+
+func TestECSTargetValidate(t *testing.T) {
+	tests := map[string]struct {
+		target ssmtunnels.ECSTarget
+		valid  bool
+	}{
+		"service":              {target: ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "shell"}, valid: true},
+		"family":               {target: ssmtunnels.ECSTarget{Cluster: "apps", Family: "bastion", Container: "shell"}, valid: true},
+		"no cluster":           {target: ssmtunnels.ECSTarget{Service: "bastion", Container: "shell"}},
+		"no container":         {target: ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion"}},
+		"service and family":   {target: ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Family: "bastion", Container: "shell"}},
+		"no service or family": {target: ssmtunnels.ECSTarget{Cluster: "apps", Container: "shell"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := test.target.Validate(); (err == nil) != test.valid {
+				t.Errorf("got %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestRemoteTunnelECSTarget(t *testing.T) {
+	fleet, _ := newServiceFleet()
+	server := newFleetServer(t, fleet)
+	echo := newEchoServer(t)
+
+	target, err := ssmtunnels.ECSTarget{Cluster: "apps", Service: "bastion", Container: "shell"}.Resolve(t.Context(), server.ECSClient(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ssmtunnels.IsECSTask(target) {
+		t.Fatalf("resolved target %s is not an ECS task", target)
+	}
+	cfg := echoConfig(t, server.Client(), echo)
+	cfg.Target = target
+	tunnel := startTunnel(t, cfg)
+	roundTrip(t, tunnel, "hello")
+
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].Target != target {
+		t.Errorf("got sessions %+v, want one on %s", sessions, target)
+	}
+}
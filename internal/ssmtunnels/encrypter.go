@@ -0,0 +1,112 @@
+package ssmtunnels
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/session-manager-plugin/src/encryption"
+	"github.com/aws/session-manager-plugin/src/log"
+)
+
+const (
+	// dataKeySize is the size of the data key generated by KMS, split into
+	// the decryption and the encryption key.
+	dataKeySize = 64
+
+	// generateDataKeyTimeout bounds the GenerateDataKey call made during the
+	// handshake, which has no context of its own.
+	generateDataKeyTimeout = 30 * time.Second
+)
+
+// kmsEncrypter encrypts the payloads of sessions encrypted with KMS. It works
+// like the session-manager-plugin's encryption.Encrypter, which only takes a
+// KMS client of the AWS SDK v1 built from the default credential chain.
+type kmsEncrypter struct {
+	cipherTextKey  []byte
+	encryptionAEAD cipher.AEAD
+	decryptionAEAD cipher.AEAD
+}
+
+var _ encryption.IEncrypter = (*kmsEncrypter)(nil)
+
+// newKMSEncrypter generates the data key of the session with the KMS key
+// keyID. The first half of the key decrypts what the agent sends, the second
+// half encrypts what is sent to it.
+func newKMSEncrypter(ctx context.Context, client KMSClient, keyID, sessionID, targetID string) (*kmsEncrypter, error) {
+	if client == nil {
+		return nil, fmt.Errorf("the session is encrypted with KMS, but no KMS client is configured")
+	}
+	output, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:         aws.String(keyID),
+		NumberOfBytes: aws.Int32(dataKeySize),
+		EncryptionContext: map[string]string{
+			"aws:ssm:SessionId": sessionID,
+			"aws:ssm:TargetId":  targetID,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating data key from KMS: %w", err)
+	}
+	if len(output.Plaintext) != dataKeySize {
+		return nil, fmt.Errorf("got a data key of %d bytes from KMS, want %d", len(output.Plaintext), dataKeySize)
+	}
+
+	decryptionKey, err := newAEAD(output.Plaintext[:dataKeySize/2])
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey, err := newAEAD(output.Plaintext[dataKeySize/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &kmsEncrypter{
+		cipherTextKey:  output.CiphertextBlob,
+		encryptionAEAD: encryptionKey,
+		decryptionAEAD: decryptionKey,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// GetEncryptedDataKey returns the data key encrypted by KMS, sent to the agent.
+func (e *kmsEncrypter) GetEncryptedDataKey() []byte {
+	return e.cipherTextKey
+}
+
+// Encrypt encrypts plainText, prefixed with the random nonce it used.
+func (e *kmsEncrypter) Encrypt(_ log.T, plainText []byte) ([]byte, error) {
+	nonce := make([]byte, e.encryptionAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return e.encryptionAEAD.Seal(nonce, nonce, plainText, nil), nil
+}
+
+// Decrypt decrypts cipherText prefixed with its nonce.
+func (e *kmsEncrypter) Decrypt(_ log.T, cipherText []byte) ([]byte, error) {
+	nonceSize := e.decryptionAEAD.NonceSize()
+	if len(cipherText) < nonceSize {
+		return nil, fmt.Errorf("encrypted payload of %d bytes is too short", len(cipherText))
+	}
+	plainText, err := e.decryptionAEAD.Open(nil, cipherText[:nonceSize], cipherText[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting payload: %w", err)
+	}
+	return plainText, nil
+}
@@ -0,0 +1,126 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/session-manager-plugin/src/log"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// PluginLogSubsystem is the tflog subsystem the session-manager-plugin code
+// logs to. Its level can be set with TF_LOG_PROVIDER_SSM_PLUGIN.
+const PluginLogSubsystem = "ssm-plugin"
+
+// tflogWriter is an io.Writer that sends every line written to it to the
+// ssm-plugin tflog subsystem at a fixed level.
+type tflogWriter struct {
+	ctx context.Context
+	log func(ctx context.Context, subsystem string, msg string, additionalFields ...map[string]interface{})
+}
+
+func (w tflogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.log(w.ctx, PluginLogSubsystem, line)
+	}
+	return len(p), nil
+}
+
+// pluginLogger implements the session-manager-plugin's logger interface on
+// top of tflog. The plugin's own logger writes to stdout, which Terraform uses
+// for the plugin handshake, and to log files under the home directory.
+type pluginLogger struct {
+	trace io.Writer
+	debug io.Writer
+	info  io.Writer
+	warn  io.Writer
+	err   io.Writer
+
+	context []string
+}
+
+var _ log.T = (*pluginLogger)(nil)
+
+// newPluginLogger returns a plugin logger writing to the ssm-plugin subsystem
+// of the logger in ctx.
+func newPluginLogger(ctx context.Context) *pluginLogger {
+	ctx = tflog.NewSubsystem(ctx, PluginLogSubsystem)
+	return &pluginLogger{
+		trace: tflogWriter{ctx: ctx, log: tflog.SubsystemTrace},
+		debug: tflogWriter{ctx: ctx, log: tflog.SubsystemDebug},
+		info:  tflogWriter{ctx: ctx, log: tflog.SubsystemInfo},
+		warn:  tflogWriter{ctx: ctx, log: tflog.SubsystemWarn},
+		err:   tflogWriter{ctx: ctx, log: tflog.SubsystemError},
+	}
+}
+
+func (l *pluginLogger) write(w io.Writer, msg string) string {
+	if len(l.context) > 0 {
+		msg = strings.Join(l.context, " ") + " " + msg
+	}
+	_, _ = io.WriteString(w, msg)
+	return msg
+}
+
+func (l *pluginLogger) Tracef(format string, params ...interface{}) {
+	l.write(l.trace, fmt.Sprintf(format, params...))
+}
+
+func (l *pluginLogger) Debugf(format string, params ...interface{}) {
+	l.write(l.debug, fmt.Sprintf(format, params...))
+}
+
+func (l *pluginLogger) Infof(format string, params ...interface{}) {
+	l.write(l.info, fmt.Sprintf(format, params...))
+}
+
+func (l *pluginLogger) Warnf(format string, params ...interface{}) error {
+	return errors.New(l.write(l.warn, fmt.Sprintf(format, params...)))
+}
+
+func (l *pluginLogger) Errorf(format string, params ...interface{}) error {
+	return errors.New(l.write(l.err, fmt.Sprintf(format, params...)))
+}
+
+func (l *pluginLogger) Criticalf(format string, params ...interface{}) error {
+	return errors.New(l.write(l.err, fmt.Sprintf(format, params...)))
+}
+
+func (l *pluginLogger) Trace(v ...interface{}) {
+	l.write(l.trace, fmt.Sprint(v...))
+}
+
+func (l *pluginLogger) Debug(v ...interface{}) {
+	l.write(l.debug, fmt.Sprint(v...))
+}
+
+func (l *pluginLogger) Info(v ...interface{}) {
+	l.write(l.info, fmt.Sprint(v...))
+}
+
+func (l *pluginLogger) Warn(v ...interface{}) error {
+	return errors.New(l.write(l.warn, fmt.Sprint(v...)))
+}
+
+func (l *pluginLogger) Error(v ...interface{}) error {
+	return errors.New(l.write(l.err, fmt.Sprint(v...)))
+}
+
+func (l *pluginLogger) Critical(v ...interface{}) error {
+	return errors.New(l.write(l.err, fmt.Sprint(v...)))
+}
+
+// Flush does nothing as messages are not buffered.
+func (l *pluginLogger) Flush() {}
+
+// Close does nothing as messages are not buffered.
+func (l *pluginLogger) Close() {}
+
+func (l *pluginLogger) WithContext(context ...string) log.T {
+	child := *l
+	child.context = append(append([]string(nil), l.context...), context...)
+	return &child
+}
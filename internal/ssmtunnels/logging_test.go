@@ -0,0 +1,55 @@
+package ssmtunnels
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-log/tflogtest"
+)
+
+func TestPluginLoggerLevels(t *testing.T) {
+	// Every level is logged, whatever the environment sets
+	t.Setenv("TF_LOG_PROVIDER_SSM_PLUGIN", "TRACE")
+	var output bytes.Buffer
+	logger := newPluginLogger(tflogtest.RootLogger(context.Background(), &output))
+
+	logger.Tracef("trace %d", 1)
+	logger.Debug("debug ", 2)
+	logger.Infof("info %d", 3)
+	if err := logger.Warnf("warn %d", 4); err == nil || err.Error() != "warn 4" {
+		t.Errorf("got error %v from Warnf, want the message", err)
+	}
+	_ = logger.Error("error ", 5)
+	_ = logger.Criticalf("critical %d", 6)
+	logger.WithContext("[DataChannel]").Infof("first line\nsecond line")
+
+	entries, err := tflogtest.MultilineJSONDecode(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		level   string
+		message string
+	}{
+		{"trace", "trace 1"},
+		{"debug", "debug 2"},
+		{"info", "info 3"},
+		{"warn", "warn 4"},
+		{"error", "error 5"},
+		{"error", "critical 6"},
+		{"info", "[DataChannel] first line"},
+		{"info", "second line"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d log entries, want %d: %v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry["@module"] != "provider."+PluginLogSubsystem {
+			t.Errorf("entry %d was logged to %v, want the %s subsystem", i, entry["@module"], PluginLogSubsystem)
+		}
+		if entry["@level"] != want[i].level || entry["@message"] != want[i].message {
+			t.Errorf("got entry %d %v %q, want %s %q", i, entry["@level"], entry["@message"], want[i].level, want[i].message)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package ssmtunnels
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/aws/session-manager-plugin/src/config"
+	"github.com/aws/session-manager-plugin/src/message"
+	"github.com/aws/session-manager-plugin/src/version"
+	"github.com/xtaci/smux"
+)
+
+// portForwarder carries local client connections over a data channel.
+type portForwarder interface {
+	// serve forwards the connection until either side closes it.
+	serve(conn net.Conn)
+	close()
+}
+
+// newPortForwarder picks the forwarding mode the agent supports, the same way
+// the session-manager-plugin does.
+func newPortForwarder(dc *dataChannel) (portForwarder, error) {
+	dc.mu.Lock()
+	agentVersion := dc.agentVersion
+	dc.mu.Unlock()
+
+	if version.DoesAgentSupportTCPMultiplexing(dc.log, agentVersion) {
+		return newMuxPortForwarder(dc, agentVersion)
+	}
+	return newBasicPortForwarder(dc), nil
+}
+
+// muxPortForwarder multiplexes any number of client connections over the data
+// channel using smux.
+type muxPortForwarder struct {
+	dc      *dataChannel
+	pipe    net.Conn
+	session *smux.Session
+}
+
+func newMuxPortForwarder(dc *dataChannel, agentVersion string) (*muxPortForwarder, error) {
+	local, remote := net.Pipe()
+
+	smuxConfig := smux.DefaultConfig()
+	if version.DoesAgentSupportDisableSmuxKeepAlive(dc.log, agentVersion) {
+		// Disable smux KeepAlive or else it breaks Session Manager idle timeout.
+		smuxConfig.KeepAliveDisabled = true
+	}
+	session, err := smux.Client(local, smuxConfig)
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+
+	f := &muxPortForwarder{
+		dc:      dc,
+		pipe:    remote,
+		session: session,
+	}
+	dc.setOutputHandler(func(payload []byte) error {
+		_, err := f.pipe.Write(payload)
+		return err
+	})
+	go f.transferToDataChannel()
+	return f, nil
+}
+
+// transferToDataChannel sends everything smux writes over the data channel.
+func (f *muxPortForwarder) transferToDataChannel() {
+	buf := make([]byte, config.StreamDataPayloadSize)
+	for {
+		n, err := f.pipe.Read(buf)
+		if err != nil {
+			return
+		}
+		if err := f.dc.sendInput(message.Output, buf[:n]); err != nil {
+			f.dc.log.Debugf("Failed to send packet on data channel: %v", err)
+			f.close()
+			return
+		}
+	}
+}
+
+func (f *muxPortForwarder) serve(conn net.Conn) {
+	stream, err := f.session.OpenStream()
+	if err != nil {
+		f.dc.log.Debugf("Failed to open stream for %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	pipeConnections(stream, conn)
+}
+
+func (f *muxPortForwarder) close() {
+	f.session.Close()
+	f.pipe.Close()
+}
+
+// basicPortForwarder is used with agents that do not support multiplexing.
+// Those agents handle a single client connection at a time.
+type basicPortForwarder struct {
+	dc *dataChannel
+
+	serveMu sync.Mutex // Held while a client connection is being served
+
+	mu     sync.Mutex
+	stream net.Conn
+}
+
+func newBasicPortForwarder(dc *dataChannel) *basicPortForwarder {
+	f := &basicPortForwarder{dc: dc}
+	dc.setOutputHandler(func(payload []byte) error {
+		f.mu.Lock()
+		stream := f.stream
+		f.mu.Unlock()
+		if stream == nil {
+			return nil
+		}
+		if _, err := stream.Write(payload); err != nil {
+			dc.log.Debugf("Failed to write to client connection: %v", err)
+		}
+		return nil
+	})
+	return f
+}
+
+func (f *basicPortForwarder) serve(conn net.Conn) {
+	f.serveMu.Lock()
+	defer f.serveMu.Unlock()
+
+	f.mu.Lock()
+	f.stream = conn
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.stream = nil
+		f.mu.Unlock()
+		conn.Close()
+	}()
+
+	buf := make([]byte, config.StreamDataPayloadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// Let the agent know so it closes its connection to the remote port too.
+			if err := f.dc.sendFlag(message.DisconnectToPort); err != nil {
+				f.dc.log.Debugf("Failed to send DisconnectToPort flag: %v", err)
+			}
+			return
+		}
+		if err := f.dc.sendInput(message.Output, buf[:n]); err != nil {
+			f.dc.log.Debugf("Failed to send packet on data channel: %v", err)
+			return
+		}
+	}
+}
+
+func (f *basicPortForwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stream != nil {
+		f.stream.Close()
+	}
+}
+
+// pipeConnections copies data in both directions until one side is done.
+func pipeConnections(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyAndClose := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		dst.Close()
+	}
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
@@ -2,85 +2,556 @@ package ssmtunnels
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"net"
+	"slices"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	pluginSession "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session"
-	_ "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session/portsession"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/session-manager-plugin/src/log"
+	"github.com/aws/session-manager-plugin/src/message"
+	"github.com/aws/smithy-go"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
+const (
+	// terminateTimeout bounds the TerminateSession call made while shutting
+	// down, when the tunnel's own context is already canceled.
+	terminateTimeout = 10 * time.Second
+
+	// resumeMaxAttempts and restartMaxAttempts bound how often a lost session
+	// is resumed, and then replaced with a new one, before the tunnel gives up.
+	resumeMaxAttempts  = 3
+	restartMaxAttempts = 5
+
+	reconnectInitialDelay = time.Second
+	reconnectMaxDelay     = 30 * time.Second
+)
+
+// errSessionExpired is returned when ResumeSession reports that the session
+// timed out, so only a new session can replace it.
+var errSessionExpired = errors.New("session expired")
+
 type RemoteTunnelConfig struct {
-	Client     *ssm.Client
-	Target     string
-	Region     string
+	Client SSMClient
+	Target string
+	// FailoverTargets are tried in order after Target when a session can not
+	// be started on it, both when the tunnel starts and when its session is
+	// lost.
+	FailoverTargets []string
+	Region          string
+	// KMSClient generates the data key of sessions encrypted with KMS, as
+	// enabled in the Session Manager preferences.
+	KMSClient KMSClient
+	// DocumentName is the Session Manager document starting the session.
+	// Defaults to DocumentPortForwardingToRemoteHost when RemoteHost is set,
+	// and to DocumentPortForwarding otherwise.
+	DocumentName string
+	// DocumentParameters are passed to custom documents, along with
+	// portNumber and host when the document declares them and they are not
+	// set here.
+	DocumentParameters map[string][]string
+	// RemoteHost is the host to forward to. Not used with DocumentPortForwarding.
 	RemoteHost string
 	RemotePort int
 	LocalPort  int
+	// Listener, when set, is listened on instead of binding LocalPort. The
+	// tunnel takes it over and closes it.
+	Listener net.Listener
 }
 
-func StartRemoteTunnel(ctx context.Context, cfg RemoteTunnelConfig) error {
+// startSessionInput validates the config and builds the StartSession request.
+// Custom documents are described, to know which parameters they take.
+func (cfg RemoteTunnelConfig) startSessionInput(ctx context.Context) (*ssm.StartSessionInput, error) {
 	if cfg.Target == "" {
-		return fmt.Errorf("target must be set")
+		return nil, fmt.Errorf("target must be set")
 	}
-	if cfg.Region == "" {
-		return fmt.Errorf("region must be set")
+	if slices.Contains(cfg.FailoverTargets, "") {
+		return nil, fmt.Errorf("failover targets can not be empty")
 	}
-	if cfg.RemoteHost == "" {
-		return fmt.Errorf("remoteHost must be set")
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("region must be set")
 	}
 	if cfg.RemotePort == 0 {
-		return fmt.Errorf("remotePort must be set")
+		return nil, fmt.Errorf("remotePort must be set")
 	}
 	if cfg.LocalPort == 0 {
-		return fmt.Errorf("localPort must be set")
-	}
-
-	startSessionInput := ssm.StartSessionInput{
-		Target:       &cfg.Target,
-		DocumentName: aws.String("AWS-StartPortForwardingSessionToRemoteHost"),
-		Parameters: map[string][]string{
-			"host": {
-				cfg.RemoteHost,
-			},
-			"portNumber": {
-				strconv.Itoa(cfg.RemotePort),
-			},
-			"localPortNumber": {
-				strconv.Itoa(cfg.LocalPort),
-			},
-		},
-	}
-
-	startSessionOutput, err := cfg.Client.StartSession(ctx, &startSessionInput)
+		return nil, fmt.Errorf("localPort must be set")
+	}
+
+	var document *ssmtypes.DocumentDescription
+	if name := cfg.SessionDocumentName(); !IsAWSDocument(name) {
+		var err error
+		document, err = DescribeSessionDocument(ctx, cfg.Client, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	documentName, parameters, err := cfg.SessionDocument(document)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	startSessionOuputJson, err := json.Marshal(startSessionOutput)
+	return &ssm.StartSessionInput{
+		Target:       aws.String(cfg.Target),
+		DocumentName: aws.String(documentName),
+		Parameters:   parameters,
+	}, nil
+}
+
+// targets returns Target followed by the failover targets.
+func (cfg RemoteTunnelConfig) targets() []string {
+	return append([]string{cfg.Target}, cfg.FailoverTargets...)
+}
+
+// isTargetUnavailable reports whether StartSession failed because of the
+// target, so another target may succeed. InvalidTarget is not modeled for
+// StartSession, so errors are matched by code.
+func isTargetUnavailable(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case (&ssmtypes.TargetNotConnected{}).ErrorCode(), (&ssmtypes.InvalidTarget{}).ErrorCode():
+		return true
+	}
+	return false
+}
+
+// startSessionOnTargets starts a session on the first available target,
+// beginning with the one at index from and wrapping around. It returns the
+// index of the target the session runs on.
+func startSessionOnTargets(ctx context.Context, cfg RemoteTunnelConfig, input *ssm.StartSessionInput, from int) (*ssm.StartSessionOutput, int, error) {
+	targets := cfg.targets()
+	var errs error
+	for i := range targets {
+		index := (from + i) % len(targets)
+		targetInput := *input
+		targetInput.Target = aws.String(targets[index])
+		output, err := cfg.Client.StartSession(ctx, &targetInput)
+		if err == nil {
+			return output, index, nil
+		}
+		if len(targets) == 1 || !isTargetUnavailable(err) {
+			return nil, index, err
+		}
+
+		errs = errors.Join(errs, fmt.Errorf("%s: %w", targets[index], err))
+		if i < len(targets)-1 {
+			tflog.Warn(ctx, "Target unavailable, failing over to the next target", map[string]interface{}{
+				"target":      targets[index],
+				"next_target": targets[(index+1)%len(targets)],
+				"error":       err.Error(),
+			})
+		}
+	}
+	return nil, from, fmt.Errorf("no target is available: %w", errs)
+}
+
+// StartRemoteTunnel starts an SSM port forwarding session, binds the local
+// listener and returns while the data channel is being set up in the
+// background. The tunnel runs until ctx is canceled, Close is called or the
+// session ends; it then closes the listener, tears down the data channel and
+// terminates the session.
+func StartRemoteTunnel(ctx context.Context, cfg RemoteTunnelConfig) (*Tunnel, error) {
+	listener := cfg.Listener
+	startSessionInput, err := cfg.startSessionInput(ctx)
 	if err != nil {
+		closeListener(listener)
+		return nil, err
+	}
+
+	startSessionOutput, targetIndex, err := startSessionOnTargets(ctx, cfg, startSessionInput, 0)
+	if err != nil {
+		closeListener(listener)
+		return nil, err
+	}
+	sessionID := aws.ToString(startSessionOutput.SessionId)
+	logger := newPluginLogger(ctx)
+
+	if listener == nil {
+		listener, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.LocalPort)))
+		if err != nil {
+			terminateSession(ctx, cfg.Client, logger, sessionID)
+			return nil, err
+		}
+	}
+	logger.Infof("Port %s opened for sessionId %s.", listener.Addr(), sessionID)
+
+	ctx, cancel := context.WithCancel(ctx)
+	tunnel := &Tunnel{
+		sessionID: sessionID,
+		localAddr: listener.Addr(),
+		cancel:    cancel,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	tunnel.touch()
+	runner := &tunnelRunner{
+		tunnel:       tunnel,
+		cfg:          cfg,
+		logger:       logger,
+		startSession: startSessionInput,
+		targetIndex:  targetIndex,
+		accepted:     make(chan net.Conn),
+		acceptErr:    make(chan error, 1),
+	}
+	go func() {
+		defer close(tunnel.done)
+		defer tunnel.setState(TunnelClosed)
+		defer listener.Close()
+		defer cancel()
+
+		go runner.accept(ctx, listener)
+		tunnel.err = runner.run(ctx, startSessionOutput)
+	}()
+
+	return tunnel, nil
+}
+
+// closeListener closes a listener the tunnel was given but did not start on.
+func closeListener(listener net.Listener) {
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// tunnelRunner keeps an SSM session attached to the tunnel's listener for the
+// whole lifetime of the tunnel.
+type tunnelRunner struct {
+	tunnel       *Tunnel
+	cfg          RemoteTunnelConfig
+	logger       log.T
+	startSession *ssm.StartSessionInput
+	// targetIndex is the index in cfg.targets() of the target sessions are
+	// started on.
+	targetIndex int
+
+	accepted  chan net.Conn
+	acceptErr chan error
+}
+
+// session is one SSM session serving the tunnel's listener.
+type session struct {
+	id        string
+	dc        *dataChannel
+	forwarder portForwarder
+	conns     connSet
+}
+
+// accept hands connections from the listener to the current session. The
+// listener stays open while the tunnel reconnects, so clients only need to
+// reconnect themselves.
+func (r *tunnelRunner) accept(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			r.acceptErr <- err
+			return
+		}
+		select {
+		case r.accepted <- conn:
+		case <-ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+// run serves the first session and replaces it whenever it is lost, until ctx
+// is canceled or reconnecting fails.
+func (r *tunnelRunner) run(ctx context.Context, output *ssm.StartSessionOutput) error {
+	s, err := r.connect(ctx, output)
+	if err != nil {
+		r.terminate(ctx, aws.ToString(output.SessionId))
+		if ctx.Err() != nil {
+			return nil
+		}
 		return err
 	}
+	r.tunnel.setState(TunnelReady)
+	close(r.tunnel.ready)
+
+	for {
+		err := r.serve(ctx, s)
+		closeErr := r.closeSession(ctx, s)
+		if ctx.Err() != nil {
+			return closeErr
+		}
+		var acceptErr *acceptError
+		if errors.As(err, &acceptErr) {
+			return err
+		}
+
+		r.tunnel.setState(TunnelDegraded)
+		tflog.Warn(ctx, "SSM session lost, starting a new session", map[string]interface{}{
+			"session_id": s.id,
+			"error":      err.Error(),
+		})
+		if s, err = r.restart(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		r.tunnel.setState(TunnelReady)
+	}
+}
 
-	// TODO: Add a way to terminate the session
-	// cfg.Client.TerminateSession()
+// connect opens the data channel of a started session and waits for the
+// agent to complete the handshake.
+func (r *tunnelRunner) connect(ctx context.Context, output *ssm.StartSessionOutput) (*session, error) {
+	target := r.cfg.targets()[r.targetIndex]
+	s := &session{
+		id: aws.ToString(output.SessionId),
+		dc: newDataChannel(r.logger, r.cfg.KMSClient, aws.ToString(output.SessionId), target),
+	}
+	if err := s.dc.open(ctx, aws.ToString(output.StreamUrl), aws.ToString(output.TokenValue)); err != nil {
+		return nil, err
+	}
+	if err := s.dc.waitForHandshake(ctx); err != nil {
+		s.dc.close()
+		return nil, err
+	}
 
-	args := []string{
-		"session-manager-plugin",
-		string(startSessionOuputJson),
-		cfg.Region,
-		"StartSession",
-		"",
-		fmt.Sprintf("{\"Target\": \"%s\"}", cfg.Target),
-		fmt.Sprintf("https://ssm.%s.amazonaws.com", cfg.Region),
+	s.dc.setFlagHandler(func(flag message.PayloadTypeFlag) {
+		if flag == message.ConnectToPortError {
+			r.logger.Errorf("Connection to destination port failed, check SSM Agent logs.")
+			r.tunnel.connectErrors.Add(1)
+			r.tunnel.setState(TunnelDegraded)
+		}
+	})
+	forwarder, err := newPortForwarder(s.dc)
+	if err != nil {
+		s.dc.close()
+		return nil, err
 	}
+	s.forwarder = forwarder
+	r.tunnel.setSession(s.id, target)
+	return s, nil
+}
+
+// serve forwards accepted connections over the session until ctx is canceled
+// or the session is lost for good. Dropped websocket connections are resumed
+// in place, which keeps client connections alive.
+func (r *tunnelRunner) serve(ctx context.Context, s *session) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-r.acceptErr:
+			return &acceptError{err: err}
+		case conn := <-r.accepted:
+			conn = r.tunnel.countConn(conn)
+			s.conns.add(conn)
+			go func() {
+				s.forwarder.serve(conn)
+				s.conns.remove(conn)
+				r.tunnel.connClosed()
+			}()
+		case err := <-s.dc.Lost():
+			if resumeErr := r.resume(ctx, s, err); resumeErr != nil {
+				return resumeErr
+			}
+		case <-s.dc.Done():
+			if err := s.dc.Err(); err != nil {
+				return err
+			}
+			return errChannelClosed
+		}
+	}
+}
 
-	// TODO: Run this in a cancelable goroutine
+// resume reattaches the data channel to the existing session with ResumeSession.
+func (r *tunnelRunner) resume(ctx context.Context, s *session, cause error) error {
+	r.tunnel.setState(TunnelDegraded)
+	tflog.Warn(ctx, "SSM data channel lost, resuming session", map[string]interface{}{
+		"session_id": s.id,
+		"error":      cause.Error(),
+	})
 
-	pluginSession.ValidateInputAndStartSession(args, os.Stdout)
+	err := retryWithBackoff(ctx, resumeMaxAttempts, func(attempt int) error {
+		output, err := r.cfg.Client.ResumeSession(ctx, &ssm.ResumeSessionInput{
+			SessionId: aws.String(s.id),
+		})
+		if err != nil {
+			tflog.Debug(ctx, "ResumeSession failed", map[string]interface{}{
+				"session_id": s.id,
+				"attempt":    attempt,
+				"error":      err.Error(),
+			})
+			return err
+		}
+		if aws.ToString(output.TokenValue) == "" {
+			// The session timed out on the service side and cannot be resumed.
+			return errSessionExpired
+		}
+		return s.dc.reconnect(ctx, aws.ToString(output.StreamUrl), aws.ToString(output.TokenValue))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to resume session %s: %w", s.id, err)
+	}
 
+	r.tunnel.setState(TunnelReady)
+	tflog.Info(ctx, "Resumed SSM session", map[string]interface{}{
+		"session_id": s.id,
+	})
 	return nil
 }
+
+// restart starts a new session to replace one that could not be resumed. It
+// starts on the current target, and fails over to the next ones when the
+// current target is unavailable or its session can not be connected.
+func (r *tunnelRunner) restart(ctx context.Context) (*session, error) {
+	targets := r.cfg.targets()
+	previous := targets[r.targetIndex]
+
+	var s *session
+	err := retryWithBackoff(ctx, restartMaxAttempts, func(attempt int) error {
+		tflog.Info(ctx, "Starting new SSM session", map[string]interface{}{
+			"target":  targets[r.targetIndex],
+			"attempt": attempt,
+		})
+		output, index, err := startSessionOnTargets(ctx, r.cfg, r.startSession, r.targetIndex)
+		if err != nil {
+			tflog.Warn(ctx, "StartSession failed", map[string]interface{}{
+				"attempt": attempt,
+				"error":   err.Error(),
+			})
+			return err
+		}
+		r.targetIndex = index
+		if s, err = r.connect(ctx, output); err != nil {
+			tflog.Warn(ctx, "Failed to connect new SSM session", map[string]interface{}{
+				"session_id": aws.ToString(output.SessionId),
+				"attempt":    attempt,
+				"error":      err.Error(),
+			})
+			r.terminate(ctx, aws.ToString(output.SessionId))
+			// The agent of this target may be gone before SSM noticed
+			r.targetIndex = (index + 1) % len(targets)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		tflog.Error(ctx, "Giving up reconnecting tunnel", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return nil, err
+	}
+
+	tflog.Info(ctx, "Reconnected tunnel with a new SSM session", map[string]interface{}{
+		"session_id": s.id,
+	})
+	if target := targets[r.targetIndex]; target != previous {
+		tflog.Warn(ctx, "Tunnel failed over to another target", map[string]interface{}{
+			"previous_target": previous,
+			"target":          target,
+			"session_id":      s.id,
+		})
+	}
+	return s, nil
+}
+
+// closeSession drops the session's client connections, tears down its data
+// channel and terminates it.
+func (r *tunnelRunner) closeSession(ctx context.Context, s *session) error {
+	s.conns.closeAll()
+	s.forwarder.close()
+	s.dc.close()
+	return r.terminate(ctx, s.id)
+}
+
+// terminate calls ssm:TerminateSession so the session does not linger on the
+// AWS side until it times out.
+func (r *tunnelRunner) terminate(ctx context.Context, sessionID string) error {
+	return terminateSession(ctx, r.cfg.Client, r.logger, sessionID)
+}
+
+func terminateSession(ctx context.Context, client SSMClient, logger log.T, sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), terminateTimeout)
+	defer cancel()
+
+	if _, err := client.TerminateSession(ctx, &ssm.TerminateSessionInput{
+		SessionId: aws.String(sessionID),
+	}); err != nil {
+		logger.Errorf("Terminate Session %s failed: %v", sessionID, err)
+		return fmt.Errorf("failed to terminate session %s: %w", sessionID, err)
+	}
+	return nil
+}
+
+// retryWithBackoff calls fn until it succeeds, ctx is done or maxAttempts is
+// reached, doubling the delay between attempts.
+func retryWithBackoff(ctx context.Context, maxAttempts int, fn func(attempt int) error) error {
+	delay := reconnectInitialDelay
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(attempt); err == nil || errors.Is(err, errSessionExpired) {
+			return err
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+	return err
+}
+
+// acceptError wraps a failure of the local listener, which ends the tunnel
+// instead of triggering a reconnect.
+type acceptError struct {
+	err error
+}
+
+func (e *acceptError) Error() string {
+	return fmt.Sprintf("failed to accept connection: %s", e.err)
+}
+
+func (e *acceptError) Unwrap() error {
+	return e.err
+}
+
+// connSet tracks the client connections served by a session.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (c *connSet) add(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[net.Conn]struct{})
+	}
+	c.conns[conn] = struct{}{}
+}
+
+func (c *connSet) remove(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, conn)
+}
+
+func (c *connSet) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
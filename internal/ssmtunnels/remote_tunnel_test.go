@@ -0,0 +1,474 @@
+package ssmtunnels_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+)
+
+const testTarget = "i-0123456789abcdef0"
+
+// newServer starts a stand-in SSM service stopped when the test ends.
+func newServer(t *testing.T) *ssmtunnelstest.Server {
+	t.Helper()
+	server := ssmtunnelstest.NewServer()
+	server.Logf = t.Logf
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newEchoServer starts an echo server closed when the test ends.
+func newEchoServer(t *testing.T) *ssmtunnelstest.EchoServer {
+	t.Helper()
+	echo, err := ssmtunnelstest.NewEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = echo.Close()
+	})
+	return echo
+}
+
+// startTunnel starts a tunnel with cfg and waits for it to be ready. It is
+// closed when the test ends.
+func startTunnel(t *testing.T, cfg ssmtunnels.RemoteTunnelConfig) *ssmtunnels.Tunnel {
+	t.Helper()
+	tunnel, err := ssmtunnels.StartRemoteTunnel(t.Context(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = tunnel.Close()
+	})
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	if err := tunnel.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return tunnel
+}
+
+// echoConfig returns the config of a tunnel to echo through the test target,
+// on an open local port.
+func echoConfig(t *testing.T, client ssmtunnels.SSMClient, echo *ssmtunnelstest.EchoServer) ssmtunnels.RemoteTunnelConfig {
+	t.Helper()
+	return ssmtunnels.RemoteTunnelConfig{
+		Client:     client,
+		Target:     testTarget,
+		Region:     "us-east-1",
+		RemoteHost: echo.Host(),
+		RemotePort: echo.Port(),
+		LocalPort:  openPort(t),
+	}
+}
+
+// openPort returns a local port nothing listens on.
+func openPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listenerPort(t, listener)
+}
+
+func listenerPort(t *testing.T, listener net.Listener) int {
+	t.Helper()
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("unexpected listener address %s", listener.Addr())
+	}
+	return addr.Port
+}
+
+// roundTrip sends message through the tunnel and checks it is echoed back.
+func roundTrip(t *testing.T, tunnel *ssmtunnels.Tunnel, message string) {
+	t.Helper()
+	if err := tryRoundTrip(tunnel, message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tryRoundTrip(tunnel *ssmtunnels.Tunnel, message string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.LocalPort())), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return err
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if string(reply) != message {
+		return errors.New("got " + strconv.Quote(string(reply)) + " back, want " + strconv.Quote(message))
+	}
+	return nil
+}
+
+func TestRemoteTunnelForwards(t *testing.T) {
+	server := newServer(t)
+	echo := newEchoServer(t)
+
+	tunnel := startTunnel(t, echoConfig(t, server.Client(), echo))
+	roundTrip(t, tunnel, "hello")
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if sessions[0].Target != testTarget || sessions[0].DocumentName != ssmtunnels.DocumentPortForwardingToRemoteHost {
+		t.Errorf("got session %+v", sessions[0])
+	}
+	if tunnel.SessionID() != sessions[0].ID {
+		t.Errorf("got session ID %s, want %s", tunnel.SessionID(), sessions[0].ID)
+	}
+}
+
+func TestRemoteTunnelForwardsConcurrentConnections(t *testing.T) {
+	server := newServer(t)
+	echo := newEchoServer(t)
+	tunnel := startTunnel(t, echoConfig(t, server.Client(), echo))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Go(func() {
+			errs[i] = tryRoundTrip(tunnel, "connection "+strconv.Itoa(i))
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	stats := tunnel.Stats()
+	if stats.Connections != 10 {
+		t.Errorf("got %d connections, want 10", stats.Connections)
+	}
+}
+
+func TestRemoteTunnelBasicAgent(t *testing.T) {
+	server := newServer(t)
+	server.AgentVersion = ssmtunnelstest.BasicAgentVersion
+	echo := newEchoServer(t)
+
+	tunnel := startTunnel(t, echoConfig(t, server.Client(), echo))
+	roundTrip(t, tunnel, "first")
+	roundTrip(t, tunnel, "second")
+}
+
+func TestRemoteTunnelEncryptedWithKMS(t *testing.T) {
+	server := newServer(t)
+	server.KMSKeyID = "alias/session-manager"
+	echo := newEchoServer(t)
+
+	cfg := echoConfig(t, server.Client(), echo)
+	cfg.KMSClient = server.KMSClient()
+	tunnel := startTunnel(t, cfg)
+	roundTrip(t, tunnel, "first")
+	roundTrip(t, tunnel, "second")
+
+	keys := server.DataKeys()
+	if len(keys) != 1 {
+		t.Fatalf("got %d data keys, want 1", len(keys))
+	}
+	want := map[string]string{"aws:ssm:SessionId": tunnel.SessionID(), "aws:ssm:TargetId": testTarget}
+	if keys[0].KeyID != server.KMSKeyID || !maps.Equal(keys[0].EncryptionContext, want) {
+		t.Errorf("got data key %+v", keys[0])
+	}
+}
+
+func TestRemoteTunnelCloseTerminatesSession(t *testing.T) {
+	server := newServer(t)
+	echo := newEchoServer(t)
+
+	tunnel := startTunnel(t, echoConfig(t, server.Client(), echo))
+	if err := tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if active := server.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v were not terminated", active)
+	}
+	if err := tryRoundTrip(tunnel, "closed"); err == nil {
+		t.Error("closed tunnel still forwards")
+	}
+}
+
+func TestRemoteTunnelResumesDroppedConnection(t *testing.T) {
+	server := newServer(t)
+	echo := newEchoServer(t)
+	tunnel := startTunnel(t, echoConfig(t, server.Client(), echo))
+	roundTrip(t, tunnel, "before")
+
+	server.DropConnections()
+	eventually(t, func() error {
+		return tryRoundTrip(tunnel, "after")
+	})
+
+	if sessions := server.Sessions(); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want the session to be resumed", len(sessions))
+	}
+}
+
+func TestRemoteTunnelRestartsExpiredSession(t *testing.T) {
+	server := newServer(t)
+	echo := newEchoServer(t)
+	tunnel := startTunnel(t, echoConfig(t, server.Client(), echo))
+	port := tunnel.LocalPort()
+
+	server.ExpireSession(tunnel.SessionID())
+	eventually(t, func() error {
+		if len(server.ActiveSessions()) != 1 {
+			return errors.New("no new session")
+		}
+		return tryRoundTrip(tunnel, "after")
+	})
+
+	if sessions := server.Sessions(); len(sessions) != 2 {
+		t.Errorf("got %d sessions, want a new one", len(sessions))
+	}
+	if tunnel.LocalPort() != port {
+		t.Errorf("local port changed from %d to %d", port, tunnel.LocalPort())
+	}
+}
+
+func TestRemoteTunnelTakesOverListener(t *testing.T) {
+	server := newServer(t)
+	echo := newEchoServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := echoConfig(t, server.Client(), echo)
+	cfg.Listener = listener
+	cfg.LocalPort = listenerPort(t, listener)
+	tunnel := startTunnel(t, cfg)
+	if tunnel.LocalAddr().String() != listener.Addr().String() {
+		t.Errorf("tunnel listens on %s, want %s", tunnel.LocalAddr(), listener.Addr())
+	}
+	roundTrip(t, tunnel, "hello")
+
+	if err := tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Error("listener was not closed with the tunnel")
+	}
+}
+
+func TestStartRemoteTunnelFailure(t *testing.T) {
+	client := ssmtunnelstest.NewFakeSSMClient("ws://127.0.0.1:1")
+	client.StartSessionErr = errors.New("access denied")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssmtunnels.RemoteTunnelConfig{
+		Client:     client,
+		Target:     testTarget,
+		Region:     "us-east-1",
+		RemoteHost: "127.0.0.1",
+		RemotePort: 5432,
+		LocalPort:  listenerPort(t, listener),
+		Listener:   listener,
+	}
+	if _, err := ssmtunnels.StartRemoteTunnel(t.Context(), cfg); err == nil {
+		t.Fatal("tunnel started without a session")
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Error("listener was not closed")
+	}
+}
+
+// eventually retries check until it succeeds, failing the test after a while.
+func eventually(t *testing.T, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRemoteTunnelWithFakeClient(t *testing.T) {
+	// Nothing serves the data channel, so the tunnel never gets ready
+	client := ssmtunnelstest.NewFakeSSMClient("ws://127.0.0.1:1")
+	cfg := ssmtunnels.RemoteTunnelConfig{
+		Client:     client,
+		Target:     testTarget,
+		Region:     "us-east-1",
+		RemoteHost: "db.internal",
+		RemotePort: 5432,
+		LocalPort:  openPort(t),
+	}
+	tunnel, err := ssmtunnels.StartRemoteTunnel(t.Context(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := client.StartedSessions()
+	if len(started) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(started))
+	}
+	input := started[0]
+	if *input.Target != testTarget || *input.DocumentName != ssmtunnels.DocumentPortForwardingToRemoteHost {
+		t.Errorf("got target %s and document %s", *input.Target, *input.DocumentName)
+	}
+	if host := input.Parameters["host"]; len(host) != 1 || host[0] != "db.internal" {
+		t.Errorf("got host parameter %v", host)
+	}
+	if port := input.Parameters["portNumber"]; len(port) != 1 || port[0] != "5432" {
+		t.Errorf("got portNumber parameter %v", port)
+	}
+
+	_ = tunnel.Close()
+	if terminated := client.TerminatedSessions(); len(terminated) != 1 || terminated[0] != tunnel.SessionID() {
+		t.Errorf("got terminated sessions %v, want %s", terminated, tunnel.SessionID())
+	}
+	if active := client.ActiveSessions(); len(active) != 0 {
+		t.Errorf("sessions %v are still active", active)
+	}
+}
+
+func TestRemoteTunnelCustomDocument(t *testing.T) {
+	server := newServer(t)
+	// The document forwards to a port of the target, and takes no host
+	server.AddDocument(ssmtunnelstest.SessionDocument("MyOrg-PortForwarding", map[string]*string{
+		"portNumber":   nil,
+		"changeTicket": nil,
+	}))
+	echo := newEchoServer(t)
+
+	cfg := echoConfig(t, server.Client(), echo)
+	cfg.DocumentName = "MyOrg-PortForwarding"
+	cfg.DocumentParameters = map[string][]string{"changeTicket": {"OPS-1234"}}
+	tunnel := startTunnel(t, cfg)
+	roundTrip(t, tunnel, "hello")
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].DocumentName != "MyOrg-PortForwarding" {
+		t.Fatalf("got sessions %+v", sessions)
+	}
+}
+
+func TestRemoteTunnelFailsOver(t *testing.T) {
+	tests := map[string]ssmtunnelstest.Instance{
+		"target not connected": {ID: testTarget, PingStatus: ssmtypes.PingStatusConnectionLost},
+		"invalid target":       {ID: testTarget, State: ec2types.InstanceStateNameTerminated},
+	}
+	for name, unavailable := range tests {
+		t.Run(name, func(t *testing.T) {
+			fleet := ssmtunnelstest.NewFleet(unavailable, ssmtunnelstest.Instance{ID: "i-0fedcba9876543210"})
+			server := newFleetServer(t, fleet)
+			echo := newEchoServer(t)
+
+			cfg := echoConfig(t, server.Client(), echo)
+			cfg.FailoverTargets = []string{"i-0fedcba9876543210"}
+			tunnel := startTunnel(t, cfg)
+			roundTrip(t, tunnel, "hello")
+
+			if tunnel.Target() != "i-0fedcba9876543210" {
+				t.Errorf("tunnel runs on %s, want the failover target", tunnel.Target())
+			}
+			if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].Target != "i-0fedcba9876543210" {
+				t.Errorf("got sessions %+v, want one on the failover target", sessions)
+			}
+		})
+	}
+}
+
+func TestRemoteTunnelNoTargetAvailable(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(
+		ssmtunnelstest.Instance{ID: testTarget, PingStatus: ssmtypes.PingStatusConnectionLost},
+		ssmtunnelstest.Instance{ID: "i-0fedcba9876543210", PingStatus: ssmtypes.PingStatusConnectionLost},
+	)
+	server := newFleetServer(t, fleet)
+
+	cfg := echoConfig(t, server.Client(), newEchoServer(t))
+	cfg.FailoverTargets = []string{"i-0fedcba9876543210"}
+	_, err := ssmtunnels.StartRemoteTunnel(t.Context(), cfg)
+	if err == nil {
+		t.Fatal("tunnel started without an available target")
+	}
+	for _, target := range []string{testTarget, "i-0fedcba9876543210"} {
+		if !strings.Contains(err.Error(), target) {
+			t.Errorf("error %q does not report target %s", err, target)
+		}
+	}
+}
+
+func TestRemoteTunnelDoesNotFailOverOtherErrors(t *testing.T) {
+	client := ssmtunnelstest.NewFakeSSMClient("ws://127.0.0.1:1")
+	client.StartSessionErr = errors.New("access denied")
+
+	cfg := ssmtunnels.RemoteTunnelConfig{
+		Client:          client,
+		Target:          testTarget,
+		FailoverTargets: []string{"i-0fedcba9876543210"},
+		Region:          "us-east-1",
+		RemoteHost:      "db.internal",
+		RemotePort:      5432,
+		LocalPort:       openPort(t),
+	}
+	if _, err := ssmtunnels.StartRemoteTunnel(t.Context(), cfg); err == nil {
+		t.Fatal("tunnel started without a session")
+	}
+	if started := client.StartedSessions(); len(started) != 1 {
+		t.Errorf("got %d StartSession calls, want the failover target not to be tried", len(started))
+	}
+}
+
+func TestRemoteTunnelFailsOverLostSession(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(
+		ssmtunnelstest.Instance{ID: testTarget},
+		ssmtunnelstest.Instance{ID: "i-0fedcba9876543210"},
+	)
+	server := newFleetServer(t, fleet)
+	echo := newEchoServer(t)
+
+	cfg := echoConfig(t, server.Client(), echo)
+	cfg.FailoverTargets = []string{"i-0fedcba9876543210"}
+	tunnel := startTunnel(t, cfg)
+	if tunnel.Target() != testTarget {
+		t.Fatalf("tunnel runs on %s, want the first target", tunnel.Target())
+	}
+
+	// The target goes away along with its session
+	fleet.SetPingStatus(testTarget, ssmtypes.PingStatusConnectionLost)
+	server.ExpireSession(tunnel.SessionID())
+	eventually(t, func() error {
+		if tunnel.Target() != "i-0fedcba9876543210" {
+			return errors.New("tunnel did not fail over")
+		}
+		return tryRoundTrip(tunnel, "after")
+	})
+}
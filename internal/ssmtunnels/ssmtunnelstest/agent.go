@@ -0,0 +1,685 @@
+package ssmtunnelstest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/session-manager-plugin/src/config"
+	"github.com/aws/session-manager-plugin/src/log"
+	"github.com/aws/session-manager-plugin/src/message"
+	"github.com/aws/session-manager-plugin/src/version"
+	"github.com/gorilla/websocket"
+	twinjuuid "github.com/twinj/uuid"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// resendInterval is how long the agent waits for an acknowledgement
+	// before it sends a stream message again.
+	resendInterval = time.Second
+	dialTimeout    = 5 * time.Second
+)
+
+// sentMessage is a stream message the client did not acknowledge yet.
+type sentMessage struct {
+	content        []byte
+	sequenceNumber int64
+	lastSent       time.Time
+}
+
+// agentSession is the agent side of a port forwarding session. It outlives
+// data channel connections, so sessions can be resumed.
+type agentSession struct {
+	id           string
+	target       string
+	documentName string
+	parameters   map[string][]string
+	remoteAddr   string
+	agentVersion string
+	// kmsKeyID, when set, encrypts the session with a data key the client
+	// generates, looked up with dataKey.
+	kmsKeyID string
+	dataKey  func(cipherText []byte) []byte
+	log      log.T
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex // Guards conn and serializes websocket writes
+	sendMu  sync.Mutex // Keeps stream messages in sequence order on the wire
+
+	mu            sync.Mutex
+	tokens        []string
+	terminated    bool
+	handshakeSent bool
+	streamSeq     int64
+	expectedSeq   int64
+	outgoing      []*sentMessage
+	incoming      map[int64]message.ClientMessage
+	forwarder     agentForwarder
+	// cipher encrypts the payloads once the client sent the data key.
+	cipher *agentCipher
+	// challenge is sent to the client to check it encrypts with the data key.
+	challenge []byte
+	done      chan struct{}
+}
+
+func (a *agentSession) describe() Session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return Session{
+		ID:           a.id,
+		Target:       a.target,
+		DocumentName: a.documentName,
+		Parameters:   maps.Clone(a.parameters),
+		Terminated:   a.terminated,
+	}
+}
+
+// newToken issues a token for connecting to the data channel. It returns an
+// empty string once the session is terminated.
+func (a *agentSession) newToken() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.terminated {
+		return ""
+	}
+	token := a.id + "-token-" + strconv.Itoa(len(a.tokens)+1)
+	a.tokens = append(a.tokens, token)
+	return token
+}
+
+func (a *agentSession) validToken(token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return !a.terminated && slices.Contains(a.tokens, token)
+}
+
+// attach makes conn the data channel connection of the session and serves it
+// until it is closed. Messages that were not acknowledged on a previous
+// connection are sent again.
+func (a *agentSession) attach(conn *websocket.Conn) {
+	a.writeMu.Lock()
+	previous := a.conn
+	a.conn = conn
+	a.writeMu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	a.mu.Lock()
+	sendHandshake := !a.handshakeSent
+	a.handshakeSent = true
+	pending := slices.Clone(a.outgoing)
+	a.mu.Unlock()
+
+	for _, msg := range pending {
+		a.write(msg.content)
+	}
+	if sendHandshake {
+		a.sendHandshakeRequest()
+	}
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		a.handleMessage(raw)
+	}
+}
+
+func (a *agentSession) dropConnection() {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn = nil
+	}
+}
+
+// terminate ends the session, telling the client with a channel_closed message.
+func (a *agentSession) terminate(output string) {
+	a.mu.Lock()
+	if a.terminated {
+		a.mu.Unlock()
+		return
+	}
+	a.terminated = true
+	forwarder := a.forwarder
+	a.mu.Unlock()
+
+	close(a.done)
+	if forwarder != nil {
+		forwarder.close()
+	}
+
+	payload, err := json.Marshal(message.ChannelClosed{
+		MessageId:     twinjuuid.NewV4().String(),
+		CreatedDate:   time.Now().UTC().Format(time.RFC3339),
+		SessionId:     a.id,
+		MessageType:   message.ChannelClosedMessage,
+		SchemaVersion: 1,
+		Output:        output,
+	})
+	if err == nil {
+		msg := message.ClientMessage{
+			MessageType:   message.ChannelClosedMessage,
+			SchemaVersion: 1,
+			CreatedDate:   uint64(time.Now().UnixMilli()),
+			MessageId:     twinjuuid.NewV4(),
+			PayloadType:   uint32(message.Output),
+			Payload:       payload,
+		}
+		if content, err := msg.SerializeClientMessage(a.log); err == nil {
+			a.write(content)
+		}
+	}
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if a.conn != nil {
+		_ = a.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		a.conn.Close()
+		a.conn = nil
+	}
+}
+
+// write sends a message on the current connection. Messages written while
+// the client is disconnected are lost; stream messages are resent later.
+func (a *agentSession) write(content []byte) {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	if a.conn == nil {
+		return
+	}
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, content); err != nil {
+		a.log.Debugf("Failed to write to data channel: %v", err)
+	}
+}
+
+func (a *agentSession) resendLoop() {
+	ticker := time.NewTicker(resendInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		var pending []*sentMessage
+		a.mu.Lock()
+		for _, msg := range a.outgoing {
+			if time.Since(msg.lastSent) > resendInterval {
+				msg.lastSent = time.Now()
+				pending = append(pending, msg)
+			}
+		}
+		a.mu.Unlock()
+		for _, msg := range pending {
+			a.write(msg.content)
+		}
+	}
+}
+
+func (a *agentSession) handleMessage(raw []byte) {
+	msg := &message.ClientMessage{}
+	if err := msg.DeserializeClientMessage(a.log, raw); err != nil {
+		a.log.Errorf("Cannot deserialize raw message: %v", err)
+		return
+	}
+	if err := msg.Validate(); err != nil {
+		a.log.Errorf("Invalid message received: %v", err)
+		return
+	}
+
+	switch msg.MessageType {
+	case message.AcknowledgeMessage:
+		ack, err := msg.DeserializeDataStreamAcknowledgeContent(a.log)
+		if err != nil {
+			a.log.Errorf("Cannot deserialize acknowledge message: %v", err)
+			return
+		}
+		a.mu.Lock()
+		a.outgoing = slices.DeleteFunc(a.outgoing, func(sent *sentMessage) bool {
+			return sent.sequenceNumber == ack.SequenceNumber
+		})
+		a.mu.Unlock()
+	case message.InputStreamMessage:
+		a.handleInputMessage(*msg)
+	default:
+		a.log.Warnf("Unexpected message type received: %s", msg.MessageType)
+	}
+}
+
+// handleInputMessage acknowledges stream messages and processes them in
+// sequence order.
+func (a *agentSession) handleInputMessage(msg message.ClientMessage) {
+	// message.SerializeClientMessageWithAcknowledgeContent switches the global
+	// UUID format on every call, which races with the client
+	content, err := message.SerializeClientMessagePayload(a.log, message.AcknowledgeContent{
+		MessageType:         msg.MessageType,
+		MessageId:           msg.MessageId.String(),
+		SequenceNumber:      msg.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	if err == nil {
+		ack := message.ClientMessage{
+			MessageType:   message.AcknowledgeMessage,
+			SchemaVersion: 1,
+			CreatedDate:   uint64(time.Now().UnixMilli()),
+			Flags:         3,
+			MessageId:     twinjuuid.NewV4(),
+			Payload:       content,
+		}
+		if reply, err := ack.SerializeClientMessage(a.log); err == nil {
+			a.write(reply)
+		}
+	}
+
+	a.mu.Lock()
+	if msg.SequenceNumber != a.expectedSeq {
+		if msg.SequenceNumber > a.expectedSeq {
+			a.incoming[msg.SequenceNumber] = msg
+		}
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+
+	for {
+		a.processPayload(msg)
+
+		a.mu.Lock()
+		a.expectedSeq++
+		next, ok := a.incoming[a.expectedSeq]
+		delete(a.incoming, a.expectedSeq)
+		a.mu.Unlock()
+		if !ok {
+			return
+		}
+		msg = next
+	}
+}
+
+func (a *agentSession) processPayload(msg message.ClientMessage) {
+	a.mu.Lock()
+	forwarder := a.forwarder
+	agentCipher := a.cipher
+	a.mu.Unlock()
+
+	switch message.PayloadType(msg.PayloadType) {
+	case message.HandshakeResponsePayloadType:
+		var response message.HandshakeResponsePayload
+		if err := json.Unmarshal(msg.Payload, &response); err != nil {
+			a.log.Errorf("Cannot deserialize handshake response: %v", err)
+			return
+		}
+		if a.kmsKeyID != "" {
+			a.sendEncryptionChallenge(response)
+			return
+		}
+		a.completeHandshake()
+	case message.EncChallengeResponse:
+		var response message.EncryptionChallengeResponse
+		if err := json.Unmarshal(msg.Payload, &response); err != nil {
+			a.log.Errorf("Cannot deserialize encryption challenge response: %v", err)
+			return
+		}
+		a.mu.Lock()
+		challenge := a.challenge
+		a.mu.Unlock()
+		if agentCipher == nil {
+			return
+		}
+		if decrypted, err := agentCipher.decrypt(response.Challenge); err != nil || !bytes.Equal(decrypted, challenge) {
+			a.terminate("Encryption challenge failed.")
+			return
+		}
+		a.completeHandshake()
+	case message.Output:
+		payload := msg.Payload
+		if agentCipher != nil {
+			var err error
+			if payload, err = agentCipher.decrypt(payload); err != nil {
+				a.log.Errorf("Cannot decrypt payload: %v", err)
+				return
+			}
+		}
+		if forwarder != nil {
+			forwarder.input(payload)
+		}
+	case message.Flag:
+		var flag message.PayloadTypeFlag
+		if err := binary.Read(bytes.NewReader(msg.Payload), binary.BigEndian, &flag); err != nil {
+			return
+		}
+		switch flag {
+		case message.DisconnectToPort:
+			if forwarder != nil {
+				forwarder.disconnect()
+			}
+		case message.TerminateSession:
+			a.terminate("Session terminated by the client.")
+		}
+	}
+}
+
+// completeHandshake starts forwarding and tells the client.
+func (a *agentSession) completeHandshake() {
+	a.mu.Lock()
+	if a.forwarder == nil {
+		a.forwarder = a.newForwarder()
+	}
+	a.mu.Unlock()
+	payload, err := json.Marshal(message.HandshakeCompletePayload{})
+	if err != nil {
+		return
+	}
+	a.send(message.HandshakeCompletePayloadType, payload)
+}
+
+// sendEncryptionChallenge sets up encryption with the data key in response,
+// and sends the client a challenge to encrypt back with it.
+func (a *agentSession) sendEncryptionChallenge(response message.HandshakeResponsePayload) {
+	var encryptionResponse message.KMSEncryptionResponse
+	for _, action := range response.ProcessedClientActions {
+		if action.ActionType != message.KMSEncryption || action.ActionStatus != message.Success {
+			continue
+		}
+		// ActionResult was decoded as a map
+		result, err := json.Marshal(action.ActionResult)
+		if err == nil {
+			err = json.Unmarshal(result, &encryptionResponse)
+		}
+		if err != nil {
+			a.log.Errorf("Cannot deserialize KMS encryption response: %v", err)
+		}
+	}
+	agentCipher, err := newAgentCipher(a.dataKey(encryptionResponse.KMSCipherTextKey))
+	if err != nil {
+		a.terminate("KMS encryption could not be set up.")
+		return
+	}
+
+	challenge := make([]byte, 64)
+	if _, err := rand.Read(challenge); err != nil {
+		return
+	}
+	encrypted, err := agentCipher.encrypt(challenge)
+	if err != nil {
+		return
+	}
+	payload, err := json.Marshal(message.EncryptionChallengeRequest{Challenge: encrypted})
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	a.cipher = agentCipher
+	a.challenge = challenge
+	a.mu.Unlock()
+	a.send(message.EncChallengeRequest, payload)
+}
+
+func (a *agentSession) sendHandshakeRequest() {
+	_, portNumber, _ := net.SplitHostPort(a.remoteAddr)
+	sessionType, err := json.Marshal(map[string]interface{}{
+		"SessionType": config.PortPluginName,
+		"Properties": map[string]string{
+			"portNumber": portNumber,
+		},
+	})
+	if err != nil {
+		return
+	}
+	request := message.HandshakeRequestPayload{
+		AgentVersion: a.agentVersion,
+		RequestedClientActions: []message.RequestedClientAction{
+			{
+				ActionType:       message.SessionType,
+				ActionParameters: sessionType,
+			},
+		},
+	}
+	if a.kmsKeyID != "" {
+		kmsEncryption, err := json.Marshal(message.KMSEncryptionRequest{KMSKeyID: a.kmsKeyID})
+		if err != nil {
+			return
+		}
+		request.RequestedClientActions = append(request.RequestedClientActions, message.RequestedClientAction{
+			ActionType:       message.KMSEncryption,
+			ActionParameters: kmsEncryption,
+		})
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	a.send(message.HandshakeRequestPayloadType, payload)
+}
+
+func (a *agentSession) sendFlag(flag message.PayloadTypeFlag) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, flag); err != nil {
+		return
+	}
+	a.send(message.Flag, buf.Bytes())
+}
+
+// send sends a stream message and keeps it until the client acknowledges it.
+func (a *agentSession) send(payloadType message.PayloadType, payload []byte) {
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+
+	a.mu.Lock()
+	if a.cipher != nil && payloadType == message.Output {
+		var err error
+		if payload, err = a.cipher.encrypt(payload); err != nil {
+			a.mu.Unlock()
+			a.log.Errorf("Cannot encrypt payload: %v", err)
+			return
+		}
+	}
+	msg := message.ClientMessage{
+		MessageType:    message.OutputStreamMessage,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixMilli()),
+		MessageId:      twinjuuid.NewV4(),
+		PayloadType:    uint32(payloadType),
+		Payload:        payload,
+		SequenceNumber: a.streamSeq,
+	}
+	content, err := msg.SerializeClientMessage(a.log)
+	if err != nil {
+		a.mu.Unlock()
+		a.log.Errorf("Cannot serialize stream data message: %v", err)
+		return
+	}
+	a.outgoing = append(a.outgoing, &sentMessage{
+		content:        content,
+		sequenceNumber: a.streamSeq,
+		lastSent:       time.Now(),
+	})
+	a.streamSeq++
+	a.mu.Unlock()
+
+	a.write(content)
+}
+
+// agentForwarder connects the data channel to the remote port.
+type agentForwarder interface {
+	// input handles a payload sent by the client.
+	input(payload []byte)
+	// disconnect closes the connection to the remote port, if any.
+	disconnect()
+	close()
+}
+
+// newForwarder picks the forwarding mode matching the agent version, the
+// same way the client does.
+func (a *agentSession) newForwarder() agentForwarder {
+	if version.DoesAgentSupportTCPMultiplexing(a.log, a.agentVersion) {
+		forwarder, err := newMuxForwarder(a)
+		if err == nil {
+			return forwarder
+		}
+		a.log.Errorf("Failed to set up multiplexing: %v", err)
+	}
+	return &basicForwarder{session: a}
+}
+
+// muxForwarder accepts the smux streams opened by the client, and connects
+// each of them to the remote port.
+type muxForwarder struct {
+	session *agentSession
+	pipe    net.Conn
+	smux    *smux.Session
+}
+
+func newMuxForwarder(a *agentSession) (*muxForwarder, error) {
+	local, remote := net.Pipe()
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.KeepAliveDisabled = version.DoesAgentSupportDisableSmuxKeepAlive(a.log, a.agentVersion)
+	session, err := smux.Server(local, smuxConfig)
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+
+	f := &muxForwarder{
+		session: a,
+		pipe:    remote,
+		smux:    session,
+	}
+	go f.transferToDataChannel()
+	go f.acceptStreams()
+	return f, nil
+}
+
+func (f *muxForwarder) transferToDataChannel() {
+	buf := make([]byte, config.StreamDataPayloadSize)
+	for {
+		n, err := f.pipe.Read(buf)
+		if err != nil {
+			return
+		}
+		f.session.send(message.Output, buf[:n])
+	}
+}
+
+func (f *muxForwarder) acceptStreams() {
+	for {
+		stream, err := f.smux.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, err := net.DialTimeout("tcp", f.session.remoteAddr, dialTimeout)
+			if err != nil {
+				f.session.log.Debugf("Failed to connect to %s: %v", f.session.remoteAddr, err)
+				f.session.sendFlag(message.ConnectToPortError)
+				stream.Close()
+				return
+			}
+			pipeConnections(stream, conn)
+		}()
+	}
+}
+
+func (f *muxForwarder) input(payload []byte) {
+	_, _ = f.pipe.Write(payload)
+}
+
+// disconnect does nothing, as streams are closed through smux.
+func (f *muxForwarder) disconnect() {}
+
+func (f *muxForwarder) close() {
+	f.smux.Close()
+	f.pipe.Close()
+}
+
+// basicForwarder forwards a single connection at a time. It connects to the
+// remote port when the client sends data, and disconnects when the client
+// sends the DisconnectToPort flag.
+type basicForwarder struct {
+	session *agentSession
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (f *basicForwarder) input(payload []byte) {
+	f.mu.Lock()
+	conn := f.conn
+	if conn == nil {
+		var err error
+		conn, err = net.DialTimeout("tcp", f.session.remoteAddr, dialTimeout)
+		if err != nil {
+			f.mu.Unlock()
+			f.session.log.Debugf("Failed to connect to %s: %v", f.session.remoteAddr, err)
+			f.session.sendFlag(message.ConnectToPortError)
+			return
+		}
+		f.conn = conn
+		go f.transferToDataChannel(conn)
+	}
+	f.mu.Unlock()
+
+	if _, err := conn.Write(payload); err != nil {
+		f.session.log.Debugf("Failed to write to %s: %v", f.session.remoteAddr, err)
+	}
+}
+
+func (f *basicForwarder) transferToDataChannel(conn net.Conn) {
+	buf := make([]byte, config.StreamDataPayloadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		f.session.send(message.Output, buf[:n])
+	}
+
+	f.mu.Lock()
+	if f.conn == conn {
+		f.conn = nil
+	}
+	f.mu.Unlock()
+	conn.Close()
+}
+
+func (f *basicForwarder) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func (f *basicForwarder) close() {
+	f.disconnect()
+}
+
+// pipeConnections copies data in both directions until one side is done.
+func pipeConnections(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyAndClose := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		dst.Close()
+	}
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,201 @@
+// Package ssmtunnelstest provides fakes for testing code that runs tunnels
+// with the ssmtunnels package, without AWS.
+package ssmtunnelstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// ErrSessionNotFound is returned when terminating a session the fake does not know.
+var ErrSessionNotFound = errors.New("session not found")
+
+// FakeSSMClient is an in-memory ssmtunnels.SSMClient. It hands out session IDs
+// and tokens, and records the calls made to it. Sessions point at StreamURL;
+// unless something serves the data channel there, tunnels fail to connect.
+//
+// The exported fields must be set before the client is used.
+type FakeSSMClient struct {
+	// StreamURL is returned as the stream URL of every session.
+	StreamURL string
+
+	// StartSessionErr, ResumeSessionErr and TerminateSessionErr, when set,
+	// are returned by the corresponding calls.
+	StartSessionErr     error
+	ResumeSessionErr    error
+	TerminateSessionErr error
+
+	// Fleet answers DescribeInstanceInformation, and sessions can only be
+	// started on its online instances. When it is nil, no instances are
+	// described and sessions can be started on any target.
+	Fleet *Fleet
+
+	mu         sync.Mutex
+	documents  documentSet
+	nextID     int
+	active     map[string]bool
+	started    []ssm.StartSessionInput
+	resumed    []string
+	terminated []string
+}
+
+var _ ssmtunnels.SSMClient = (*FakeSSMClient)(nil)
+
+// NewFakeSSMClient returns a fake whose sessions connect to streamURL.
+func NewFakeSSMClient(streamURL string) *FakeSSMClient {
+	return &FakeSSMClient{
+		StreamURL: streamURL,
+	}
+}
+
+func (c *FakeSSMClient) StartSession(ctx context.Context, params *ssm.StartSessionInput, optFns ...func(*ssm.Options)) (*ssm.StartSessionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.started = append(c.started, *params)
+	if c.StartSessionErr != nil {
+		return nil, c.StartSessionErr
+	}
+	if c.Fleet != nil {
+		if err := c.Fleet.checkTarget(aws.ToString(params.Target)); err != nil {
+			return nil, err
+		}
+	}
+
+	c.nextID++
+	sessionID := fmt.Sprintf("fake-session-%d", c.nextID)
+	if c.active == nil {
+		c.active = make(map[string]bool)
+	}
+	c.active[sessionID] = true
+
+	return &ssm.StartSessionOutput{
+		SessionId:  aws.String(sessionID),
+		StreamUrl:  aws.String(c.StreamURL),
+		TokenValue: aws.String("token-" + sessionID),
+	}, nil
+}
+
+// ResumeSession returns a new token for active sessions. Like SSM, it returns
+// no token for sessions that are no longer active.
+func (c *FakeSSMClient) ResumeSession(ctx context.Context, params *ssm.ResumeSessionInput, optFns ...func(*ssm.Options)) (*ssm.ResumeSessionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sessionID := aws.ToString(params.SessionId)
+	c.resumed = append(c.resumed, sessionID)
+	if c.ResumeSessionErr != nil {
+		return nil, c.ResumeSessionErr
+	}
+
+	output := &ssm.ResumeSessionOutput{
+		SessionId: params.SessionId,
+	}
+	if c.active[sessionID] {
+		output.StreamUrl = aws.String(c.StreamURL)
+		output.TokenValue = aws.String(fmt.Sprintf("token-%s-resumed-%d", sessionID, len(c.resumed)))
+	}
+	return output, nil
+}
+
+func (c *FakeSSMClient) TerminateSession(ctx context.Context, params *ssm.TerminateSessionInput, optFns ...func(*ssm.Options)) (*ssm.TerminateSessionOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sessionID := aws.ToString(params.SessionId)
+	c.terminated = append(c.terminated, sessionID)
+	if c.TerminateSessionErr != nil {
+		return nil, c.TerminateSessionErr
+	}
+	if _, ok := c.active[sessionID]; !ok {
+		return nil, ErrSessionNotFound
+	}
+	c.active[sessionID] = false
+
+	return &ssm.TerminateSessionOutput{
+		SessionId: params.SessionId,
+	}, nil
+}
+
+// AddDocument makes a custom document known to DescribeDocument.
+func (c *FakeSSMClient) AddDocument(document types.DocumentDescription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.documents = c.documents.with(document)
+}
+
+// DescribeDocument describes the documents added with AddDocument and the
+// AWS-owned port forwarding documents.
+func (c *FakeSSMClient) DescribeDocument(ctx context.Context, params *ssm.DescribeDocumentInput, optFns ...func(*ssm.Options)) (*ssm.DescribeDocumentOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	document, ok := c.documents.lookup(aws.ToString(params.Name))
+	if !ok {
+		return nil, &types.InvalidDocument{Message: aws.String("document does not exist")}
+	}
+	return &ssm.DescribeDocumentOutput{
+		Document: &document,
+	}, nil
+}
+
+func (c *FakeSSMClient) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	if c.Fleet == nil {
+		return &ssm.DescribeInstanceInformationOutput{}, nil
+	}
+	return c.Fleet.DescribeInstanceInformation(ctx, params, optFns...)
+}
+
+// ExpireSession marks a session as timed out, so it can no longer be resumed.
+func (c *FakeSSMClient) ExpireSession(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.active[sessionID]; ok {
+		c.active[sessionID] = false
+	}
+}
+
+// StartedSessions returns the inputs of every StartSession call.
+func (c *FakeSSMClient) StartedSessions() []ssm.StartSessionInput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.started)
+}
+
+// ResumedSessions returns the session IDs of every ResumeSession call.
+func (c *FakeSSMClient) ResumedSessions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.resumed)
+}
+
+// TerminatedSessions returns the session IDs of every TerminateSession call.
+func (c *FakeSSMClient) TerminatedSessions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.terminated)
+}
+
+// ActiveSessions returns the IDs of sessions started and not terminated or
+// expired since, in the order they were started.
+func (c *FakeSSMClient) ActiveSessions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sessions []string
+	for i := 1; i <= c.nextID; i++ {
+		sessionID := fmt.Sprintf("fake-session-%d", i)
+		if c.active[sessionID] {
+			sessions = append(sessions, sessionID)
+		}
+	}
+	return sessions
+}
@@ -0,0 +1,64 @@
+package ssmtunnelstest
+
+import (
+	"maps"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// SessionDocument describes a Session Manager document declaring the given
+// parameters. Parameters mapped to nil are required, the others default to
+// the given value.
+func SessionDocument(name string, parameters map[string]*string) types.DocumentDescription {
+	document := types.DocumentDescription{
+		Name:         aws.String(name),
+		DocumentType: types.DocumentTypeSession,
+		Status:       types.DocumentStatusActive,
+	}
+	for name, defaultValue := range parameters {
+		document.Parameters = append(document.Parameters, types.DocumentParameter{
+			Name:         aws.String(name),
+			Type:         types.DocumentParameterTypeString,
+			DefaultValue: defaultValue,
+		})
+	}
+	return document
+}
+
+// awsDocuments returns the AWS-owned port forwarding documents.
+func awsDocuments() map[string]types.DocumentDescription {
+	return map[string]types.DocumentDescription{
+		ssmtunnels.DocumentPortForwardingToRemoteHost: SessionDocument(ssmtunnels.DocumentPortForwardingToRemoteHost, map[string]*string{
+			"host":            aws.String(""),
+			"portNumber":      aws.String("80"),
+			"localPortNumber": aws.String("0"),
+		}),
+		ssmtunnels.DocumentPortForwarding: SessionDocument(ssmtunnels.DocumentPortForwarding, map[string]*string{
+			"portNumber":      aws.String("80"),
+			"localPortNumber": aws.String("0"),
+		}),
+	}
+}
+
+// documentSet holds the documents known to a fake, on top of the AWS-owned ones.
+type documentSet map[string]types.DocumentDescription
+
+func (d documentSet) lookup(name string) (types.DocumentDescription, bool) {
+	if document, ok := d[name]; ok {
+		return document, true
+	}
+	document, ok := awsDocuments()[name]
+	return document, ok
+}
+
+func (d documentSet) with(document types.DocumentDescription) documentSet {
+	documents := maps.Clone(d)
+	if documents == nil {
+		documents = make(documentSet)
+	}
+	documents[aws.ToString(document.Name)] = document
+	return documents
+}
@@ -0,0 +1,86 @@
+package ssmtunnelstest
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// EchoServer is a TCP server on the loopback interface that sends back
+// everything it receives. It stands in for the remote host of a tunnel.
+type EchoServer struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewEchoServer starts an echo server on a random port.
+func NewEchoServer() (*EchoServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &EchoServer{
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Host returns the address the server listens on.
+func (s *EchoServer) Host() string {
+	return "127.0.0.1"
+}
+
+// Port returns the port the server listens on.
+func (s *EchoServer) Port() int {
+	if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Addr returns the host:port the server listens on.
+func (s *EchoServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *EchoServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			_, _ = io.Copy(conn, conn)
+			conn.Close()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the server and closes its open connections.
+func (s *EchoServer) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
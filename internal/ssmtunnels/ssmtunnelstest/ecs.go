@@ -0,0 +1,171 @@
+package ssmtunnelstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// ecsTargetPrefix starts the X-Amz-Target header of ECS API calls.
+const ecsTargetPrefix = "AmazonEC2ContainerServiceV20141113."
+
+// ECSClient returns an ECS client using the server as its endpoint. The tasks
+// of its Fleet are the tasks of the ECS API.
+func (s *Server) ECSClient() *ecs.Client {
+	return ecs.New(ecs.Options{
+		BaseEndpoint: aws.String(s.URL),
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+// handleECS answers the ECS API operation from the Fleet.
+func (s *Server) handleECS(operation string, r *http.Request) (interface{}, error) {
+	if s.Fleet == nil {
+		return nil, &apiError{http.StatusBadRequest, "ClusterNotFoundException", "there is no fleet"}
+	}
+
+	var input struct {
+		Cluster              string `json:"cluster"`
+		ServiceName          string `json:"serviceName"`
+		Family               string `json:"family"`
+		DesiredStatus        string `json:"desiredStatus"`
+		Tasks                []string
+		Task                 string `json:"task"`
+		Reason               string `json:"reason"`
+		TaskDefinition       string `json:"taskDefinition"`
+		EnableExecuteCommand bool   `json:"enableExecuteCommand"`
+		NetworkConfiguration struct {
+			AwsvpcConfiguration struct {
+				Subnets        []string `json:"subnets"`
+				SecurityGroups []string `json:"securityGroups"`
+				AssignPublicIP string   `json:"assignPublicIp"`
+			} `json:"awsvpcConfiguration"`
+		} `json:"networkConfiguration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ClientException", err.Error()}
+	}
+	cluster := aws.String(input.Cluster)
+	if input.Cluster == "" {
+		cluster = aws.String("default")
+	}
+
+	switch operation {
+	case "ListTasks":
+		params := &ecs.ListTasksInput{
+			Cluster:       cluster,
+			DesiredStatus: ecstypes.DesiredStatus(input.DesiredStatus),
+		}
+		if input.ServiceName != "" {
+			params.ServiceName = aws.String(input.ServiceName)
+		}
+		if input.Family != "" {
+			params.Family = aws.String(input.Family)
+		}
+		output, err := s.Fleet.ListTasks(r.Context(), params)
+		if err != nil {
+			return nil, fleetError(err)
+		}
+		return map[string]interface{}{"taskArns": output.TaskArns}, nil
+	case "DescribeTasks":
+		output, err := s.Fleet.DescribeTasks(r.Context(), &ecs.DescribeTasksInput{
+			Cluster: cluster,
+			Tasks:   input.Tasks,
+		})
+		if err != nil {
+			return nil, fleetError(err)
+		}
+		tasks := make([]interface{}, 0, len(output.Tasks))
+		for _, task := range output.Tasks {
+			tasks = append(tasks, encodeTask(task))
+		}
+		failures := make([]interface{}, 0, len(output.Failures))
+		for _, failure := range output.Failures {
+			failures = append(failures, map[string]string{
+				"arn":    aws.ToString(failure.Arn),
+				"reason": aws.ToString(failure.Reason),
+			})
+		}
+		return map[string]interface{}{"tasks": tasks, "failures": failures}, nil
+	case "RunTask":
+		network := input.NetworkConfiguration.AwsvpcConfiguration
+		output, err := s.Fleet.RunTask(r.Context(), &ecs.RunTaskInput{
+			Cluster:              cluster,
+			TaskDefinition:       aws.String(input.TaskDefinition),
+			EnableExecuteCommand: input.EnableExecuteCommand,
+			NetworkConfiguration: &ecstypes.NetworkConfiguration{
+				AwsvpcConfiguration: &ecstypes.AwsVpcConfiguration{
+					Subnets:        network.Subnets,
+					SecurityGroups: network.SecurityGroups,
+					AssignPublicIp: ecstypes.AssignPublicIp(network.AssignPublicIP),
+				},
+			},
+		})
+		if err != nil {
+			return nil, fleetError(err)
+		}
+		tasks := make([]interface{}, 0, len(output.Tasks))
+		for _, task := range output.Tasks {
+			tasks = append(tasks, encodeTask(task))
+		}
+		return map[string]interface{}{"tasks": tasks, "failures": []interface{}{}}, nil
+	case "StopTask":
+		output, err := s.Fleet.StopTask(r.Context(), &ecs.StopTaskInput{
+			Cluster: cluster,
+			Task:    aws.String(input.Task),
+			Reason:  aws.String(input.Reason),
+		})
+		if err != nil {
+			return nil, fleetError(err)
+		}
+		return map[string]interface{}{"task": encodeTask(*output.Task)}, nil
+	}
+	return nil, &apiError{http.StatusBadRequest, "UnknownOperationException", "operation " + operation + " is not supported"}
+}
+
+// encodeTask encodes task as the ECS API does.
+func encodeTask(task ecstypes.Task) map[string]interface{} {
+	containers := make([]interface{}, 0, len(task.Containers))
+	for _, container := range task.Containers {
+		agents := make([]interface{}, 0, len(container.ManagedAgents))
+		for _, agent := range container.ManagedAgents {
+			agents = append(agents, map[string]string{
+				"name":       string(agent.Name),
+				"lastStatus": aws.ToString(agent.LastStatus),
+			})
+		}
+		containers = append(containers, map[string]interface{}{
+			"name":          aws.ToString(container.Name),
+			"runtimeId":     aws.ToString(container.RuntimeId),
+			"managedAgents": agents,
+		})
+	}
+	encoded := map[string]interface{}{
+		"taskArn":              aws.ToString(task.TaskArn),
+		"clusterArn":           aws.ToString(task.ClusterArn),
+		"lastStatus":           aws.ToString(task.LastStatus),
+		"enableExecuteCommand": task.EnableExecuteCommand,
+		"containers":           containers,
+	}
+	if task.StartedAt != nil {
+		encoded["startedAt"] = float64(task.StartedAt.UnixMilli()) / 1000
+	}
+	if task.StoppedReason != nil {
+		encoded["stoppedReason"] = aws.ToString(task.StoppedReason)
+	}
+	return encoded
+}
+
+// fleetError converts the "Code: message" errors of the fleet to API errors.
+func fleetError(err error) error {
+	code, message, ok := strings.Cut(err.Error(), ": ")
+	if !ok {
+		return err
+	}
+	return &apiError{http.StatusBadRequest, code, message}
+}
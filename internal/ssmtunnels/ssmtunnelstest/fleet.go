@@ -0,0 +1,522 @@
+package ssmtunnelstest
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// Instance is a managed instance known to a Fleet.
+type Instance struct {
+	ID string
+	// PingStatus is the status of its SSM agent. Defaults to Online.
+	PingStatus ssmtypes.PingStatus
+	// State is its EC2 state. Defaults to running.
+	State        ec2types.InstanceStateName
+	PlatformType ssmtypes.PlatformType
+	LaunchTime   time.Time
+	Tags         map[string]string
+}
+
+// Task is an ECS task known to a Fleet, in the us-east-1 region.
+type Task struct {
+	Cluster string
+	ID      string
+	Family  string
+	// Service is the service that started the task, if any.
+	Service string
+	// LastStatus is its ECS status. Defaults to RUNNING.
+	LastStatus string
+	// ExecDisabled is set for tasks started without ECS Exec.
+	ExecDisabled bool
+	StartedAt    time.Time
+	// Containers maps the names of its containers to their runtime IDs.
+	Containers map[string]string
+
+	// The network configuration and reason to stop of tasks started by RunTask.
+	Subnets        []string
+	SecurityGroups []string
+	AssignPublicIP bool
+	StoppedReason  string
+}
+
+// Target returns the SSM target of container in the task.
+func (t Task) Target(container string) string {
+	return fmt.Sprintf("ecs:%s_%s_%s", t.Cluster, t.ID, t.Containers[container])
+}
+
+// Fleet is an in-memory set of instances and ECS tasks. It serves as the EC2
+// client for target selection and auto start, as the ECS client, and answers
+// DescribeInstanceInformation for the fakes of the SSM API it is given to.
+// Instances start and stop right away, with their agent going online and
+// offline along.
+type Fleet struct {
+	mu        sync.Mutex
+	instances []Instance
+	tasks     []Task
+	// taskDefinitions maps families to the names of their containers.
+	taskDefinitions map[string][]string
+	nextTaskID      int
+}
+
+var _ ssmtunnels.EC2Client = (*Fleet)(nil)
+var _ ssmtunnels.ECSClient = (*Fleet)(nil)
+
+// NewFleet returns a fleet of the given instances.
+func NewFleet(instances ...Instance) *Fleet {
+	f := &Fleet{}
+	for _, instance := range instances {
+		f.Add(instance)
+	}
+	return f
+}
+
+// Add adds an instance to the fleet, replacing the one with the same ID.
+func (f *Fleet) Add(instance Instance) {
+	if instance.PingStatus == "" {
+		instance.PingStatus = ssmtypes.PingStatusOnline
+	}
+	if instance.State == "" {
+		instance.State = ec2types.InstanceStateNameRunning
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = slices.DeleteFunc(f.instances, func(i Instance) bool {
+		return i.ID == instance.ID
+	})
+	f.instances = append(f.instances, instance)
+}
+
+// AddTask adds a task to the fleet, replacing the one with the same ID.
+func (f *Fleet) AddTask(task Task) {
+	if task.LastStatus == "" {
+		task.LastStatus = "RUNNING"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tasks = slices.DeleteFunc(f.tasks, func(t Task) bool {
+		return t.ID == task.ID
+	})
+	f.tasks = append(f.tasks, task)
+}
+
+// AddTaskDefinition lets RunTask start tasks of family, with the given
+// containers.
+func (f *Fleet) AddTaskDefinition(family string, containers ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.taskDefinitions == nil {
+		f.taskDefinitions = make(map[string][]string)
+	}
+	f.taskDefinitions[family] = containers
+}
+
+// Tasks returns the tasks of the fleet, including the stopped ones.
+func (f *Fleet) Tasks() []Task {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.tasks)
+}
+
+// SetTaskStatus changes the ECS status of a task.
+func (f *Fleet) SetTaskStatus(id, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.tasks {
+		if f.tasks[i].ID == id {
+			f.tasks[i].LastStatus = status
+		}
+	}
+}
+
+// SetPingStatus changes the status of the SSM agent of an instance.
+func (f *Fleet) SetPingStatus(id string, status ssmtypes.PingStatus) {
+	f.update(id, func(instance *Instance) {
+		instance.PingStatus = status
+	})
+}
+
+// SetState changes the EC2 state of an instance.
+func (f *Fleet) SetState(id string, state ec2types.InstanceStateName) {
+	f.update(id, func(instance *Instance) {
+		instance.State = state
+	})
+}
+
+// Instance returns the instance with the given ID.
+func (f *Fleet) Instance(id string) (Instance, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, instance := range f.instances {
+		if instance.ID == id {
+			return instance, true
+		}
+	}
+	return Instance{}, false
+}
+
+func (f *Fleet) update(id string, change func(*Instance)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.instances {
+		if f.instances[i].ID == id {
+			change(&f.instances[i])
+		}
+	}
+}
+
+// checkTarget returns the error StartSession fails with on target: the target
+// is not connected when its agent is not online, and invalid when the fleet
+// does not know it.
+func (f *Fleet) checkTarget(target string) error {
+	if strings.HasPrefix(target, "ecs:") {
+		return f.checkTaskTarget(target)
+	}
+	instance, ok := f.Instance(target)
+	switch {
+	case !ok || instance.State == ec2types.InstanceStateNameTerminated:
+		return &ssmtypes.InvalidTarget{Message: aws.String(fmt.Sprintf("%s is not a valid target", target))}
+	case instance.PingStatus != ssmtypes.PingStatusOnline:
+		return &ssmtypes.TargetNotConnected{Message: aws.String(fmt.Sprintf("%s is not connected", target))}
+	}
+	return nil
+}
+
+// checkTaskTarget checks target is a container of a running task with ECS
+// Exec enabled.
+func (f *Fleet) checkTaskTarget(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, task := range f.tasks {
+		for container := range task.Containers {
+			if task.Target(container) != target {
+				continue
+			}
+			if task.LastStatus != "RUNNING" || task.ExecDisabled {
+				return &ssmtypes.TargetNotConnected{Message: aws.String(fmt.Sprintf("%s is not connected", target))}
+			}
+			return nil
+		}
+	}
+	return &ssmtypes.InvalidTarget{Message: aws.String(fmt.Sprintf("%s is not a valid target", target))}
+}
+
+// DescribeInstances supports the instance-id, instance-state-name and
+// tag:<key> filters, with wildcards in their values. Every instance is
+// returned in its own reservation, on a single page.
+func (f *Fleet) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &ec2.DescribeInstancesOutput{}
+	for _, instance := range f.instances {
+		if len(params.InstanceIds) > 0 && !slices.Contains(params.InstanceIds, instance.ID) {
+			continue
+		}
+		matches := true
+		for _, filter := range params.Filters {
+			var value string
+			var ok bool
+			switch name := aws.ToString(filter.Name); {
+			case name == "instance-id":
+				value, ok = instance.ID, true
+			case name == "instance-state-name":
+				value, ok = string(instance.State), true
+			case strings.HasPrefix(name, "tag:"):
+				value, ok = instance.Tags[strings.TrimPrefix(name, "tag:")]
+			default:
+				return nil, fmt.Errorf("filter %q is not supported", name)
+			}
+			if !ok || !matchesAny(filter.Values, value) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		described := ec2types.Instance{
+			InstanceId: aws.String(instance.ID),
+			LaunchTime: aws.Time(instance.LaunchTime),
+			State:      &ec2types.InstanceState{Name: instance.State},
+		}
+		for key, value := range instance.Tags {
+			described.Tags = append(described.Tags, ec2types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		output.Reservations = append(output.Reservations, ec2types.Reservation{
+			Instances: []ec2types.Instance{described},
+		})
+	}
+	return output, nil
+}
+
+// StartInstances starts stopped instances. Instances that are not stopped
+// keep their state.
+func (f *Fleet) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	changes, err := f.changeStates(params.InstanceIds, ec2types.InstanceStateNameStopped, ec2types.InstanceStateNameRunning, ssmtypes.PingStatusOnline)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+// StopInstances stops running instances. Instances that are not running keep
+// their state.
+func (f *Fleet) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	changes, err := f.changeStates(params.InstanceIds, ec2types.InstanceStateNameRunning, ec2types.InstanceStateNameStopped, ssmtypes.PingStatusConnectionLost)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+// changeStates moves the instances ids that are in state from to state to.
+func (f *Fleet) changeStates(ids []string, from, to ec2types.InstanceStateName, pingStatus ssmtypes.PingStatus) ([]ec2types.InstanceStateChange, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var changes []ec2types.InstanceStateChange
+	for _, id := range ids {
+		i := slices.IndexFunc(f.instances, func(instance Instance) bool {
+			return instance.ID == id
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("InvalidInstanceID.NotFound: instance %s does not exist", id)
+		}
+		instance := &f.instances[i]
+		change := ec2types.InstanceStateChange{
+			InstanceId:    aws.String(id),
+			PreviousState: &ec2types.InstanceState{Name: instance.State},
+		}
+		if instance.State == from {
+			instance.State = to
+			instance.PingStatus = pingStatus
+		}
+		change.CurrentState = &ec2types.InstanceState{Name: instance.State}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// DescribeInstanceInformation supports the InstanceIds, PingStatus,
+// PlatformTypes and tag:<key> filters. Every instance is returned on a single
+// page.
+func (f *Fleet) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &ssm.DescribeInstanceInformationOutput{}
+	for _, instance := range f.instances {
+		// Terminated instances are deregistered
+		if instance.State == ec2types.InstanceStateNameTerminated {
+			continue
+		}
+		matches := true
+		for _, filter := range params.Filters {
+			var value string
+			var ok bool
+			switch key := aws.ToString(filter.Key); {
+			case key == "InstanceIds":
+				value, ok = instance.ID, true
+			case key == "PingStatus":
+				value, ok = string(instance.PingStatus), true
+			case key == "PlatformTypes":
+				value, ok = string(instance.PlatformType), true
+			case strings.HasPrefix(key, "tag:"):
+				value, ok = instance.Tags[strings.TrimPrefix(key, "tag:")]
+			default:
+				return nil, &ssmtypes.InvalidInstanceInformationFilterValue{Message: aws.String(fmt.Sprintf("filter %q is not supported", key))}
+			}
+			if !ok || !slices.Contains(filter.Values, value) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		output.InstanceInformationList = append(output.InstanceInformationList, ssmtypes.InstanceInformation{
+			InstanceId:   aws.String(instance.ID),
+			PingStatus:   instance.PingStatus,
+			PlatformType: instance.PlatformType,
+			ResourceType: ssmtypes.ResourceTypeEc2Instance,
+		})
+	}
+	return output, nil
+}
+
+// ListTasks lists the tasks of the cluster, which can be named by its ARN,
+// supporting the ServiceName, Family and DesiredStatus filters. Stopped tasks
+// are desired to be stopped, and the others to be running. Every task is
+// returned on a single page.
+func (f *Fleet) ListTasks(ctx context.Context, params *ecs.ListTasksInput, optFns ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &ecs.ListTasksOutput{}
+	for _, task := range f.tasks {
+		desiredStatus := ecstypes.DesiredStatusRunning
+		if task.LastStatus == "STOPPED" {
+			desiredStatus = ecstypes.DesiredStatusStopped
+		}
+		switch {
+		case task.Cluster != clusterName(params.Cluster):
+		case params.ServiceName != nil && aws.ToString(params.ServiceName) != task.Service:
+		case params.Family != nil && aws.ToString(params.Family) != task.Family:
+		case params.DesiredStatus != "" && params.DesiredStatus != desiredStatus:
+		default:
+			output.TaskArns = append(output.TaskArns, taskArn(task))
+		}
+	}
+	return output, nil
+}
+
+// DescribeTasks describes the tasks of the cluster named by their ARN or ID.
+// Unknown tasks are reported as failures.
+func (f *Fleet) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	if len(params.Tasks) > 100 {
+		return nil, fmt.Errorf("InvalidParameterException: at most 100 tasks can be described")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &ecs.DescribeTasksOutput{}
+	for _, name := range params.Tasks {
+		i := slices.IndexFunc(f.tasks, func(task Task) bool {
+			return task.Cluster == clusterName(params.Cluster) && (name == task.ID || name == taskArn(task))
+		})
+		if i < 0 {
+			output.Failures = append(output.Failures, ecstypes.Failure{Arn: aws.String(name), Reason: aws.String("MISSING")})
+			continue
+		}
+		task := f.tasks[i]
+
+		described := ecstypes.Task{
+			TaskArn:              aws.String(taskArn(task)),
+			ClusterArn:           aws.String("arn:aws:ecs:us-east-1:123456789012:cluster/" + task.Cluster),
+			LastStatus:           aws.String(task.LastStatus),
+			EnableExecuteCommand: !task.ExecDisabled,
+			StartedAt:            aws.Time(task.StartedAt),
+		}
+		for _, name := range slices.Sorted(maps.Keys(task.Containers)) {
+			container := ecstypes.Container{
+				Name:      aws.String(name),
+				RuntimeId: aws.String(task.Containers[name]),
+			}
+			if !task.ExecDisabled {
+				container.ManagedAgents = []ecstypes.ManagedAgent{{
+					Name:       ecstypes.ManagedAgentNameExecuteCommandAgent,
+					LastStatus: aws.String(task.LastStatus),
+				}}
+			}
+			described.Containers = append(described.Containers, container)
+		}
+		if task.StoppedReason != "" {
+			described.StoppedReason = aws.String(task.StoppedReason)
+		}
+		output.Tasks = append(output.Tasks, described)
+	}
+	return output, nil
+}
+
+// RunTask starts a task of a task definition added with AddTaskDefinition,
+// named by its family, family:revision or ARN. It is running right away.
+func (f *Fleet) RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+	family, _, _ := strings.Cut(lastPathSegment(aws.ToString(params.TaskDefinition)), ":")
+
+	f.mu.Lock()
+	containers, ok := f.taskDefinitions[family]
+	if !ok {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("ClientException: unable to find task definition %s", aws.ToString(params.TaskDefinition))
+	}
+	f.nextTaskID++
+	task := Task{
+		Cluster:      clusterName(params.Cluster),
+		ID:           fmt.Sprintf("%032x", f.nextTaskID),
+		Family:       family,
+		ExecDisabled: !params.EnableExecuteCommand,
+		StartedAt:    time.Now(),
+		Containers:   make(map[string]string, len(containers)),
+	}
+	for i, container := range containers {
+		task.Containers[container] = fmt.Sprintf("%s-%d", task.ID, i)
+	}
+	if network := params.NetworkConfiguration; network != nil && network.AwsvpcConfiguration != nil {
+		task.Subnets = network.AwsvpcConfiguration.Subnets
+		task.SecurityGroups = network.AwsvpcConfiguration.SecurityGroups
+		task.AssignPublicIP = network.AwsvpcConfiguration.AssignPublicIp == ecstypes.AssignPublicIpEnabled
+	}
+	f.mu.Unlock()
+
+	f.AddTask(task)
+	return &ecs.RunTaskOutput{
+		Tasks: []ecstypes.Task{{
+			TaskArn:    aws.String(taskArn(task)),
+			LastStatus: aws.String("PROVISIONING"),
+		}},
+	}, nil
+}
+
+// StopTask stops a task named by its ARN or ID.
+func (f *Fleet) StopTask(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, task := range f.tasks {
+		if task.Cluster == clusterName(params.Cluster) && (aws.ToString(params.Task) == task.ID || aws.ToString(params.Task) == taskArn(task)) {
+			f.tasks[i].LastStatus = "STOPPED"
+			f.tasks[i].StoppedReason = aws.ToString(params.Reason)
+			return &ecs.StopTaskOutput{Task: &ecstypes.Task{TaskArn: aws.String(taskArn(task))}}, nil
+		}
+	}
+	return nil, fmt.Errorf("InvalidParameterException: task %s does not exist", aws.ToString(params.Task))
+}
+
+// taskArn returns the ARN of task.
+func taskArn(task Task) string {
+	return fmt.Sprintf("arn:aws:ecs:us-east-1:123456789012:task/%s/%s", task.Cluster, task.ID)
+}
+
+// clusterName returns the name of the cluster named by its name or ARN.
+func clusterName(cluster *string) string {
+	return lastPathSegment(aws.ToString(cluster))
+}
+
+// lastPathSegment returns what follows the last / of an ARN.
+func lastPathSegment(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// matchesAny reports whether value matches one of the EC2 filter patterns,
+// where * matches any characters and ? a single one.
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		if regexp.MustCompile("^" + expr + "$").MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package ssmtunnelstest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// kmsTargetPrefix starts the X-Amz-Target header of KMS API calls.
+const kmsTargetPrefix = "TrentService."
+
+// DataKey describes a data key generated by the KMS API of the Server.
+type DataKey struct {
+	KeyID             string
+	EncryptionContext map[string]string
+}
+
+// generatedDataKey is a data key, with the plaintext the agent encrypts with.
+type generatedDataKey struct {
+	DataKey
+	cipherText []byte
+	plainText  []byte
+}
+
+// KMSClient returns a KMS client using the server as its endpoint. It
+// generates the data keys of sessions encrypted with KMSKeyID.
+func (s *Server) KMSClient() *kms.Client {
+	return kms.New(kms.Options{
+		BaseEndpoint: aws.String(s.URL),
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+// DataKeys returns the data keys generated so far, in order.
+func (s *Server) DataKeys() []DataKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]DataKey, 0, len(s.dataKeys))
+	for _, key := range s.dataKeys {
+		keys = append(keys, DataKey{KeyID: key.KeyID, EncryptionContext: maps.Clone(key.EncryptionContext)})
+	}
+	return keys
+}
+
+// handleKMS answers the KMS API operation.
+func (s *Server) handleKMS(operation string, r *http.Request) (interface{}, error) {
+	if operation != "GenerateDataKey" {
+		return nil, &apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("operation %q is not supported", operation)}
+	}
+
+	var input struct {
+		KeyId             string
+		NumberOfBytes     int
+		EncryptionContext map[string]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", err.Error()}
+	}
+	if input.KeyId == "" || input.KeyId != s.KMSKeyID {
+		return nil, &apiError{http.StatusBadRequest, "NotFoundException", fmt.Sprintf("key %q does not exist", input.KeyId)}
+	}
+	if input.NumberOfBytes <= 0 || input.NumberOfBytes > 1024 {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", "NumberOfBytes must be between 1 and 1024"}
+	}
+
+	plainText := make([]byte, input.NumberOfBytes)
+	if _, err := rand.Read(plainText); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	key := generatedDataKey{
+		DataKey:    DataKey{KeyID: input.KeyId, EncryptionContext: input.EncryptionContext},
+		cipherText: fmt.Appendf(nil, "stand-in-data-key-%d", len(s.dataKeys)+1),
+		plainText:  plainText,
+	}
+	s.dataKeys = append(s.dataKeys, key)
+	s.mu.Unlock()
+
+	return map[string]interface{}{
+		"KeyId":          input.KeyId,
+		"CiphertextBlob": key.cipherText,
+		"Plaintext":      key.plainText,
+	}, nil
+}
+
+// dataKey returns the plaintext of the data key encrypted as cipherText, or
+// nil if the server did not generate it.
+func (s *Server) dataKey(cipherText []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.dataKeys, func(key generatedDataKey) bool {
+		return slices.Equal(key.cipherText, cipherText)
+	})
+	if i < 0 {
+		return nil
+	}
+	return s.dataKeys[i].plainText
+}
+
+// agentCipher encrypts the payloads of a session as the agent does. The
+// first half of the data key encrypts what the agent sends, the second half
+// decrypts what it receives.
+type agentCipher struct {
+	encrypter cipher.AEAD
+	decrypter cipher.AEAD
+}
+
+func newAgentCipher(dataKey []byte) (*agentCipher, error) {
+	if len(dataKey) == 0 || len(dataKey)%2 != 0 {
+		return nil, errors.New("invalid data key size")
+	}
+	encrypter, err := newGCM(dataKey[:len(dataKey)/2])
+	if err != nil {
+		return nil, err
+	}
+	decrypter, err := newGCM(dataKey[len(dataKey)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &agentCipher{encrypter: encrypter, decrypter: decrypter}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt encrypts plainText, prefixed with its nonce.
+func (c *agentCipher) encrypt(plainText []byte) ([]byte, error) {
+	nonce := make([]byte, c.encrypter.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.encrypter.Seal(nonce, nonce, plainText, nil), nil
+}
+
+// decrypt decrypts cipherText prefixed with its nonce.
+func (c *agentCipher) decrypt(cipherText []byte) ([]byte, error) {
+	nonceSize := c.decrypter.NonceSize()
+	if len(cipherText) < nonceSize {
+		return nil, errors.New("encrypted payload is too short")
+	}
+	return c.decrypter.Open(nil, cipherText[:nonceSize], cipherText[nonceSize:], nil)
+}
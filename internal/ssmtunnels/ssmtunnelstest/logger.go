@@ -0,0 +1,86 @@
+package ssmtunnelstest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/session-manager-plugin/src/log"
+)
+
+// logger is the session-manager-plugin logger used by the stand-in agent. It
+// sends messages to logf, or drops them when logf is nil.
+type logger struct {
+	logf    func(format string, args ...interface{})
+	context []string
+}
+
+var _ log.T = (*logger)(nil)
+
+func (l *logger) write(level, msg string) string {
+	if len(l.context) > 0 {
+		msg = strings.Join(l.context, " ") + " " + msg
+	}
+	if l.logf != nil {
+		l.logf("[%s] %s", level, msg)
+	}
+	return msg
+}
+
+func (l *logger) Tracef(format string, params ...interface{}) {
+	l.write("TRACE", fmt.Sprintf(format, params...))
+}
+
+func (l *logger) Debugf(format string, params ...interface{}) {
+	l.write("DEBUG", fmt.Sprintf(format, params...))
+}
+
+func (l *logger) Infof(format string, params ...interface{}) {
+	l.write("INFO", fmt.Sprintf(format, params...))
+}
+
+func (l *logger) Warnf(format string, params ...interface{}) error {
+	return errors.New(l.write("WARN", fmt.Sprintf(format, params...)))
+}
+
+func (l *logger) Errorf(format string, params ...interface{}) error {
+	return errors.New(l.write("ERROR", fmt.Sprintf(format, params...)))
+}
+
+func (l *logger) Criticalf(format string, params ...interface{}) error {
+	return errors.New(l.write("CRITICAL", fmt.Sprintf(format, params...)))
+}
+
+func (l *logger) Trace(v ...interface{}) {
+	l.write("TRACE", fmt.Sprint(v...))
+}
+
+func (l *logger) Debug(v ...interface{}) {
+	l.write("DEBUG", fmt.Sprint(v...))
+}
+
+func (l *logger) Info(v ...interface{}) {
+	l.write("INFO", fmt.Sprint(v...))
+}
+
+func (l *logger) Warn(v ...interface{}) error {
+	return errors.New(l.write("WARN", fmt.Sprint(v...)))
+}
+
+func (l *logger) Error(v ...interface{}) error {
+	return errors.New(l.write("ERROR", fmt.Sprint(v...)))
+}
+
+func (l *logger) Critical(v ...interface{}) error {
+	return errors.New(l.write("CRITICAL", fmt.Sprint(v...)))
+}
+
+func (l *logger) Flush() {}
+
+func (l *logger) Close() {}
+
+func (l *logger) WithContext(context ...string) log.T {
+	child := *l
+	child.context = append(append([]string(nil), l.context...), context...)
+	return &child
+}
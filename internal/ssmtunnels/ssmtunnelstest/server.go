@@ -0,0 +1,461 @@
+package ssmtunnelstest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/session-manager-plugin/src/message"
+	"github.com/aws/session-manager-plugin/src/service"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultAgentVersion is the SSM agent version the stand-in agent reports. It
+// supports multiplexed port forwarding with smux keep-alives disabled.
+const DefaultAgentVersion = "3.3.40.0"
+
+// BasicAgentVersion is an SSM agent version that predates multiplexing, so
+// sessions forward a single connection at a time.
+const BasicAgentVersion = "3.0.100.0"
+
+const dataChannelPath = "/v1/data-channel/"
+
+// Server is a local stand-in for the SSM service. It implements the
+// StartSession, ResumeSession, TerminateSession, DescribeDocument and
+// DescribeInstanceInformation JSON API, and a websocket
+// endpoint speaking the Session Manager data channel protocol as the SSM
+// agent would, forwarding port forwarding sessions to local TCP servers. It
+// also stands in for the ListTasks, DescribeTasks, RunTask and StopTask
+// operations of the ECS API, on the tasks of its Fleet, and for the
+// GenerateDataKey operation of the KMS API.
+//
+// Point an SSM client at URL, for example with Client, an ECS client with
+// ECSClient and a KMS client with KMSClient.
+type Server struct {
+	// URL is the endpoint of the SSM API.
+	URL string
+
+	// AgentVersion is reported by the agent of new sessions. Defaults to
+	// DefaultAgentVersion.
+	AgentVersion string
+	// Logf receives the log output of the stand-in agent. It is discarded if nil.
+	Logf func(format string, args ...interface{})
+	// Fleet answers DescribeInstanceInformation, and sessions can only be
+	// started on its online instances. When it is nil, no instances are
+	// described and sessions can be started on any target.
+	Fleet *Fleet
+	// KMSKeyID, when set, makes new sessions encrypted with a data key of
+	// this KMS key, as when KMS encryption is enabled in the Session Manager
+	// preferences.
+	KMSKeyID string
+
+	httpServer *httptest.Server
+	upgrader   websocket.Upgrader
+
+	mu        sync.Mutex
+	documents documentSet
+	nextID    int
+	sessions  []*agentSession
+	dataKeys  []generatedDataKey
+}
+
+// Session describes a session started on the Server.
+type Session struct {
+	ID           string
+	Target       string
+	DocumentName string
+	Parameters   map[string][]string
+	Terminated   bool
+}
+
+// NewServer starts a stand-in SSM service on a random local port. The exported
+// fields must be set before sessions are started.
+func NewServer() *Server {
+	s := &Server{
+		AgentVersion: DefaultAgentVersion,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleAPI)
+	mux.HandleFunc(dataChannelPath, s.handleDataChannel)
+	s.httpServer = httptest.NewServer(mux)
+	s.URL = s.httpServer.URL
+	return s
+}
+
+// Client returns an SSM client using the server as its endpoint.
+func (s *Server) Client() *ssm.Client {
+	return ssm.New(ssm.Options{
+		BaseEndpoint: aws.String(s.URL),
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+// Close terminates every session and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	sessions := slices.Clone(s.sessions)
+	s.mu.Unlock()
+	for _, session := range sessions {
+		session.terminate("Session terminated because the service stopped.")
+	}
+	s.httpServer.CloseClientConnections()
+	s.httpServer.Close()
+}
+
+// Sessions returns the sessions started on the server, in order.
+func (s *Server) Sessions() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session.describe())
+	}
+	return sessions
+}
+
+// ActiveSessions returns the IDs of the sessions that were not terminated.
+func (s *Server) ActiveSessions() []string {
+	var active []string
+	for _, session := range s.Sessions() {
+		if !session.Terminated {
+			active = append(active, session.ID)
+		}
+	}
+	return active
+}
+
+// AddDocument makes a custom port forwarding document known to the server.
+// Sessions started with it forward to its host parameter, or to localhost,
+// on its portNumber parameter.
+func (s *Server) AddDocument(document types.DocumentDescription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documents = s.documents.with(document)
+}
+
+// DropConnections closes the data channel connections of every session
+// without ending the sessions, as a network failure would. Clients can
+// resume the sessions afterwards.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	sessions := slices.Clone(s.sessions)
+	s.mu.Unlock()
+	for _, session := range sessions {
+		session.dropConnection()
+	}
+}
+
+// ExpireSession ends a session as if it timed out. It can not be resumed.
+func (s *Server) ExpireSession(sessionID string) {
+	if session := s.session(sessionID); session != nil {
+		session.terminate("Session expired.")
+	}
+}
+
+func (s *Server) session(sessionID string) *agentSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if session.id == sessionID {
+			return session
+		}
+	}
+	return nil
+}
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	var (
+		output interface{}
+		err    error
+	)
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	switch {
+	case strings.HasPrefix(operation, ecsTargetPrefix):
+		output, err = s.handleECS(strings.TrimPrefix(operation, ecsTargetPrefix), r)
+	case strings.HasPrefix(operation, kmsTargetPrefix):
+		output, err = s.handleKMS(strings.TrimPrefix(operation, kmsTargetPrefix), r)
+	case operation == "StartSession":
+		output, err = s.startSession(r)
+	case operation == "ResumeSession":
+		output, err = s.resumeSession(r)
+	case operation == "TerminateSession":
+		output, err = s.terminateSession(r)
+	case operation == "DescribeDocument":
+		output, err = s.describeDocument(r)
+	case operation == "DescribeInstanceInformation":
+		output, err = s.describeInstanceInformation(r)
+	default:
+		err = &apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("operation %q is not supported", operation)}
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if err != nil {
+		apiErr, ok := err.(*apiError)
+		if !ok {
+			apiErr = &apiError{http.StatusInternalServerError, "InternalServerError", err.Error()}
+		}
+		w.Header().Set("X-Amzn-ErrorType", apiErr.code)
+		w.WriteHeader(apiErr.status)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"__type":  apiErr.code,
+			"message": apiErr.message,
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(output)
+}
+
+func (s *Server) startSession(r *http.Request) (interface{}, error) {
+	var input struct {
+		Target       string
+		DocumentName string
+		Parameters   map[string][]string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", err.Error()}
+	}
+	if input.Target == "" {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", "Target must be set"}
+	}
+	if s.Fleet != nil {
+		var notConnected *types.TargetNotConnected
+		var invalid *types.InvalidTarget
+		switch err := s.Fleet.checkTarget(input.Target); {
+		case errors.As(err, &notConnected):
+			return nil, &apiError{http.StatusBadRequest, "TargetNotConnected", aws.ToString(notConnected.Message)}
+		case errors.As(err, &invalid):
+			return nil, &apiError{http.StatusBadRequest, "InvalidTarget", aws.ToString(invalid.Message)}
+		}
+	}
+
+	s.mu.Lock()
+	document, ok := s.documents.lookup(input.DocumentName)
+	s.mu.Unlock()
+	if !ok {
+		return nil, &apiError{http.StatusBadRequest, "InvalidDocument", fmt.Sprintf("document %q does not exist", input.DocumentName)}
+	}
+	if err := checkParameters(document, input.Parameters); err != nil {
+		return nil, err
+	}
+
+	host := "localhost"
+	if len(input.Parameters["host"]) == 1 && input.Parameters["host"][0] != "" {
+		host = input.Parameters["host"][0]
+	}
+	if len(input.Parameters["portNumber"]) != 1 {
+		return nil, &apiError{http.StatusBadRequest, "InvalidParameters", "portNumber must be set"}
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	session := &agentSession{
+		id:           fmt.Sprintf("stand-in-session-%d", s.nextID),
+		target:       input.Target,
+		documentName: input.DocumentName,
+		parameters:   input.Parameters,
+		remoteAddr:   net.JoinHostPort(host, input.Parameters["portNumber"][0]),
+		agentVersion: s.AgentVersion,
+		kmsKeyID:     s.KMSKeyID,
+		dataKey:      s.dataKey,
+		log:          &logger{logf: s.Logf},
+		incoming:     make(map[int64]message.ClientMessage),
+		done:         make(chan struct{}),
+	}
+	token := session.newToken()
+	s.sessions = append(s.sessions, session)
+	s.mu.Unlock()
+
+	go session.resendLoop()
+
+	return map[string]string{
+		"SessionId":  session.id,
+		"StreamUrl":  s.streamURL(session.id),
+		"TokenValue": token,
+	}, nil
+}
+
+// checkParameters rejects the parameters that document does not declare, and
+// missing required ones, like SSM does.
+func checkParameters(document types.DocumentDescription, parameters map[string][]string) error {
+	declared := make(map[string]bool)
+	for _, parameter := range document.Parameters {
+		name := aws.ToString(parameter.Name)
+		declared[name] = true
+		if _, ok := parameters[name]; !ok && parameter.DefaultValue == nil {
+			return &apiError{http.StatusBadRequest, "InvalidParameters", fmt.Sprintf("parameter %q is required", name)}
+		}
+	}
+	for name := range parameters {
+		if !declared[name] {
+			return &apiError{http.StatusBadRequest, "InvalidParameters", fmt.Sprintf("parameter %q is not declared by the document", name)}
+		}
+	}
+	return nil
+}
+
+func (s *Server) describeDocument(r *http.Request) (interface{}, error) {
+	var input struct {
+		Name string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", err.Error()}
+	}
+	s.mu.Lock()
+	document, ok := s.documents.lookup(input.Name)
+	s.mu.Unlock()
+	if !ok {
+		return nil, &apiError{http.StatusBadRequest, "InvalidDocument", fmt.Sprintf("document %q does not exist", input.Name)}
+	}
+
+	parameters := make([]map[string]string, 0, len(document.Parameters))
+	for _, parameter := range document.Parameters {
+		p := map[string]string{
+			"Name": aws.ToString(parameter.Name),
+			"Type": string(parameter.Type),
+		}
+		if parameter.DefaultValue != nil {
+			p["DefaultValue"] = *parameter.DefaultValue
+		}
+		parameters = append(parameters, p)
+	}
+	return map[string]interface{}{
+		"Document": map[string]interface{}{
+			"Name":         aws.ToString(document.Name),
+			"DocumentType": string(document.DocumentType),
+			"Status":       string(document.Status),
+			"Parameters":   parameters,
+		},
+	}, nil
+}
+
+func (s *Server) describeInstanceInformation(r *http.Request) (interface{}, error) {
+	var input struct {
+		Filters []struct {
+			Key    string
+			Values []string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", err.Error()}
+	}
+	instances := []map[string]string{}
+	if s.Fleet == nil {
+		return map[string]interface{}{"InstanceInformationList": instances}, nil
+	}
+
+	params := &ssm.DescribeInstanceInformationInput{}
+	for _, filter := range input.Filters {
+		params.Filters = append(params.Filters, types.InstanceInformationStringFilter{
+			Key:    aws.String(filter.Key),
+			Values: filter.Values,
+		})
+	}
+	output, err := s.Fleet.DescribeInstanceInformation(r.Context(), params)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, "InvalidInstanceInformationFilterValue", err.Error()}
+	}
+	for _, instance := range output.InstanceInformationList {
+		instances = append(instances, map[string]string{
+			"InstanceId":   aws.ToString(instance.InstanceId),
+			"PingStatus":   string(instance.PingStatus),
+			"PlatformType": string(instance.PlatformType),
+			"ResourceType": string(instance.ResourceType),
+		})
+	}
+	return map[string]interface{}{"InstanceInformationList": instances}, nil
+}
+
+func (s *Server) resumeSession(r *http.Request) (interface{}, error) {
+	var input struct {
+		SessionId string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", err.Error()}
+	}
+	session := s.session(input.SessionId)
+	if session == nil {
+		return nil, &apiError{http.StatusBadRequest, "DoesNotExistException", fmt.Sprintf("session %s does not exist", input.SessionId)}
+	}
+
+	output := map[string]string{
+		"SessionId": session.id,
+	}
+	if token := session.newToken(); token != "" {
+		// Like SSM, expired sessions are resumed without a token.
+		output["StreamUrl"] = s.streamURL(session.id)
+		output["TokenValue"] = token
+	}
+	return output, nil
+}
+
+func (s *Server) terminateSession(r *http.Request) (interface{}, error) {
+	var input struct {
+		SessionId string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "ValidationException", err.Error()}
+	}
+	// SSM does not fail when terminating an unknown or terminated session.
+	if session := s.session(input.SessionId); session != nil {
+		session.terminate("Session terminated.")
+	}
+	return map[string]string{
+		"SessionId": input.SessionId,
+	}, nil
+}
+
+func (s *Server) streamURL(sessionID string) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + dataChannelPath + sessionID
+}
+
+func (s *Server) handleDataChannel(w http.ResponseWriter, r *http.Request) {
+	session := s.session(strings.TrimPrefix(r.URL.Path, dataChannelPath))
+	if session == nil {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	// The client acknowledges the connection by sending its token.
+	messageType, raw, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var input service.OpenDataChannelInput
+	if messageType != websocket.TextMessage || json.Unmarshal(raw, &input) != nil || input.TokenValue == nil || !session.validToken(*input.TokenValue) {
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid token"))
+		conn.Close()
+		return
+	}
+
+	session.attach(conn)
+}
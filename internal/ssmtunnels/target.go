@@ -0,0 +1,400 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// EC2Client is the subset of the EC2 API used to select and start targets.
+// It is satisfied by *ec2.Client, and by fakes in tests.
+type EC2Client interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error)
+	StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error)
+}
+
+var _ EC2Client = (*ec2.Client)(nil)
+
+// The strategies picking a target among the instances matching a selector.
+const (
+	// TargetStrategyOldest picks the instance launched first.
+	TargetStrategyOldest = "oldest"
+	// TargetStrategyNewest picks the instance launched last.
+	TargetStrategyNewest = "newest"
+	// TargetStrategyRandom picks any of the instances.
+	TargetStrategyRandom = "random"
+)
+
+// TargetStrategies lists the supported selection strategies.
+var TargetStrategies = []string{TargetStrategyOldest, TargetStrategyNewest, TargetStrategyRandom}
+
+// ErrNoTarget is returned when no online instance matches a target selector.
+var ErrNoTarget = errors.New("no online managed instance matches the target selector")
+
+// describeInstancesBatch is the most values EC2 accepts in a filter.
+const describeInstancesBatch = 200
+
+// instanceInformationBatch is the most instance IDs SSM accepts in a filter.
+const instanceInformationBatch = 50
+
+// DefaultTargetPollInterval is how often the status of targets is checked
+// while waiting for them to come online.
+const DefaultTargetPollInterval = 10 * time.Second
+
+// TargetSelector picks the instance to start sessions on among the managed
+// instances whose SSM agent is online, rather than naming it.
+type TargetSelector struct {
+	// Tags are the EC2 tags instances must have. Values can use the * and ?
+	// wildcards.
+	Tags map[string]string
+	// Filters are ssm:DescribeInstanceInformation filters, such as
+	// PlatformTypes or tag:Name.
+	Filters map[string][]string
+	// Strategy picks among the matching instances. Defaults to
+	// TargetStrategyOldest.
+	Strategy string
+}
+
+// Validate checks the selector can be resolved.
+func (s TargetSelector) Validate() error {
+	if s.Strategy != "" && !slices.Contains(TargetStrategies, s.Strategy) {
+		return fmt.Errorf("unknown strategy %q, expected one of %v", s.Strategy, TargetStrategies)
+	}
+	for key := range s.Filters {
+		if key == "PingStatus" {
+			return fmt.Errorf("the PingStatus filter can not be set, only online instances are selected")
+		}
+	}
+	return nil
+}
+
+// Candidates returns the IDs of the online instances matching the selector,
+// in the order the strategy prefers them. EC2 is only queried when the
+// selector has tags or orders instances by launch time, so managed instances
+// outside of EC2 can only be selected at random by SSM filters.
+func (s TargetSelector) Candidates(ctx context.Context, ssmClient SSMClient, ec2Client EC2Client) ([]string, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	online, err := s.onlineInstances(ctx, ssmClient)
+	if err != nil {
+		return nil, err
+	}
+
+	strategy := s.Strategy
+	if strategy == "" {
+		strategy = TargetStrategyOldest
+	}
+	if len(s.Tags) == 0 && strategy == TargetStrategyRandom {
+		rand.Shuffle(len(online), func(i, j int) {
+			online[i], online[j] = online[j], online[i]
+		})
+		return online, nil
+	}
+
+	launched, err := s.runningInstances(ctx, ec2Client, online)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]string, 0, len(launched))
+	for id := range launched {
+		candidates = append(candidates, id)
+	}
+	switch strategy {
+	case TargetStrategyRandom:
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	default:
+		// Instance IDs break ties, so the order is stable across plans
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := launched[candidates[i]], launched[candidates[j]]
+			if a.Equal(b) {
+				return candidates[i] < candidates[j]
+			}
+			if strategy == TargetStrategyNewest {
+				return a.After(b)
+			}
+			return a.Before(b)
+		})
+	}
+	return candidates, nil
+}
+
+// Resolve returns the instance to start sessions on. current, the instance
+// resolved before, is kept as long as it still matches, so targets do not
+// move between runs.
+func (s TargetSelector) Resolve(ctx context.Context, ssmClient SSMClient, ec2Client EC2Client, current string) (string, error) {
+	candidates, err := s.Candidates(ctx, ssmClient, ec2Client)
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoTarget
+	}
+	if current != "" && slices.Contains(candidates, current) {
+		return current, nil
+	}
+	return candidates[0], nil
+}
+
+// WaitResolve is Resolve, polling every interval while no instance matches,
+// for example because the instance is still booting, until ctx is done.
+func (s TargetSelector) WaitResolve(ctx context.Context, ssmClient SSMClient, ec2Client EC2Client, current string, interval time.Duration) (string, error) {
+	for {
+		target, err := s.Resolve(ctx, ssmClient, ec2Client, current)
+		if !errors.Is(err, ErrNoTarget) {
+			return target, err
+		}
+		tflog.Info(ctx, "Waiting for an instance matching the target selector to come online", map[string]interface{}{
+			"poll_interval": interval.String(),
+		})
+		if err := sleep(ctx, interval); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrNoTarget, err)
+		}
+	}
+}
+
+// WaitForTarget polls ssm:DescribeInstanceInformation every interval until
+// the agent of one of targets is online, or ctx is done. It lets sessions be
+// started on instances created moments before, whose agent has not
+// registered yet.
+func WaitForTarget(ctx context.Context, client SSMClient, targets []string, interval time.Duration) error {
+	for {
+		statuses, err := pingStatuses(ctx, client, targets)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			if statuses[target] == ssmtypes.PingStatusOnline {
+				tflog.Info(ctx, "Target is online", map[string]interface{}{
+					"target": target,
+				})
+				return nil
+			}
+		}
+
+		fields := make(map[string]interface{}, len(targets))
+		for _, target := range targets {
+			status := string(statuses[target])
+			if status == "" {
+				status = "NotRegistered"
+			}
+			fields[target] = status
+		}
+		tflog.Info(ctx, "Waiting for target to come online", map[string]interface{}{
+			"ping_status":   fields,
+			"poll_interval": interval.String(),
+		})
+		if err := sleep(ctx, interval); err != nil {
+			return fmt.Errorf("no target came online: %w", err)
+		}
+	}
+}
+
+// IsEC2Instance reports whether target is an EC2 instance ID, rather than a
+// managed instance outside of EC2 or an ECS task.
+func IsEC2Instance(target string) bool {
+	return strings.HasPrefix(target, "i-")
+}
+
+// StartTarget starts the EC2 instance id when it is stopped, and waits for it
+// to be running and for its agent to be online, polling every interval until
+// ctx is done. An instance that is stopping is started once it stopped. It
+// reports whether it started the instance, even when waiting failed.
+func StartTarget(ctx context.Context, ec2Client EC2Client, ssmClient SSMClient, id string, interval time.Duration) (bool, error) {
+	started := false
+	for {
+		state, err := instanceState(ctx, ec2Client, id)
+		if err != nil {
+			return started, err
+		}
+
+		switch state {
+		case ec2types.InstanceStateNameRunning:
+			return started, WaitForTarget(ctx, ssmClient, []string{id}, interval)
+		case ec2types.InstanceStateNameStopped:
+			output, err := ec2Client.StartInstances(ctx, &ec2.StartInstancesInput{
+				InstanceIds: []string{id},
+			})
+			if err != nil {
+				return started, fmt.Errorf("failed to start instance %s: %w", id, err)
+			}
+			for _, change := range output.StartingInstances {
+				if change.PreviousState != nil && change.PreviousState.Name == ec2types.InstanceStateNameStopped {
+					started = true
+				}
+			}
+			tflog.Info(ctx, "Started target instance", map[string]interface{}{
+				"target": id,
+			})
+		case ec2types.InstanceStateNameShuttingDown, ec2types.InstanceStateNameTerminated:
+			return started, fmt.Errorf("instance %s is %s", id, state)
+		default:
+			tflog.Info(ctx, "Waiting for target instance to be running", map[string]interface{}{
+				"target": id,
+				"state":  string(state),
+			})
+		}
+
+		if err := sleep(ctx, interval); err != nil {
+			return started, fmt.Errorf("instance %s is not running: %w", id, err)
+		}
+	}
+}
+
+// StopTargets stops the EC2 instances ids.
+func StopTargets(ctx context.Context, client EC2Client, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := client.StopInstances(ctx, &ec2.StopInstancesInput{
+		InstanceIds: ids,
+	}); err != nil {
+		return fmt.Errorf("failed to stop instances %v: %w", ids, err)
+	}
+	tflog.Info(ctx, "Stopped target instances", map[string]interface{}{
+		"targets": ids,
+	})
+	return nil
+}
+
+// instanceState returns the state of the EC2 instance id.
+func instanceState(ctx context.Context, client EC2Client, id string) (ec2types.InstanceStateName, error) {
+	output, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{id},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe instance %s: %w", id, err)
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.ToString(instance.InstanceId) == id && instance.State != nil {
+				return instance.State.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("instance %s does not exist", id)
+}
+
+// pingStatuses returns the status of the agent of the registered targets.
+func pingStatuses(ctx context.Context, client SSMClient, targets []string) (map[string]ssmtypes.PingStatus, error) {
+	statuses := make(map[string]ssmtypes.PingStatus, len(targets))
+	for batch := range slices.Chunk(targets, instanceInformationBatch) {
+		input := &ssm.DescribeInstanceInformationInput{
+			Filters: []ssmtypes.InstanceInformationStringFilter{{
+				Key:    aws.String("InstanceIds"),
+				Values: batch,
+			}},
+		}
+		paginator := ssm.NewDescribeInstanceInformationPaginator(client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe managed instances: %w", err)
+			}
+			for _, instance := range page.InstanceInformationList {
+				statuses[aws.ToString(instance.InstanceId)] = instance.PingStatus
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// sleep waits for d, or returns the error of ctx once it is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// onlineInstances returns the IDs of the managed instances matching the SSM
+// filters whose agent is online.
+func (s TargetSelector) onlineInstances(ctx context.Context, client SSMClient) ([]string, error) {
+	input := &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{{
+			Key:    aws.String("PingStatus"),
+			Values: []string{string(ssmtypes.PingStatusOnline)},
+		}},
+	}
+	for key, values := range s.Filters {
+		input.Filters = append(input.Filters, ssmtypes.InstanceInformationStringFilter{
+			Key:    aws.String(key),
+			Values: values,
+		})
+	}
+
+	var ids []string
+	paginator := ssm.NewDescribeInstanceInformationPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe managed instances: %w", err)
+		}
+		for _, instance := range page.InstanceInformationList {
+			// The filter is applied again in case the API ignores it
+			if instance.PingStatus == ssmtypes.PingStatusOnline {
+				ids = append(ids, aws.ToString(instance.InstanceId))
+			}
+		}
+	}
+	return ids, nil
+}
+
+// runningInstances returns the launch times of the running EC2 instances
+// among ids that have the selector's tags.
+func (s TargetSelector) runningInstances(ctx context.Context, client EC2Client, ids []string) (map[string]time.Time, error) {
+	filters := []ec2types.Filter{{
+		Name:   aws.String("instance-state-name"),
+		Values: []string{string(ec2types.InstanceStateNameRunning)},
+	}}
+	for key, value := range s.Tags {
+		filters = append(filters, ec2types.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []string{value},
+		})
+	}
+
+	launched := make(map[string]time.Time)
+	for batch := range slices.Chunk(ids, describeInstancesBatch) {
+		input := &ec2.DescribeInstancesInput{
+			Filters: append(slices.Clone(filters), ec2types.Filter{
+				Name:   aws.String("instance-id"),
+				Values: batch,
+			}),
+		}
+		paginator := ec2.NewDescribeInstancesPaginator(client, input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe instances: %w", err)
+			}
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					launched[aws.ToString(instance.InstanceId)] = aws.ToTime(instance.LaunchTime)
+				}
+			}
+		}
+	}
+	return launched, nil
+}
@@ -0,0 +1,196 @@
+package ssmtunnels_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels/ssmtunnelstest"
+)
+
+// newBastionFleet returns a fleet of bastions launched an hour apart, oldest
+// first, along with an offline bastion and an instance that is no bastion.
+func newBastionFleet() *ssmtunnelstest.Fleet {
+	launched := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bastion := map[string]string{"Role": "bastion"}
+	return ssmtunnelstest.NewFleet(
+		ssmtunnelstest.Instance{ID: "i-0000000000000000b", LaunchTime: launched.Add(time.Hour), Tags: bastion, PlatformType: ssmtypes.PlatformTypeLinux},
+		ssmtunnelstest.Instance{ID: "i-0000000000000000a", LaunchTime: launched, Tags: bastion, PlatformType: ssmtypes.PlatformTypeLinux},
+		ssmtunnelstest.Instance{ID: "i-0000000000000000c", LaunchTime: launched.Add(2 * time.Hour), Tags: bastion, PlatformType: ssmtypes.PlatformTypeWindows},
+		ssmtunnelstest.Instance{ID: "i-00000000000000off", LaunchTime: launched.Add(-time.Hour), Tags: bastion, PingStatus: ssmtypes.PingStatusConnectionLost},
+		ssmtunnelstest.Instance{ID: "i-000000000000000db", LaunchTime: launched.Add(-time.Hour), Tags: map[string]string{"Role": "database"}},
+	)
+}
+
+// newFleetServer starts a stand-in SSM service answering for fleet.
+func newFleetServer(t *testing.T, fleet *ssmtunnelstest.Fleet) *ssmtunnelstest.Server {
+	t.Helper()
+	server := newServer(t)
+	server.Fleet = fleet
+	return server
+}
+
+func TestTargetSelectorCandidates(t *testing.T) {
+	fleet := newBastionFleet()
+	server := newFleetServer(t, fleet)
+
+	tests := map[string]struct {
+		selector ssmtunnels.TargetSelector
+		want     []string
+	}{
+		"oldest by default": {
+			selector: ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}},
+			want:     []string{"i-0000000000000000a", "i-0000000000000000b", "i-0000000000000000c"},
+		},
+		"newest": {
+			selector: ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}, Strategy: ssmtunnels.TargetStrategyNewest},
+			want:     []string{"i-0000000000000000c", "i-0000000000000000b", "i-0000000000000000a"},
+		},
+		"tag wildcard": {
+			selector: ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "data*"}},
+			want:     []string{"i-000000000000000db"},
+		},
+		"ssm filter": {
+			selector: ssmtunnels.TargetSelector{
+				Tags:    map[string]string{"Role": "bastion"},
+				Filters: map[string][]string{"PlatformTypes": {string(ssmtypes.PlatformTypeWindows)}},
+			},
+			want: []string{"i-0000000000000000c"},
+		},
+		"no match": {
+			selector: ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "cache"}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			candidates, err := test.selector.Candidates(t.Context(), server.Client(), fleet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(candidates, test.want) {
+				t.Errorf("got candidates %v, want %v", candidates, test.want)
+			}
+		})
+	}
+}
+
+func TestTargetSelectorRandom(t *testing.T) {
+	fleet := newBastionFleet()
+	server := newFleetServer(t, fleet)
+
+	selector := ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}, Strategy: ssmtunnels.TargetStrategyRandom}
+	candidates, err := selector.Candidates(t.Context(), server.Client(), fleet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(candidates)
+	if want := []string{"i-0000000000000000a", "i-0000000000000000b", "i-0000000000000000c"}; !slices.Equal(candidates, want) {
+		t.Errorf("got candidates %v, want %v in any order", candidates, want)
+	}
+}
+
+func TestTargetSelectorResolve(t *testing.T) {
+	fleet := newBastionFleet()
+	server := newFleetServer(t, fleet)
+	selector := ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}}
+
+	target, err := selector.Resolve(t.Context(), server.Client(), fleet, "")
+	if err != nil || target != "i-0000000000000000a" {
+		t.Fatalf("got target %q and error %v, want the oldest bastion", target, err)
+	}
+	// The current target is kept while it matches, so tunnels do not move
+	target, err = selector.Resolve(t.Context(), server.Client(), fleet, "i-0000000000000000b")
+	if err != nil || target != "i-0000000000000000b" {
+		t.Errorf("got target %q and error %v, want the current bastion", target, err)
+	}
+	target, err = selector.Resolve(t.Context(), server.Client(), fleet, "i-00000000000000off")
+	if err != nil || target != "i-0000000000000000a" {
+		t.Errorf("got target %q and error %v, want the offline bastion replaced", target, err)
+	}
+
+	selector.Tags = map[string]string{"Role": "cache"}
+	if _, err := selector.Resolve(t.Context(), server.Client(), fleet, ""); !errors.Is(err, ssmtunnels.ErrNoTarget) {
+		t.Errorf("got %v, want ErrNoTarget", err)
+	}
+}
+
+func TestTargetSelectorWaitResolve(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(ssmtunnelstest.Instance{
+		ID:         testTarget,
+		Tags:       map[string]string{"Role": "bastion"},
+		PingStatus: ssmtypes.PingStatusConnectionLost,
+	})
+	server := newFleetServer(t, fleet)
+	selector := ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}}
+
+	time.AfterFunc(200*time.Millisecond, func() {
+		fleet.SetPingStatus(testTarget, ssmtypes.PingStatusOnline)
+	})
+	target, err := selector.WaitResolve(t.Context(), server.Client(), fleet, "", 20*time.Millisecond)
+	if err != nil || target != testTarget {
+		t.Fatalf("got target %q and error %v, want the bastion once online", target, err)
+	}
+
+	fleet.SetPingStatus(testTarget, ssmtypes.PingStatusConnectionLost)
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := selector.WaitResolve(ctx, server.Client(), fleet, "", 20*time.Millisecond); !errors.Is(err, ssmtunnels.ErrNoTarget) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want ErrNoTarget once the deadline is exceeded", err)
+	}
+}
+
+func TestTargetSelectorValidate(t *testing.T) {
+	tests := map[string]struct {
+		selector ssmtunnels.TargetSelector
+		valid    bool
+	}{
+		"tags":             {selector: ssmtunnels.TargetSelector{Tags: map[string]string{"Role": "bastion"}}, valid: true},
+		"known strategy":   {selector: ssmtunnels.TargetSelector{Strategy: ssmtunnels.TargetStrategyRandom}, valid: true},
+		"unknown strategy": {selector: ssmtunnels.TargetSelector{Strategy: "first"}},
+		"ping status":      {selector: ssmtunnels.TargetSelector{Filters: map[string][]string{"PingStatus": {"Online"}}}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := test.selector.Validate(); (err == nil) != test.valid {
+				t.Errorf("got %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestWaitForTarget(t *testing.T) {
+	fleet := ssmtunnelstest.NewFleet(
+		ssmtunnelstest.Instance{ID: testTarget, PingStatus: ssmtypes.PingStatusConnectionLost},
+		ssmtunnelstest.Instance{ID: "i-0fedcba9876543210", PingStatus: ssmtypes.PingStatusInactive},
+	)
+	server := newFleetServer(t, fleet)
+	targets := []string{testTarget, "i-0fedcba9876543210"}
+
+	// Any of the targets coming online ends the wait
+	start := time.Now()
+	time.AfterFunc(200*time.Millisecond, func() {
+		fleet.SetPingStatus("i-0fedcba9876543210", ssmtypes.PingStatusOnline)
+	})
+	if err := ssmtunnels.WaitForTarget(t.Context(), server.Client(), targets, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("waited %s, before the target came online", elapsed)
+	}
+}
+
+func TestWaitForTargetTimeout(t *testing.T) {
+	// The agent of the instance has not registered yet
+	server := newFleetServer(t, ssmtunnelstest.NewFleet())
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if err := ssmtunnels.WaitForTarget(ctx, server.Client(), []string{testTarget}, 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline to be exceeded", err)
+	}
+}
@@ -0,0 +1,299 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTunnelClosed is returned when waiting on a tunnel that already stopped
+// without an error.
+var ErrTunnelClosed = errors.New("tunnel closed")
+
+// idlePollInterval is how often WaitIdle checks a tunnel with active
+// connections.
+const idlePollInterval = 100 * time.Millisecond
+
+// probeGracePeriod is how long Probe waits for the agent to report a failed
+// connection to the remote port before it assumes the connection succeeded.
+const probeGracePeriod = 2 * time.Second
+
+// TunnelState describes where a Tunnel is in its lifecycle.
+type TunnelState int32
+
+const (
+	// TunnelStarting means the session was started but the data channel is not ready yet.
+	TunnelStarting TunnelState = iota
+	// TunnelReady means client connections are being forwarded.
+	TunnelReady
+	// TunnelDegraded means the tunnel is still open but forwarding is impaired,
+	// for example because the agent could not reach the remote port.
+	TunnelDegraded
+	// TunnelClosed means the tunnel stopped and its session was terminated.
+	TunnelClosed
+)
+
+func (s TunnelState) String() string {
+	switch s {
+	case TunnelStarting:
+		return "starting"
+	case TunnelReady:
+		return "ready"
+	case TunnelDegraded:
+		return "degraded"
+	case TunnelClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Tunnel is a running port forwarding session returned by StartRemoteTunnel.
+type Tunnel struct {
+	localAddr net.Addr
+	cancel    func()
+
+	mu        sync.Mutex
+	sessionID string
+	target    string
+
+	state         atomic.Int32
+	connectErrors atomic.Int64 // Number of ConnectToPortError flags received from the agent
+
+	activeConns   atomic.Int64
+	totalConns    atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	lastActivity  atomic.Int64 // Unix nanoseconds of the last connection or transfer
+	ready         chan struct{}
+	done          chan struct{}
+	err           error
+}
+
+// SessionID returns the ID of the SSM session currently backing the tunnel.
+// It changes when a lost session is replaced with a new one.
+func (t *Tunnel) SessionID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessionID
+}
+
+// Target returns the target the current session runs on. It changes when the
+// tunnel fails over to another target.
+func (t *Tunnel) Target() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.target
+}
+
+func (t *Tunnel) setSession(sessionID, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessionID = sessionID
+	t.target = target
+}
+
+// LocalAddr returns the address the local listener is bound to.
+func (t *Tunnel) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+// LocalPort returns the port the local listener is bound to.
+func (t *Tunnel) LocalPort() int {
+	if addr, ok := t.localAddr.(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Ready is closed once the tunnel starts forwarding client connections. It is
+// never closed if the tunnel fails before that, so callers should also watch Done.
+func (t *Tunnel) Ready() <-chan struct{} {
+	return t.ready
+}
+
+// Done is closed once the tunnel terminated.
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// WaitReady blocks until the local listener is bound and the data channel
+// handshake completed, the tunnel stops, or ctx is done.
+func (t *Tunnel) WaitReady(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-t.done:
+		if err := t.Wait(); err != nil {
+			return err
+		}
+		return ErrTunnelClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Probe checks end to end that the remote port can be reached through the
+// tunnel by opening a connection and watching for the agent to report a
+// connection failure. Servers that close new connections right away are
+// reported as unreachable.
+func (t *Tunnel) Probe(ctx context.Context) error {
+	if err := t.WaitReady(ctx); err != nil {
+		return err
+	}
+
+	failuresBefore := t.connectErrors.Load()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.localAddr.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to the local listener: %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(probeGracePeriod)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, 1))
+
+	var netErr net.Error
+	switch {
+	case t.connectErrors.Load() > failuresBefore:
+		return fmt.Errorf("the agent could not connect to the remote port")
+	case err == nil, errors.As(err, &netErr) && netErr.Timeout():
+		// Either the remote sent data or it is waiting for the client to speak.
+		t.state.CompareAndSwap(int32(TunnelDegraded), int32(TunnelReady))
+		return nil
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("the connection to the remote port was closed immediately")
+	default:
+		return fmt.Errorf("probe failed: %w", err)
+	}
+}
+
+// Wait blocks until the tunnel terminated and returns the error that ended
+// it. It returns nil if the tunnel was closed on purpose, unless its session
+// could not be terminated.
+func (t *Tunnel) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// Close stops the tunnel, terminates its session and waits for it to finish.
+func (t *Tunnel) Close() error {
+	t.cancel()
+	return t.Wait()
+}
+
+// State returns the current lifecycle state of the tunnel.
+func (t *Tunnel) State() TunnelState {
+	return TunnelState(t.state.Load())
+}
+
+func (t *Tunnel) setState(state TunnelState) {
+	t.state.Store(int32(state))
+}
+
+// TunnelStats counts the client connections forwarded by a tunnel, across
+// the sessions it went through.
+type TunnelStats struct {
+	// ActiveConnections is the number of client connections being forwarded.
+	ActiveConnections int64
+	// Connections is the number of client connections accepted so far.
+	Connections int64
+	// BytesSent is the number of bytes read from clients and sent to the remote port.
+	BytesSent int64
+	// BytesReceived is the number of bytes from the remote port written to clients.
+	BytesReceived int64
+	// LastActivity is when a connection was last opened, closed or
+	// transferred data, or when the tunnel started.
+	LastActivity time.Time
+}
+
+// Stats returns the connection counts of the tunnel.
+func (t *Tunnel) Stats() TunnelStats {
+	return TunnelStats{
+		ActiveConnections: t.activeConns.Load(),
+		Connections:       t.totalConns.Load(),
+		BytesSent:         t.bytesSent.Load(),
+		BytesReceived:     t.bytesReceived.Load(),
+		LastActivity:      time.Unix(0, t.lastActivity.Load()),
+	}
+}
+
+// WaitIdle blocks until the tunnel had no client connections and no traffic
+// for idle, the tunnel stops, or ctx is done.
+func (t *Tunnel) WaitIdle(ctx context.Context, idle time.Duration) error {
+	for {
+		wait := idlePollInterval
+		if t.activeConns.Load() == 0 {
+			wait = idle - time.Since(time.Unix(0, t.lastActivity.Load()))
+			if wait <= 0 {
+				return nil
+			}
+		}
+		select {
+		case <-t.done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Drain blocks until the tunnel has no client connections, the tunnel
+// stops, or ctx is done.
+func (t *Tunnel) Drain(ctx context.Context) error {
+	return t.WaitIdle(ctx, 0)
+}
+
+func (t *Tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// countConn returns conn counting the bytes it transfers in the tunnel's
+// stats, and counts it as active until connClosed is called.
+func (t *Tunnel) countConn(conn net.Conn) net.Conn {
+	t.totalConns.Add(1)
+	t.activeConns.Add(1)
+	t.touch()
+	return &countingConn{Conn: conn, tunnel: t}
+}
+
+func (t *Tunnel) connClosed() {
+	t.activeConns.Add(-1)
+	t.touch()
+}
+
+// countingConn is a client connection counted in the stats of its tunnel.
+type countingConn struct {
+	net.Conn
+	tunnel *Tunnel
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tunnel.bytesSent.Add(int64(n))
+		c.tunnel.touch()
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.tunnel.bytesReceived.Add(int64(n))
+		c.tunnel.touch()
+	}
+	return n, err
+}
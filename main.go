@@ -7,6 +7,10 @@ import (
 	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/provider"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
@@ -42,7 +46,33 @@ func main() {
 		Debug:   debug,
 	}
 
-	err := providerserver.Serve(context.Background(), provider.New(version), opts)
+	// The root context is canceled on SIGTERM, and once the plugin server
+	// shut down, so the provider closes its tunnels and terminates their
+	// sessions before the process exits. Terraform forwards Ctrl-C to its
+	// plugins, which ignore SIGINT and keep serving until it is done with
+	// them, so SIGINT does not cancel it.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	var shutdown sync.WaitGroup
+
+	// SIGTERM does not stop the plugin server, so the process exits once the
+	// tunnels are closed.
+	served := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-served:
+			// The context was canceled once the server shut down
+		default:
+			shutdown.Wait()
+			os.Exit(128 + int(syscall.SIGTERM))
+		}
+	}()
+
+	err := providerserver.Serve(ctx, provider.New(ctx, version, &shutdown), opts)
+
+	close(served)
+	stop()
+	shutdown.Wait()
 
 	if err != nil {
 		log.Fatal(err.Error())